@@ -0,0 +1,62 @@
+/*
+ *
+ *      echobot.go
+ *      Example Paizer bot, repeats "!echo" commands
+ *
+ *      Based on MIT open source agreement
+ *      Copyright © 2020 ViudiraTech, based on the MIT agreement.
+ *
+ */
+
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+
+	"Paizer-Open-source-instant-messenger/paizer"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1", "Server address")
+	name := flag.String("name", "echobot", "Bot nickname")
+	rooms := flag.String("rooms", "", "Comma separated rooms to join")
+	flag.Parse()
+
+	bot := paizer.New(paizer.Config{Addr: *addr, Nickname: *name, Reconnect: true})
+
+	router := paizer.NewRouter("!")
+	router.Handle("echo", "Repeat the text after the command", func(ctx *paizer.Context) {
+		if ctx.Text != "" {
+			ctx.Reply(ctx.Text)
+		}
+	})
+	router.Handle("ping", "Check that the bot is alive", func(ctx *paizer.Context) {
+		ctx.Reply("pong")
+	})
+	router.Attach(bot)
+
+	/* Join the rooms on every login, the server answers members with a notice */
+	bot.On("system", func(ev paizer.Event) {
+		if ev.UID == "" || *rooms == "" {
+			return
+		}
+		for _, room := range strings.Split(*rooms, ",") {
+			bot.JoinRoom(strings.TrimSpace(room))
+		}
+	})
+	bot.On(paizer.EventDisconnected, func(ev paizer.Event) {
+		log.Printf("Disconnected: %s, reconnecting", ev.Content)
+	})
+
+	if err := bot.Connect(); err != nil {
+		log.Fatalf("Unable to connect: %v", err)
+	}
+	log.Printf("Connected as %s", bot.Username())
+
+	<-bot.Done()
+	if err := bot.Err(); err != nil {
+		log.Fatalf("Stopped: %v", err)
+	}
+}
@@ -0,0 +1,656 @@
+/*
+ *
+ *      client.go
+ *      Paizer client library, for bots and the terminal client
+ *
+ *      Based on MIT open source agreement
+ *      Copyright © 2020 ViudiraTech, based on the MIT agreement.
+ *
+ */
+
+/*
+ * Package paizer connects to a Paizer server over its TCP protocol. It logs in
+ * or resumes a session, answers heartbeats, reconnects when the connection
+ * drops and delivers every server message as a typed Event, through callbacks
+ * registered with On or through the Events channel.
+ *
+ *	bot := paizer.New(paizer.Config{Addr: "127.0.0.1", Nickname: "bot", Reconnect: true})
+ *	bot.On("chat", func(ev paizer.Event) { ... })
+ *	if err := bot.Connect(); err != nil { ... }
+ *	<-bot.Done()
+ */
+package paizer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPort    = "32768"
+	heartbeatDelay = 5 * time.Second
+	timeoutLimit   = 10 * time.Second
+	fileChunkSize  = 32 * 1024
+	maxBackoff     = 30 * time.Second
+)
+
+/* Returned by Connect when the session token was rejected and there is no nickname to fall back to */
+var ErrTokenInvalid = errors.New("paizer: session token rejected")
+
+/* A message from the server, the same JSON object the server sends WebSocket clients */
+type Event struct {
+	Type      string                 `json:"type"` // "chat", "join", "leave", "dm", "mention", "file", "system", "room_joined", ...
+	ID        string                 `json:"id,omitempty"`
+	UID       string                 `json:"uid,omitempty"`
+	User      string                 `json:"user,omitempty"`
+	Content   string                 `json:"content,omitempty"`
+	IP        string                 `json:"ip,omitempty"`
+	Mentions  []string               `json:"mentions,omitempty"`
+	Time      int64                  `json:"time,omitempty"` // Unix milliseconds
+	File      *FileInfo              `json:"file,omitempty"`
+	Token     string                 `json:"token,omitempty"`
+	To        string                 `json:"to,omitempty"`
+	E2E       json.RawMessage        `json:"e2e,omitempty"` // End-to-end encrypted payload, Content is empty
+	Keys      []DeviceKey            `json:"keys,omitempty"`
+	OwnKeys   []DeviceKey            `json:"own_keys,omitempty"`
+	Room      string                 `json:"room,omitempty"`
+	Encrypted bool                   `json:"encrypted,omitempty"`
+	RoomKeys  map[string][]DeviceKey `json:"room_keys,omitempty"`
+	Search    *SearchPage            `json:"search,omitempty"` // Results of a "search_results" event
+	Role      string                 `json:"role,omitempty"`   // Role of the sender of a chat or file event, empty for members
+}
+
+/* A page of search results, the matches in Snippet are wrapped in ** */
+type SearchPage struct {
+	Query   string         `json:"query"`
+	Page    int            `json:"page"`
+	Pages   int            `json:"pages"`
+	Total   int            `json:"total"`
+	Results []SearchResult `json:"results,omitempty"`
+}
+
+type SearchResult struct {
+	ID      string `json:"id"`
+	Room    string `json:"room,omitempty"`
+	User    string `json:"user"`
+	To      string `json:"to,omitempty"` // Recipient of a direct message
+	Time    int64  `json:"time"`
+	Snippet string `json:"snippet"`
+}
+
+type FileInfo struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	MIME   string `json:"mime"`
+	SHA256 string `json:"sha256"`
+	URL    string `json:"url"`
+}
+
+type DeviceKey struct {
+	Device    string `json:"device"`
+	Key       string `json:"key"`
+	Published int64  `json:"published,omitempty"`
+}
+
+type Config struct {
+	Addr      string             // Server address, the default port is used when it has none
+	Nickname  string             // Logs in with this name when there is no token or it is rejected
+	Token     string             // Session token of a previous login, resumes that session
+	OnToken   func(token string) // Called with every new session token, to store it
+	Reconnect bool               // Reconnect and resume the session when the connection drops
+}
+
+type Client struct {
+	cfg      Config
+	addr     string
+	mu       sync.Mutex // Guards the fields below
+	conn     net.Conn
+	uid      string
+	user     string
+	token    string
+	handlers map[string][]func(Event)
+	events   chan Event
+	writeMu  sync.Mutex
+	closed   chan struct{}
+	done     chan struct{}
+	err      error
+}
+
+/* Synthetic events, they are not sent by the server */
+const (
+	EventDisconnected = "disconnected" // The connection dropped, Content holds the error
+	EventReconnecting = "reconnecting" // A reconnection attempt failed, Content holds the error
+)
+
+func New(cfg Config) *Client {
+	return &Client{
+		cfg:      cfg,
+		token:    cfg.Token,
+		handlers: make(map[string][]func(Event)),
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+/* Normalize a server address, adding the default port and IPv6 brackets */
+func ResolveAddress(addr string) (string, error) {
+	if strings.Contains(addr, "[") && strings.Contains(addr, "]") {
+		return addr, nil
+	}
+	if strings.Contains(addr, ":") {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", err
+		}
+		if strings.Contains(host, ":") {
+			return "[" + host + "]:" + port, nil
+		}
+		return addr, nil
+	}
+	return net.JoinHostPort(addr, DefaultPort), nil
+}
+
+/*
+ * Register a callback for an event type, or "*" for every event. Callbacks run
+ * one at a time on the connection's goroutine, so they should not block for long.
+ */
+func (c *Client) On(eventType string, handler func(Event)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.handlers[eventType] = append(c.handlers[eventType], handler)
+}
+
+/* Every event, after the callbacks have run. Call it before Connect, the channel must be drained */
+func (c *Client) Events() <-chan Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.events == nil {
+		c.events = make(chan Event, 64)
+	}
+	return c.events
+}
+
+/* Log in, then read events and send heartbeats in the background until Close */
+func (c *Client) Connect() error {
+	addr, err := ResolveAddress(c.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	c.addr = addr
+
+	conn, reader, events, err := c.handshake()
+	if err != nil {
+		return err
+	}
+	for _, ev := range events {
+		c.dispatch(ev)
+	}
+	go c.run(conn, reader)
+	return nil
+}
+
+/*
+ * Log in and wait for the welcome, it is returned first followed by the messages
+ * that arrived before it, like broadcasts sent while the session was set up
+ */
+func (c *Client) handshake() (net.Conn, *bufio.Reader, []Event, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, timeoutLimit)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	fail := func(err error) (net.Conn, *bufio.Reader, []Event, error) {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+
+	c.mu.Lock()
+	token := c.token
+	c.mu.Unlock()
+
+	login := "PROTOCOL JSON\n"
+	if token != "" {
+		login += "TOKEN " + token + "\n"
+	} else if c.cfg.Nickname != "" {
+		login += c.cfg.Nickname + "\n"
+	} else {
+		return fail(errors.New("paizer: a nickname or a session token is required"))
+	}
+	if _, err := conn.Write([]byte(login)); err != nil {
+		return fail(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	var early []Event
+	var notice string
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeoutLimit))
+		ev, err := readEvent(reader)
+		if err != nil {
+			/* A refused login, like a ban, is a notice followed by the server closing the connection */
+			if notice != "" {
+				return fail(errors.New(notice))
+			}
+			return fail(err)
+		}
+
+		switch {
+		case ev.Type == "token_invalid":
+			c.mu.Lock()
+			c.token = ""
+			c.mu.Unlock()
+			if c.cfg.Nickname == "" {
+				return fail(ErrTokenInvalid)
+			}
+			if _, err := conn.Write([]byte(c.cfg.Nickname + "\n")); err != nil {
+				return fail(err)
+			}
+
+		case ev.Type == "system" && ev.UID != "":
+			c.mu.Lock()
+			c.conn, c.uid, c.user = conn, ev.UID, ev.User
+			if ev.Token != "" {
+				c.token = ev.Token
+			}
+			c.mu.Unlock()
+			if ev.Token != "" && c.cfg.OnToken != nil {
+				c.cfg.OnToken(ev.Token)
+			}
+			return conn, reader, append([]Event{ev}, early...), nil
+
+		case ev.Type == "system":
+			notice = ev.Content
+			early = append(early, ev)
+
+		default:
+			early = append(early, ev)
+		}
+	}
+}
+
+func readEvent(reader *bufio.Reader) (Event, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return Event{}, err
+	}
+	var ev Event
+	if err := json.Unmarshal([]byte(line), &ev); err != nil {
+		return Event{}, fmt.Errorf("paizer: invalid message from server: %w", err)
+	}
+	return ev, nil
+}
+
+/* Read events until the connection drops, then reconnect or stop */
+func (c *Client) run(conn net.Conn, reader *bufio.Reader) {
+	for {
+		err := c.serve(conn, reader)
+
+		select {
+		case <-c.closed:
+			c.finish(nil)
+			return
+		default:
+		}
+		if !c.cfg.Reconnect {
+			c.finish(err)
+			return
+		}
+		c.dispatch(Event{Type: EventDisconnected, Content: err.Error()})
+
+		backoff := time.Second
+		for {
+			select {
+			case <-c.closed:
+				c.finish(nil)
+				return
+			case <-time.After(backoff):
+			}
+
+			var events []Event
+			conn, reader, events, err = c.handshake()
+			if err == nil {
+				for _, ev := range events {
+					c.dispatch(ev)
+				}
+				break
+			}
+			if errors.Is(err, ErrTokenInvalid) {
+				c.finish(err)
+				return
+			}
+			c.dispatch(Event{Type: EventReconnecting, Content: err.Error()})
+			backoff = min(backoff*2, maxBackoff)
+		}
+	}
+}
+
+/* Handle one connection, heartbeats are sent here and expected back within the timeout */
+func (c *Client) serve(conn net.Conn, reader *bufio.Reader) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(heartbeatDelay)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				c.SendLine("HEARTBEAT")
+			}
+		}
+	}()
+
+	defer func() {
+		conn.Close()
+		c.mu.Lock()
+		if c.conn == conn {
+			c.conn = nil
+		}
+		c.mu.Unlock()
+	}()
+	for {
+		conn.SetReadDeadline(time.Now().Add(timeoutLimit))
+		ev, err := readEvent(reader)
+		if err != nil {
+			return err
+		}
+		if ev.Type == "heartbeat" {
+			continue
+		}
+		if ev.Token != "" {
+			c.mu.Lock()
+			c.token = ev.Token
+			c.mu.Unlock()
+			if c.cfg.OnToken != nil {
+				c.cfg.OnToken(ev.Token)
+			}
+		}
+		c.dispatch(ev)
+	}
+}
+
+func (c *Client) dispatch(ev Event) {
+	c.mu.Lock()
+	handlers := append(append([]func(Event){}, c.handlers[ev.Type]...), c.handlers["*"]...)
+	events := c.events
+	c.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(ev)
+	}
+	if events != nil {
+		select {
+		case events <- ev:
+		case <-c.closed:
+		}
+	}
+}
+
+func (c *Client) finish(err error) {
+	c.mu.Lock()
+	c.err = err
+	events := c.events
+	c.mu.Unlock()
+
+	if events != nil {
+		close(events)
+	}
+	close(c.done)
+}
+
+/* Closed when the client stops, after Close or when the connection is lost for good */
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+/* Why the client stopped, nil after Close */
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+func (c *Client) Close() error {
+	select {
+	case <-c.closed:
+		return nil
+	default:
+		close(c.closed)
+	}
+
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+/* Session UID of the current connection */
+func (c *Client) UID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.uid
+}
+
+/* Nickname the server logged us in as */
+func (c *Client) Username() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.user
+}
+
+/* Latest session token, to resume the session later */
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.token
+}
+
+/* Send a raw protocol line, such as a slash command */
+func (c *Client) SendLine(line string) error {
+	if strings.ContainsAny(line, "\r\n") {
+		return errors.New("paizer: a line cannot contain line breaks")
+	}
+
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return errors.New("paizer: not connected")
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := conn.Write([]byte(line + "\n"))
+	return err
+}
+
+/* Post to the main chat, text starting with '/' or '#' is read as a command or a room message */
+func (c *Client) Send(text string) error {
+	return c.SendLine(text)
+}
+
+/* Post to a room the account is a member of */
+func (c *Client) SendRoom(room string, text string) error {
+	return c.SendLine("#" + strings.TrimPrefix(room, "#") + " " + text)
+}
+
+/* Send an unencrypted direct message */
+func (c *Client) DM(to string, text string) error {
+	return c.SendLine("/msg " + to + " " + text)
+}
+
+func (c *Client) CreateRoom(room string, encrypted bool) error {
+	if encrypted {
+		return c.SendLine("/create " + room + " e2e")
+	}
+	return c.SendLine("/create " + room)
+}
+
+func (c *Client) JoinRoom(room string) error {
+	return c.SendLine("/join " + room)
+}
+
+/* Join a password protected or invite-only room with its password or an invite code */
+func (c *Client) JoinRoomWithKey(room string, key string) error {
+	return c.SendLine("/join " + room + " " + key)
+}
+
+/* Invite a user to a room, they receive an "invite" event */
+func (c *Client) Invite(user string, room string) error {
+	return c.SendLine("/invite " + user + " " + room)
+}
+
+func (c *Client) LeaveRoom(room string) error {
+	return c.SendLine("/leave " + room)
+}
+
+/* Change the topic of a room, an empty topic clears it. Members see a "topic_change" event */
+func (c *Client) SetTopic(room string, topic string) error {
+	if strings.TrimSpace(topic) == "" {
+		topic = "-"
+	}
+	return c.SendLine("/topic " + room + " " + topic)
+}
+
+/* Give a user a role on the server, or in a room when room is not empty */
+func (c *Client) Grant(user string, role string, room string) error {
+	return c.SendLine(strings.TrimSpace("/grant " + user + " " + role + " " + room))
+}
+
+/* Take a user's role away, they fall back to the default role */
+func (c *Client) Ungrant(user string, room string) error {
+	return c.SendLine(strings.TrimSpace("/ungrant " + user + " " + room))
+}
+
+/* Disconnect a user, or remove them from a room when room is not empty */
+func (c *Client) Kick(user string, room string, reason string) error {
+	line := "/kick " + user
+	if room != "" {
+		line += " #" + strings.TrimPrefix(room, "#")
+	}
+	return c.SendLine(strings.TrimSpace(line + " " + reason))
+}
+
+/* Upload a file and share it, the server announces it with a "file" event */
+func (c *Client) SendFile(name string, data []byte) error {
+	sum := sha256.Sum256(data)
+	lines := []string{fmt.Sprintf("FILE BEGIN %d %s %s", len(data), hex.EncodeToString(sum[:]), name)}
+	for offset := 0; offset < len(data); offset += fileChunkSize {
+		end := min(offset+fileChunkSize, len(data))
+		lines = append(lines, "FILE CHUNK "+base64.StdEncoding.EncodeToString(data[offset:end]))
+	}
+	lines = append(lines, "FILE END")
+
+	for _, line := range lines {
+		if err := c.SendLine(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* Search the history, the results arrive as a "search_results" event */
+func (c *Client) Search(query string) error {
+	return c.SendLine("/search " + query)
+}
+
+/* End the session and revoke its token */
+func (c *Client) Logout() error {
+	return c.SendLine("/logout")
+}
+
+/* Render an event the way the server renders it for text clients */
+func (ev Event) String() string {
+	t := time.Now()
+	if ev.Time != 0 {
+		t = time.UnixMilli(ev.Time)
+	}
+	stamp := t.Format("15:04:05")
+
+	switch ev.Type {
+	case "chat":
+		if ev.Room != "" {
+			return fmt.Sprintf("[%s] [#%s] [%s] %s", stamp, ev.Room, ev.sender(), ev.Content)
+		}
+		return fmt.Sprintf("[%s] [%s] %s", stamp, ev.sender(), ev.Content)
+	case "join":
+		return fmt.Sprintf("[%s] %s joined the chat", stamp, ev.sender())
+	case "leave":
+		return fmt.Sprintf("[%s] %s left the chat", stamp, ev.sender())
+	case "file":
+		if ev.File == nil {
+			break
+		}
+		return fmt.Sprintf("[%s] [%s] shared a file: %s (%s, %d bytes) /get %s",
+			stamp, ev.sender(), ev.File.Name, ev.File.MIME, ev.File.Size, ev.File.ID[:min(12, len(ev.File.ID))])
+	case "dm":
+		return fmt.Sprintf("[%s] [%s -> %s] %s", stamp, ev.sender(), ev.To, ev.Content)
+	case "mention":
+		where := ""
+		if ev.Room != "" {
+			where = " in #" + ev.Room
+		}
+		if ev.Content == "" {
+			return fmt.Sprintf("[%s] %s mentioned you%s", stamp, ev.sender(), where)
+		}
+		return fmt.Sprintf("[%s] %s mentioned you%s: %s", stamp, ev.sender(), where, ev.Content)
+	case "room_joined", "room_left", "room_join", "room_leave":
+		return fmt.Sprintf("[%s] %s", stamp, ev.Content)
+	case "topic_change":
+		if ev.Content == "" {
+			return fmt.Sprintf("[%s] %s cleared the topic of #%s", stamp, ev.sender(), ev.Room)
+		}
+		return fmt.Sprintf("[%s] %s changed the topic of #%s to: %s", stamp, ev.sender(), ev.Room, ev.Content)
+	case "search_results":
+		if ev.Search == nil {
+			break
+		}
+		lines := []string{ev.Content}
+		for _, result := range ev.Search.Results {
+			where := ""
+			if result.Room != "" {
+				where = " [#" + result.Room + "]"
+			}
+			who := result.User
+			if result.To != "" {
+				who += " -> " + result.To
+			}
+			lines = append(lines, fmt.Sprintf("  [%s]%s [%s] %s",
+				time.UnixMilli(result.Time).Format("2006-01-02 15:04"), where, who, result.Snippet))
+		}
+		return strings.Join(lines, "\n")
+	}
+	return ev.Content
+}
+
+/* user@ip, users of federated servers arrive as nick@server without an address */
+func (ev Event) sender() string {
+	name := ev.User
+	if ev.IP != "" {
+		name += "@" + ev.IP
+	}
+	if ev.Role != "" {
+		name += " (" + ev.Role + ")"
+	}
+	return name
+}
@@ -0,0 +1,156 @@
+package paizer
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* Accept one connection and run script on it, the client dials the returned address */
+func fakeServer(t *testing.T, script func(conn net.Conn, reader *bufio.Reader)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		script(conn, bufio.NewReader(conn))
+	}()
+	return listener.Addr().String()
+}
+
+func writeEvent(conn net.Conn, ev Event) {
+	data, _ := json.Marshal(ev)
+	conn.Write(append(data, '\n'))
+}
+
+/* Read the login lines up to the nickname or token */
+func readLogin(t *testing.T, reader *bufio.Reader) []string {
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Error(err)
+			return lines
+		}
+		lines = append(lines, strings.TrimSpace(line))
+		if lines[len(lines)-1] != "PROTOCOL JSON" {
+			return lines
+		}
+	}
+}
+
+func TestResolveAddress(t *testing.T) {
+	tests := map[string]string{
+		"127.0.0.1":        "127.0.0.1:" + DefaultPort,
+		"example.com:4000": "example.com:4000",
+		"[::1]:4000":       "[::1]:4000",
+	}
+	for addr, want := range tests {
+		got, err := ResolveAddress(addr)
+		if err != nil || got != want {
+			t.Errorf("ResolveAddress(%q) = %q, %v, want %q", addr, got, err, want)
+		}
+	}
+}
+
+func TestConnectWaitsForWelcome(t *testing.T) {
+	done := make(chan struct{})
+	addr := fakeServer(t, func(conn net.Conn, reader *bufio.Reader) {
+		if login := readLogin(t, reader); strings.Join(login, ",") != "PROTOCOL JSON,bot" {
+			t.Errorf("login = %q", login)
+		}
+		/* Broadcasts can arrive before the welcome, none of them ends the handshake */
+		writeEvent(conn, Event{Type: "chat", UID: "other", User: "alice", Content: "hi"})
+		writeEvent(conn, Event{Type: "system", Content: "Server restarts at noon"})
+		writeEvent(conn, Event{Type: "system", UID: "u1", User: "bot", Token: "tok", Content: "You have successfully joined the server!"})
+		<-done
+	})
+	defer close(done)
+
+	var tokens []string
+	client := New(Config{Addr: addr, Nickname: "bot", OnToken: func(token string) { tokens = append(tokens, token) }})
+	events := client.Events()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if client.UID() != "u1" || client.Username() != "bot" || client.Token() != "tok" {
+		t.Errorf("session = %q %q %q", client.UID(), client.Username(), client.Token())
+	}
+	if len(tokens) != 1 || tokens[0] != "tok" {
+		t.Errorf("OnToken calls = %q", tokens)
+	}
+
+	/* The welcome comes first, then what arrived before it */
+	for _, want := range []string{"system:You have successfully joined the server!", "chat:hi", "system:Server restarts at noon"} {
+		select {
+		case ev := <-events:
+			if got := ev.Type + ":" + ev.Content; got != want {
+				t.Errorf("event = %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("missing event %q", want)
+		}
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	addr := fakeServer(t, func(conn net.Conn, reader *bufio.Reader) {
+		readLogin(t, reader)
+		writeEvent(conn, Event{Type: "system", Content: "You are banned from this server."})
+	})
+
+	err := New(Config{Addr: addr, Nickname: "bot"}).Connect()
+	if err == nil || err.Error() != "You are banned from this server." {
+		t.Errorf("Connect() = %v, want the ban notice", err)
+	}
+}
+
+func TestConnectFallsBackToNickname(t *testing.T) {
+	done := make(chan struct{})
+	addr := fakeServer(t, func(conn net.Conn, reader *bufio.Reader) {
+		if login := readLogin(t, reader); login[len(login)-1] != "TOKEN expired" {
+			t.Errorf("login = %q", login)
+		}
+		writeEvent(conn, Event{Type: "token_invalid", Content: "Session token rejected: expired"})
+		if nick, _ := reader.ReadString('\n'); nick != "bot\n" {
+			t.Errorf("nickname = %q", nick)
+		}
+		writeEvent(conn, Event{Type: "system", UID: "u2", User: "bot", Token: "new"})
+		<-done
+	})
+	defer close(done)
+
+	client := New(Config{Addr: addr, Nickname: "bot", Token: "expired"})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if client.UID() != "u2" || client.Token() != "new" {
+		t.Errorf("session = %q %q", client.UID(), client.Token())
+	}
+}
+
+func TestConnectTokenInvalid(t *testing.T) {
+	addr := fakeServer(t, func(conn net.Conn, reader *bufio.Reader) {
+		readLogin(t, reader)
+		writeEvent(conn, Event{Type: "token_invalid", Content: "Session token rejected: revoked"})
+		reader.ReadString('\n')
+	})
+
+	if err := New(Config{Addr: addr, Token: "revoked"}).Connect(); err != ErrTokenInvalid {
+		t.Errorf("Connect() = %v, want ErrTokenInvalid", err)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ *
+ *      router.go
+ *      Command router for "!command" style bots
+ *
+ *      Based on MIT open source agreement
+ *      Copyright © 2020 ViudiraTech, based on the MIT agreement.
+ *
+ */
+
+package paizer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/* A command invocation, replies go back where the command was sent */
+type Context struct {
+	Client  *Client
+	Event   Event
+	Command string
+	Args    []string
+	Text    string // Everything after the command name
+}
+
+/* Answer in the same room, the main chat or as a direct message to the sender */
+func (ctx *Context) Reply(text string) error {
+	switch {
+	case ctx.Event.Type == "dm":
+		return ctx.Client.DM(ctx.Event.User, text)
+	case ctx.Event.Room != "":
+		return ctx.Client.SendRoom(ctx.Event.Room, text)
+	}
+	return ctx.Client.Send(text)
+}
+
+type HandlerFunc func(ctx *Context)
+
+type command struct {
+	help    string
+	handler HandlerFunc
+}
+
+/* Dispatches chat lines and direct messages that start with a prefix, such as "!echo hello" */
+type Router struct {
+	prefix   string
+	mu       sync.Mutex
+	commands map[string]command
+}
+
+/* A router with a built-in "help" command that lists the others */
+func NewRouter(prefix string) *Router {
+	r := &Router{prefix: prefix, commands: make(map[string]command)}
+	r.Handle("help", "List the commands", func(ctx *Context) {
+		ctx.Reply(r.Help())
+	})
+	return r
+}
+
+func (r *Router) Handle(name string, help string, handler HandlerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands[strings.ToLower(name)] = command{help: help, handler: handler}
+}
+
+/* One line listing every command, for the help reply */
+func (r *Router) Help() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.commands))
+	for name := range r.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s%s: %s", r.prefix, name, r.commands[name].help))
+	}
+	return "Commands: " + strings.Join(parts, ", ")
+}
+
+/* Route the client's chat messages and direct messages, ignoring our own */
+func (r *Router) Attach(c *Client) {
+	c.On("chat", func(ev Event) { r.route(c, ev) })
+	c.On("dm", func(ev Event) { r.route(c, ev) })
+}
+
+func (r *Router) route(c *Client, ev Event) {
+	if strings.EqualFold(ev.User, c.Username()) || !strings.HasPrefix(ev.Content, r.prefix) {
+		return
+	}
+	fields := strings.Fields(strings.TrimPrefix(ev.Content, r.prefix))
+	if len(fields) == 0 {
+		return
+	}
+
+	name := strings.ToLower(fields[0])
+	r.mu.Lock()
+	cmd, exists := r.commands[name]
+	r.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	text := strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(ev.Content, r.prefix), fields[0]))
+	cmd.handler(&Context{Client: c, Event: ev, Command: name, Args: fields[1:], Text: text})
+}
@@ -0,0 +1,42 @@
+package paizer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRouterRoute(t *testing.T) {
+	client := New(Config{Nickname: "bot"})
+	client.user = "bot"
+	router := NewRouter("!")
+	var got []*Context
+	router.Handle("Echo", "Repeat the text", func(ctx *Context) { got = append(got, ctx) })
+	router.Attach(client)
+
+	client.dispatch(Event{Type: "chat", User: "alice", Room: "dev", Content: "!ECHO  hello   world "})
+	client.dispatch(Event{Type: "dm", User: "alice", Content: "!echo"})
+	client.dispatch(Event{Type: "chat", User: "Bot", Content: "!echo own messages are ignored"})
+	client.dispatch(Event{Type: "chat", User: "alice", Content: "echo without the prefix"})
+	client.dispatch(Event{Type: "chat", User: "alice", Content: "!unknown"})
+	client.dispatch(Event{Type: "system", Content: "!echo system messages are not routed"})
+
+	if len(got) != 2 {
+		t.Fatalf("handled %d commands, want 2", len(got))
+	}
+	if ctx := got[0]; ctx.Command != "echo" || strings.Join(ctx.Args, ",") != "hello,world" || ctx.Text != "hello   world" || ctx.Event.Room != "dev" {
+		t.Errorf("first command = %q %q %q in %q", ctx.Command, ctx.Args, ctx.Text, ctx.Event.Room)
+	}
+	if ctx := got[1]; ctx.Event.Type != "dm" || len(ctx.Args) != 0 || ctx.Text != "" {
+		t.Errorf("second command = %q %q %q", ctx.Event.Type, ctx.Args, ctx.Text)
+	}
+}
+
+func TestRouterHelp(t *testing.T) {
+	router := NewRouter("!")
+	router.Handle("roll", "Roll a die", func(*Context) {})
+
+	want := "Commands: !help: List the commands, !roll: Roll a die"
+	if got := router.Help(); got != want {
+		t.Errorf("Help() = %q, want %q", got, want)
+	}
+}
@@ -11,38 +11,756 @@
 package main
 
 import (
-    "bufio"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/ecdh"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
     "fmt"
+    "io"
     "log"
+    "mime"
     "net"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
     "strings"
     "time"
     "github.com/chzyer/readline"
+    "Paizer-Open-source-instant-messenger/paizer"
 )
 
 const (
-    defaultPort    = "32768"
-    heartbeatMsg   = "HEARTBEAT"
-    heartbeatDelay = 5 * time.Second
-    timeoutLimit   = 10 * time.Second
+    httpPort  = "8080"
+    e2ePrefix = "E2E "
 )
 
-/* Address resolution function */
-func parseAddress(addr string) (string, error) {
-    if strings.Contains(addr, "[") && strings.Contains(addr, "]") {
-        return addr, nil
+type deviceKey struct {
+    Device string `json:"device"`
+    Key    string `json:"key"`
+}
+
+/*
+ * One copy of an encrypted direct message, sealed for a single device. Room
+ * messages use a single envelope sealed with the sender key of the sending device.
+ */
+type envelope struct {
+    Device    string `json:"device"` // Recipient device ID, or the sending device for room messages
+    Sender    string `json:"sender"` // Sender identity key
+    Ephemeral string `json:"eph,omitempty"`
+    KeyID     string `json:"key_id,omitempty"` // Sender key of a room message
+    Nonce     string `json:"nonce"`
+    Data      string `json:"data"`
+}
+
+/* End-to-end encryption fields of a server event, and the JSON of outgoing "E2E" lines */
+type serverMessage struct {
+    Type      string                 `json:"type"`
+    User      string                 `json:"user,omitempty"`
+    IP        string                 `json:"ip,omitempty"`
+    To        string                 `json:"to,omitempty"`
+    Content   string                 `json:"content,omitempty"`
+    Time      int64                  `json:"time,omitempty"`
+    E2E       []envelope             `json:"e2e,omitempty"`
+    Keys      []deviceKey            `json:"keys,omitempty"`
+    OwnKeys   []deviceKey            `json:"own_keys,omitempty"`
+    Room      string                 `json:"room,omitempty"`
+    Encrypted bool                   `json:"encrypted,omitempty"`
+    RoomKeys  map[string][]deviceKey `json:"room_keys,omitempty"`
+}
+
+/* Sender key distribution message, sent to every room member's devices as an encrypted direct message */
+type senderKeyMessage struct {
+    Room  string `json:"room"`
+    KeyID string `json:"key_id"`
+    Key   string `json:"key"`
+}
+
+type senderKey struct {
+    User string `json:"user"` // Owner, as authenticated by the direct message that carried it
+    Key  string `json:"key"`
+}
+
+/* Sender keys of an encrypted room */
+type roomKeys struct {
+    OwnID string               `json:"own_id,omitempty"`
+    Own   string               `json:"own,omitempty"`
+    Stale bool                 `json:"stale,omitempty"` // Rotate before the next message, membership changed
+    Peers map[string]senderKey `json:"peers"`           // By "device:key_id"
+}
+
+type knownPeer struct {
+    Keys     []deviceKey `json:"keys"`
+    Pending  []deviceKey `json:"pending,omitempty"` // Keys that appeared after the first contact, not used until confirmed
+    Verified bool        `json:"verified"`
+}
+
+/* End-to-end encryption state of this device */
+type e2eClient struct {
+    identity *ecdh.PrivateKey
+    device   string
+    known    map[string]*knownPeer // Trusted identity keys by lowercase nickname
+    pending  map[string][]string   // Messages waiting for the recipient's keys
+    rooms    map[string]*roomKeys  // Encrypted rooms this account is a member of
+    queued   map[string][]string   // Room messages waiting for a new sender key
+}
+
+/* File upload function, the server announces the file once it has been stored */
+func sendFile(bot *paizer.Client, path string, notices chan<- string) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        notices <- fmt.Sprintf("Unable to read %s: %v", path, err)
+        return
+    }
+
+    notices <- fmt.Sprintf("Uploading %s (%d bytes)...", filepath.Base(path), len(data))
+    if err := bot.SendFile(filepath.Base(path), data); err != nil {
+        notices <- fmt.Sprintf("Upload of %s failed: %v", path, err)
+    }
+}
+
+/* File download function, fetches a shared file over HTTP and verifies its checksum */
+func getFile(baseURL string, id string, name string, notices chan<- string) {
+    resp, err := http.Get(baseURL + "/files/" + url.PathEscape(id))
+    if err != nil {
+        notices <- fmt.Sprintf("Download of %s failed: %v", id, err)
+        return
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        notices <- fmt.Sprintf("Download of %s failed: %s", id, resp.Status)
+        return
+    }
+
+    checksum := strings.Trim(resp.Header.Get("ETag"), `"`)
+    if name == "" {
+        name = id
+        if len(checksum) >= 12 {
+            name = checksum[:12]
+        }
+        if exts, _ := mime.ExtensionsByType(resp.Header.Get("Content-Type")); len(exts) > 0 {
+            name += exts[0]
+        }
+    }
+
+    out, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+    if err != nil {
+        notices <- fmt.Sprintf("Unable to save %s: %v", name, err)
+        return
+    }
+    defer out.Close()
+
+    hash := sha256.New()
+    size, err := io.Copy(io.MultiWriter(out, hash), resp.Body)
+    if err != nil {
+        notices <- fmt.Sprintf("Download of %s failed: %v", id, err)
+        return
+    }
+    if checksum != "" && hex.EncodeToString(hash.Sum(nil)) != checksum {
+        notices <- fmt.Sprintf("Warning: %s does not match its SHA-256 checksum", name)
+        return
+    }
+    notices <- fmt.Sprintf("Saved %s (%d bytes, SHA-256 verified)", name, size)
+}
+
+/* Config file location, shared by the session token and the encryption keys */
+func configPath(name string) string {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        dir = "."
+    }
+    return filepath.Join(dir, "paizer", name)
+}
+
+/* Device IDs are derived from the public key, the same way the server does */
+func deviceID(key []byte) string {
+    sum := sha256.Sum256(key)
+    return hex.EncodeToString(sum[:16])
+}
+
+/* Human readable form of a device ID, for comparing keys out of band */
+func fingerprint(device string) string {
+    var groups []string
+    for i := 0; i+4 <= len(device); i += 4 {
+        groups = append(groups, device[i:i+4])
+    }
+    return strings.Join(groups, " ")
+}
+
+/* HKDF-SHA256 extract and expand, a single 32 byte output block */
+func deriveKey(secret []byte, salt []byte) []byte {
+    extract := hmac.New(sha256.New, salt)
+    extract.Write(secret)
+    expand := hmac.New(sha256.New, extract.Sum(nil))
+    expand.Write([]byte("paizer e2e dm v1\x01"))
+    return expand.Sum(nil)
+}
+
+func newE2EClient() (*e2eClient, error) {
+    path := configPath("identity.key")
+    var identity *ecdh.PrivateKey
+    data, err := os.ReadFile(path)
+    if err == nil {
+        identity, err = ecdh.X25519().NewPrivateKey(data)
+    } else if errors.Is(err, os.ErrNotExist) {
+        identity, err = ecdh.X25519().GenerateKey(rand.Reader)
+        if err == nil {
+            os.MkdirAll(filepath.Dir(path), 0700)
+            err = os.WriteFile(path, identity.Bytes(), 0600)
+        }
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    e2e := &e2eClient{
+        identity: identity,
+        device:   deviceID(identity.PublicKey().Bytes()),
+        known:    make(map[string]*knownPeer),
+        pending:  make(map[string][]string),
+        rooms:    make(map[string]*roomKeys),
+        queued:   make(map[string][]string),
+    }
+    if data, err := os.ReadFile(configPath("known_keys.json")); err == nil {
+        json.Unmarshal(data, &e2e.known)
+    }
+    if data, err := os.ReadFile(configPath("sender_keys.json")); err == nil {
+        json.Unmarshal(data, &e2e.rooms)
+    }
+    return e2e, nil
+}
+
+func (e *e2eClient) publicKey() string {
+    return base64.StdEncoding.EncodeToString(e.identity.PublicKey().Bytes())
+}
+
+func (e *e2eClient) saveKnown() {
+    data, _ := json.MarshalIndent(e.known, "", "  ")
+    os.WriteFile(configPath("known_keys.json"), data, 0600)
+}
+
+func (e *e2eClient) saveRooms() {
+    data, _ := json.MarshalIndent(e.rooms, "", "  ")
+    os.WriteFile(configPath("sender_keys.json"), data, 0600)
+}
+
+func hasDevice(keys []deviceKey, device string) bool {
+    for _, key := range keys {
+        if key.Device == device {
+            return true
+        }
+    }
+    return false
+}
+
+/*
+ * Trust on first use: the keys of a peer seen for the first time are trusted.
+ * A key that appears later is only kept as pending, with a warning, and nothing
+ * is encrypted to it until it is confirmed with /verify.
+ */
+func (e *e2eClient) trustKeys(user string, keys []deviceKey) []string {
+    name := strings.ToLower(user)
+    peer, exists := e.known[name]
+    if !exists {
+        peer = &knownPeer{}
+        e.known[name] = peer
+    }
+    firstUse := len(peer.Keys) == 0 && len(peer.Pending) == 0
+
+    var notes []string
+    for _, key := range keys {
+        /* The device ID is the key's hash, a key under another device's ID is forged */
+        raw, err := base64.StdEncoding.DecodeString(key.Key)
+        if err != nil || deviceID(raw) != key.Device {
+            notes = append(notes, fmt.Sprintf("\a\033[1;31mWARNING: ignored an identity key of %s that does not match its device ID.\033[0m", user))
+            continue
+        }
+        if hasDevice(peer.Keys, key.Device) || hasDevice(peer.Pending, key.Device) {
+            continue
+        }
+
+        if firstUse {
+            notes = append(notes, fmt.Sprintf("Trusting identity key %s for %s on first use.", fingerprint(key.Device), user))
+            peer.Keys = append(peer.Keys, key)
+        } else {
+            notes = append(notes, fmt.Sprintf("\a\033[1;31mWARNING: %s has a new identity key %s, nothing is encrypted to it until you compare it with /fingerprint %s and confirm it with /verify %s <fingerprint>.\033[0m",
+                user, fingerprint(key.Device), user, user))
+            peer.Pending = append(peer.Pending, key)
+        }
+    }
+    if len(notes) > 0 {
+        e.saveKnown()
+    }
+    return notes
+}
+
+/* The keys of a user this device trusts, the others are left out */
+func (e *e2eClient) trustedKeys(user string, keys []deviceKey) []deviceKey {
+    peer, exists := e.known[strings.ToLower(user)]
+    if !exists {
+        return nil
+    }
+    var trusted []deviceKey
+    for _, key := range keys {
+        if hasDevice(peer.Keys, key.Device) {
+            trusted = append(trusted, key)
+        }
+    }
+    return trusted
+}
+
+func (e *e2eClient) encrypt(recipient deviceKey, plaintext []byte) (envelope, error) {
+    raw, err := base64.StdEncoding.DecodeString(recipient.Key)
+    if err != nil {
+        return envelope{}, err
+    }
+    peer, err := ecdh.X25519().NewPublicKey(raw)
+    if err != nil {
+        return envelope{}, err
+    }
+    ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+    if err != nil {
+        return envelope{}, err
+    }
+
+    /* The ephemeral secret gives forward secrecy, the static one authenticates the sender */
+    ephemeralSecret, err := ephemeral.ECDH(peer)
+    if err != nil {
+        return envelope{}, err
+    }
+    staticSecret, err := e.identity.ECDH(peer)
+    if err != nil {
+        return envelope{}, err
+    }
+    transcript := append(append(ephemeral.PublicKey().Bytes(), e.identity.PublicKey().Bytes()...), raw...)
+
+    block, _ := aes.NewCipher(deriveKey(append(ephemeralSecret, staticSecret...), transcript))
+    aead, _ := cipher.NewGCM(block)
+    nonce := make([]byte, aead.NonceSize())
+    rand.Read(nonce)
+
+    return envelope{
+        Device:    recipient.Device,
+        Sender:    e.publicKey(),
+        Ephemeral: base64.StdEncoding.EncodeToString(ephemeral.PublicKey().Bytes()),
+        Nonce:     base64.StdEncoding.EncodeToString(nonce),
+        Data:      base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, plaintext, transcript)),
+    }, nil
+}
+
+func (e *e2eClient) decrypt(env envelope) ([]byte, error) {
+    ephemeralRaw, err1 := base64.StdEncoding.DecodeString(env.Ephemeral)
+    senderRaw, err2 := base64.StdEncoding.DecodeString(env.Sender)
+    nonce, err3 := base64.StdEncoding.DecodeString(env.Nonce)
+    data, err4 := base64.StdEncoding.DecodeString(env.Data)
+    if err := errors.Join(err1, err2, err3, err4); err != nil {
+        return nil, err
+    }
+    ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralRaw)
+    if err != nil {
+        return nil, err
+    }
+    sender, err := ecdh.X25519().NewPublicKey(senderRaw)
+    if err != nil {
+        return nil, err
+    }
+
+    ephemeralSecret, err := e.identity.ECDH(ephemeral)
+    if err != nil {
+        return nil, err
+    }
+    staticSecret, err := e.identity.ECDH(sender)
+    if err != nil {
+        return nil, err
+    }
+    transcript := append(append(ephemeralRaw, senderRaw...), e.identity.PublicKey().Bytes()...)
+
+    block, _ := aes.NewCipher(deriveKey(append(ephemeralSecret, staticSecret...), transcript))
+    aead, _ := cipher.NewGCM(block)
+    if len(nonce) != aead.NonceSize() {
+        return nil, errors.New("invalid nonce")
+    }
+    return aead.Open(nil, nonce, data, transcript)
+}
+
+/* Encrypt the messages waiting for a peer's keys, for each of their devices and our other devices */
+func (e *e2eClient) handleKeys(bot *paizer.Client, msg serverMessage) []string {
+    name := strings.ToLower(msg.User)
+    queued := e.pending[name]
+    delete(e.pending, name)
+
+    /* Our other devices are trusted the same way, the server could slip in a key of its own */
+    var ownKeys []deviceKey
+    for _, key := range msg.OwnKeys {
+        if key.Device != e.device {
+            ownKeys = append(ownKeys, key)
+        }
+    }
+    notes := e.trustKeys(msg.User, msg.Keys)
+    notes = append(notes, e.trustKeys(bot.Username(), ownKeys)...)
+    if len(queued) == 0 {
+        return notes
+    }
+    if len(msg.Keys) == 0 {
+        return append(notes, msg.User+" has not published an identity key, use /msg to send an unencrypted message.")
+    }
+
+    recipients := e.trustedKeys(msg.User, msg.Keys)
+    if len(recipients) == 0 {
+        return append(notes, fmt.Sprintf("None of the identity keys of %s are confirmed, the message was not sent. Compare them with /fingerprint %s and confirm one with /verify %s <fingerprint>.",
+            msg.User, msg.User, msg.User))
+    }
+    recipients = append(recipients, e.trustedKeys(bot.Username(), ownKeys)...)
+
+    for _, text := range queued {
+        dm := serverMessage{Type: "dm", To: msg.User}
+        for _, key := range recipients {
+            env, err := e.encrypt(key, []byte(text))
+            if err != nil {
+                continue
+            }
+            dm.E2E = append(dm.E2E, env)
+        }
+
+        data, _ := json.Marshal(dm)
+        if err := bot.SendLine(e2ePrefix + string(data)); err != nil {
+            return append(notes, "Failed to send encrypted message: "+err.Error())
+        }
+        notes = append(notes, fmt.Sprintf("[%s] [you -> %s] 🔒 %s", time.Now().Format("15:04:05"), msg.User, text))
     }
-    if strings.Contains(addr, ":") {
-        host, port, err := net.SplitHostPort(addr)
+    return notes
+}
+
+/* Decrypt an incoming end-to-end encrypted direct message addressed to this device */
+func (e *e2eClient) handleDM(msg serverMessage) []string {
+    for _, env := range msg.E2E {
+        if env.Device != e.device {
+            continue
+        }
+
+        plaintext, err := e.decrypt(env)
         if err != nil {
-            return "", err
+            return []string{fmt.Sprintf("Unable to decrypt a message from %s: %v", msg.User, err)}
+        }
+        senderRaw, _ := base64.StdEncoding.DecodeString(env.Sender)
+        sender := deviceID(senderRaw)
+        notes := e.trustKeys(msg.User, []deviceKey{{Device: sender, Key: env.Sender}})
+        trusted := len(e.trustedKeys(msg.User, []deviceKey{{Device: sender}})) > 0
+
+        var keyMsg senderKeyMessage
+        if json.Unmarshal(plaintext, &keyMsg) == nil && keyMsg.Room != "" && keyMsg.Key != "" {
+            if !trusted {
+                return append(notes, fmt.Sprintf("Ignored a key for #%s from an unconfirmed device of %s.", keyMsg.Room, msg.User))
+            }
+            e.storeSenderKey(msg.User, sender, keyMsg)
+            return notes
+        }
+
+        lock := "🔒"
+        if !trusted {
+            lock = "🔒 (unconfirmed key)"
+        }
+        return append(notes, fmt.Sprintf("[%s] [%s@%s -> %s] %s %s",
+            time.UnixMilli(msg.Time).Format("15:04:05"), msg.User, msg.IP, msg.To, lock, plaintext))
+    }
+    /* Our other devices receive the copies we send, this one has nothing to decrypt */
+    if len(msg.E2E) > 0 && msg.E2E[0].Sender == e.publicKey() {
+        return nil
+    }
+    return []string{fmt.Sprintf("Received an encrypted message from %s that was not encrypted for this device.", msg.User)}
+}
+
+func (e *e2eClient) room(name string) *roomKeys {
+    keys, exists := e.rooms[name]
+    if !exists {
+        keys = &roomKeys{Peers: make(map[string]senderKey)}
+        e.rooms[name] = keys
+    }
+    return keys
+}
+
+func (e *e2eClient) storeSenderKey(user string, device string, msg senderKeyMessage) {
+    name := strings.ToLower(msg.Room)
+    if device == e.device {
+        return
+    }
+    e.room(name).Peers[device+":"+msg.KeyID] = senderKey{User: user, Key: msg.Key}
+    e.saveRooms()
+}
+
+/* Track membership of encrypted rooms, our sender key is replaced whenever it changes */
+func (e *e2eClient) handleRoomEvent(msg serverMessage) {
+    if !msg.Encrypted {
+        return
+    }
+    switch msg.Type {
+    case "room_joined":
+        e.room(msg.Room)
+    case "room_left":
+        delete(e.rooms, msg.Room)
+    case "room_join", "room_leave", "room_online":
+        if keys, exists := e.rooms[msg.Room]; exists {
+            keys.Stale = true
+        }
+    }
+    e.saveRooms()
+}
+
+func (e *e2eClient) isEncryptedRoom(name string) bool {
+    _, exists := e.rooms[name]
+    return exists
+}
+
+/* Encrypt a room message with our sender key, or fetch the members' keys to distribute a new one first */
+func (e *e2eClient) sendRoom(bot *paizer.Client, room string, text string) []string {
+    if text == "" {
+        return nil
+    }
+    keys := e.room(room)
+    if keys.Own == "" || keys.Stale {
+        if len(e.queued[room]) == 0 {
+            bot.SendLine("KEY ROOM " + room)
+        }
+        e.queued[room] = append(e.queued[room], text)
+        return nil
+    }
+
+    key, _ := base64.StdEncoding.DecodeString(keys.Own)
+    block, _ := aes.NewCipher(key)
+    aead, _ := cipher.NewGCM(block)
+    nonce := make([]byte, aead.NonceSize())
+    rand.Read(nonce)
+
+    env := envelope{
+        Device: e.device,
+        Sender: e.publicKey(),
+        KeyID:  keys.OwnID,
+        Nonce:  base64.StdEncoding.EncodeToString(nonce),
+        Data:   base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, []byte(text), roomAAD(room, keys.OwnID, e.device))),
+    }
+    data, _ := json.Marshal(serverMessage{Type: "chat", Room: room, E2E: []envelope{env}})
+    if err := bot.SendLine(e2ePrefix + string(data)); err != nil {
+        return []string{"Failed to send encrypted message: " + err.Error()}
+    }
+    return []string{fmt.Sprintf("[%s] [#%s] [you] 🔒 %s", time.Now().Format("15:04:05"), room, text)}
+}
+
+/* Room ciphertext is bound to the room, the sender key and the sending device */
+func roomAAD(room string, keyID string, device string) []byte {
+    return []byte(room + "\x00" + keyID + "\x00" + device)
+}
+
+/* Generate a new sender key, hand it to every online member's devices and send the queued messages */
+func (e *e2eClient) rotateSenderKey(bot *paizer.Client, msg serverMessage) []string {
+    room := msg.Room
+    var notes []string
+    key := make([]byte, 32)
+    id := make([]byte, 8)
+    rand.Read(key)
+    rand.Read(id)
+
+    distribution, _ := json.Marshal(senderKeyMessage{
+        Room:  room,
+        KeyID: hex.EncodeToString(id),
+        Key:   base64.StdEncoding.EncodeToString(key),
+    })
+    for member, memberKeys := range msg.RoomKeys {
+        var recipients []deviceKey
+        for _, key := range memberKeys {
+            if key.Device != e.device {
+                recipients = append(recipients, key)
+            }
+        }
+        notes = append(notes, e.trustKeys(member, recipients)...)
+        recipients = e.trustedKeys(member, recipients)
+        dm := serverMessage{Type: "dm", To: member}
+        for _, deviceKey := range recipients {
+            env, err := e.encrypt(deviceKey, distribution)
+            if err != nil {
+                continue
+            }
+            dm.E2E = append(dm.E2E, env)
+        }
+        if len(dm.E2E) == 0 {
+            continue
+        }
+        data, _ := json.Marshal(dm)
+        if err := bot.SendLine(e2ePrefix + string(data)); err != nil {
+            return append(notes, "Failed to distribute the sender key: "+err.Error())
+        }
+    }
+
+    keys := e.room(room)
+    keys.Own = base64.StdEncoding.EncodeToString(key)
+    keys.OwnID = hex.EncodeToString(id)
+    keys.Stale = false
+    e.saveRooms()
+
+    queued := e.queued[room]
+    delete(e.queued, room)
+    for _, text := range queued {
+        notes = append(notes, e.sendRoom(bot, room, text)...)
+    }
+    return notes
+}
+
+/* Decrypt a room message with the sender key of the device that sent it */
+func (e *e2eClient) handleRoomMessage(msg serverMessage) []string {
+    prefix := fmt.Sprintf("[%s] [#%s] [%s@%s] 🔒 ", time.UnixMilli(msg.Time).Format("15:04:05"), msg.Room, msg.User, msg.IP)
+    if len(msg.E2E) != 1 {
+        return []string{prefix + "(malformed encrypted message)"}
+    }
+    env := msg.E2E[0]
+
+    keys := e.room(msg.Room)
+    sender, exists := keys.Peers[env.Device+":"+env.KeyID]
+    if !exists {
+        return []string{prefix + "(unable to decrypt, no sender key was received from this device)"}
+    }
+    if !strings.EqualFold(sender.User, msg.User) {
+        return []string{fmt.Sprintf("\a\033[1;31mWARNING: a message in #%s claims to be from %s but uses a sender key of %s.\033[0m", msg.Room, msg.User, sender.User)}
+    }
+
+    key, err1 := base64.StdEncoding.DecodeString(sender.Key)
+    nonce, err2 := base64.StdEncoding.DecodeString(env.Nonce)
+    data, err3 := base64.StdEncoding.DecodeString(env.Data)
+    if err := errors.Join(err1, err2, err3); err != nil || len(key) != 32 {
+        return []string{prefix + "(malformed encrypted message)"}
+    }
+    block, _ := aes.NewCipher(key)
+    aead, _ := cipher.NewGCM(block)
+    if len(nonce) != aead.NonceSize() {
+        return []string{prefix + "(malformed encrypted message)"}
+    }
+    plaintext, err := aead.Open(nil, nonce, data, roomAAD(msg.Room, env.KeyID, env.Device))
+    if err != nil {
+        return []string{prefix + "(unable to decrypt: " + err.Error() + ")"}
+    }
+    return []string{prefix + string(plaintext)}
+}
+
+/* Show our own fingerprint, or the trusted fingerprints of a peer */
+func (e *e2eClient) fingerprints(user string) []string {
+    if user == "" {
+        return []string{"Your identity key fingerprint: " + fingerprint(e.device)}
+    }
+
+    peer, exists := e.known[strings.ToLower(user)]
+    if !exists || len(peer.Keys) == 0 {
+        return []string{"No identity keys known for " + user + ", send them an encrypted message first."}
+    }
+    status := "unverified"
+    if peer.Verified {
+        status = "verified"
+    }
+    lines := []string{fmt.Sprintf("Identity keys of %s (%s):", user, status)}
+    for _, key := range peer.Keys {
+        lines = append(lines, "  "+fingerprint(key.Device))
+    }
+    for _, key := range peer.Pending {
+        lines = append(lines, "  "+fingerprint(key.Device)+" (not confirmed)")
+    }
+    return lines
+}
+
+/*
+ * Mark a peer's keys as verified once a fingerprint has been compared out of band,
+ * a pending key with that fingerprint becomes trusted
+ */
+func (e *e2eClient) verify(user string, given string) string {
+    peer, exists := e.known[strings.ToLower(user)]
+    if !exists {
+        return "No identity keys known for " + user + "."
+    }
+    given = strings.ToLower(strings.ReplaceAll(given, " ", ""))
+    for i, key := range peer.Pending {
+        if key.Device == given {
+            peer.Keys = append(peer.Keys, key)
+            peer.Pending = append(peer.Pending[:i], peer.Pending[i+1:]...)
+            peer.Verified = true
+            e.saveKnown()
+            return "The new identity key of " + user + " is now confirmed and verified."
         }
-        if strings.Contains(host, ":") {
-            return "[" + host + "]:" + port, nil
+    }
+    for _, key := range peer.Keys {
+        if key.Device == given {
+            peer.Verified = true
+            e.saveKnown()
+            return "The identity key of " + user + " is now verified."
         }
-        return addr, nil
     }
-    return net.JoinHostPort(addr, defaultPort), nil
+    return "\a\033[1;31mThe fingerprint does not match any identity key of " + user + ".\033[0m"
+}
+
+/* Session token location, one file per server address */
+func tokenPath(serverAddr string) string {
+    name := strings.NewReplacer(":", "_", "[", "", "]", "").Replace(serverAddr)
+    return configPath("session-" + name)
+}
+
+func saveToken(serverAddr string, token string) {
+    path := tokenPath(serverAddr)
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err == nil {
+        os.WriteFile(path, []byte(token), 0600)
+    }
+}
+
+/* Ask for a nickname on the terminal */
+func askNickname() string {
+    fmt.Print("Please enter your nickname: ")
+    var username string
+    fmt.Scanln(&username)
+    return username
+}
+
+/* Render a server event as terminal lines, decrypting end-to-end encrypted payloads */
+func renderEvent(bot *paizer.Client, e2e *e2eClient, ev paizer.Event) []string {
+    switch ev.Type {
+    case paizer.EventDisconnected:
+        return []string{"Connection to the server lost (" + ev.Content + "), reconnecting..."}
+    case paizer.EventReconnecting:
+        return nil
+    case "mention":
+        /* Ring the terminal bell and highlight the line in bold yellow */
+        return []string{"\a\033[1;33m" + ev.String() + "\033[0m"}
+    case "search_results":
+        /* Matches are wrapped in **, show them in bold instead */
+        parts := strings.Split(ev.String(), "**")
+        for i := 1; i < len(parts); i += 2 {
+            parts[i] = "\033[1m" + parts[i] + "\033[0m"
+        }
+        return []string{strings.Join(parts, "")}
+    }
+
+    if e2e != nil && (ev.Type == "keys" || len(ev.E2E) > 0 || strings.HasPrefix(ev.Type, "room_")) {
+        var parsed serverMessage
+        data, _ := json.Marshal(ev)
+        json.Unmarshal(data, &parsed)
+        switch {
+        case ev.Type == "keys" && ev.Room != "":
+            return e2e.rotateSenderKey(bot, parsed)
+        case ev.Type == "keys":
+            return e2e.handleKeys(bot, parsed)
+        case len(ev.E2E) > 0 && ev.Room != "":
+            return e2e.handleRoomMessage(parsed)
+        case len(ev.E2E) > 0:
+            return e2e.handleDM(parsed)
+        default:
+            e2e.handleRoomEvent(parsed)
+        }
+    }
+
+    if text := ev.String(); text != "" {
+        return []string{text}
+    }
+    return nil
 }
 
 /* Client main function */
@@ -60,66 +778,55 @@ func main() {
         addr = "127.0.0.1"
     }
 
-    serverAddr, err := parseAddress(addr)
+    serverAddr, err := paizer.ResolveAddress(addr)
     if err != nil {
         log.Fatalf("Wrong address format: %v", err)
     }
 
-    conn, err := net.Dial("tcp", serverAddr)
-    if err != nil {
-        log.Fatalf("Unable to connect to server: %v", err)
+    host, _, _ := net.SplitHostPort(serverAddr)
+    httpBase := "http://" + net.JoinHostPort(host, httpPort)
+
+    /* Resume the previous session with its token, or log in with a nickname */
+    cfg := paizer.Config{
+        Addr:      serverAddr,
+        Reconnect: true,
+        OnToken: func(token string) {
+            saveToken(serverAddr, token)
+        },
+    }
+    token, _ := os.ReadFile(tokenPath(serverAddr))
+    cfg.Token = strings.TrimSpace(string(token))
+    if cfg.Token == "" {
+        cfg.Nickname = askNickname()
     }
-    defer conn.Close()
 
-    fmt.Print("Please enter your nickname: ")
-    var username string
-    fmt.Scanln(&username)
+    bot := paizer.New(cfg)
+    events := bot.Events()
+    err = bot.Connect()
+    if errors.Is(err, paizer.ErrTokenInvalid) {
+        fmt.Println("Your previous session has expired, please log in again.")
+        os.Remove(tokenPath(serverAddr))
+        cfg.Token, cfg.Nickname = "", askNickname()
 
-    _, err = conn.Write([]byte(username + "\n"))
+        bot = paizer.New(cfg)
+        events = bot.Events()
+        err = bot.Connect()
+    }
     if err != nil {
-        log.Fatalf("Failed to send nickname: %v", err)
+        log.Fatalf("Unable to connect to server: %v", err)
     }
+    defer bot.Close()
 
-    welcome, err := bufio.NewReader(conn).ReadString('\n')
+    e2e, err := newE2EClient()
     if err != nil {
-        log.Fatalf("Failed to read the welcome message: %v", err)
+        fmt.Println("End-to-end encryption is unavailable: ", err)
+    } else {
+        bot.SendLine("KEY PUBLISH " + e2e.publicKey())
     }
-    fmt.Println(strings.TrimSpace(welcome))
 
-    messageChan := make(chan string)
     errorChan := make(chan error)
     inputChan := make(chan string)
-
-    heartbeatTicker := time.NewTicker(heartbeatDelay)
-    defer heartbeatTicker.Stop()
-
-    timeoutTimer := time.NewTimer(timeoutLimit)
-    defer timeoutTimer.Stop()
-
-    /* Network message receiving coroutine */
-    go func() {
-        reader := bufio.NewReader(conn)
-        for {
-            msg, err := reader.ReadString('\n')
-            if err != nil {
-                errorChan <- err
-                return
-            }
-            msg = strings.TrimSpace(msg)
-            messageChan <- msg
-        }
-    }()
-
-    /* Heartbeat packet sending coroutine */
-    go func() {
-        for range heartbeatTicker.C {
-            _, err := conn.Write([]byte(heartbeatMsg + "\n"))
-            if err != nil {
-                errorChan <- err
-                return
-            }
-        }
-    }()
+    noticeChan := make(chan string)
 
     /* User input reading coroutine, responsible for calling the blocking rl.Readline() */
     go func() {
@@ -135,29 +842,66 @@ func main() {
 
     for {
         select {
-        case msg := <-messageChan:
-            if msg == heartbeatMsg {
-                timeoutTimer.Reset(timeoutLimit)
-                continue
+        case ev, ok := <-events:
+            if !ok {
+                fmt.Println("\nConnection error: ", bot.Err())
+                return
+            }
+            for _, line := range renderEvent(bot, e2e, ev) {
+                rl.Write([]byte(line + "\n"))
             }
-            rl.Write([]byte(msg + "\n"))
-            timeoutTimer.Reset(timeoutLimit)
+        case notice := <-noticeChan:
+            rl.Write([]byte(notice + "\n"))
         case input := <-inputChan:
-            if input != "" {
-                _, err := conn.Write([]byte(input + "\n"))
-                if err != nil {
-                    errorChan <- err
-                    return
+            if strings.HasPrefix(input, "/send ") {
+                go sendFile(bot, strings.TrimSpace(strings.TrimPrefix(input, "/send ")), noticeChan)
+            } else if strings.HasPrefix(input, "/get ") {
+                args := strings.Fields(strings.TrimPrefix(input, "/get "))
+                name := ""
+                if len(args) > 1 {
+                    name = args[1]
+                }
+                if len(args) > 0 {
+                    go getFile(httpBase, args[0], name, noticeChan)
+                }
+            } else if strings.HasPrefix(input, "/emsg ") || strings.HasPrefix(input, "/fingerprint") || strings.HasPrefix(input, "/verify ") {
+                if e2e == nil {
+                    rl.Write([]byte("End-to-end encryption is unavailable.\n"))
+                    continue
+                }
+                args := strings.Fields(input)
+                switch {
+                case args[0] == "/emsg" && len(args) > 2:
+                    /* Fetch the recipient's keys first, the message is sent when they arrive */
+                    text := strings.TrimSpace(strings.SplitN(input, " ", 3)[2])
+                    e2e.pending[strings.ToLower(args[1])] = append(e2e.pending[strings.ToLower(args[1])], text)
+                    bot.SendLine("KEY GET " + args[1])
+                case args[0] == "/fingerprint":
+                    for _, line := range e2e.fingerprints(strings.Join(args[1:], "")) {
+                        rl.Write([]byte(line + "\n"))
+                    }
+                case args[0] == "/verify" && len(args) > 2:
+                    rl.Write([]byte(e2e.verify(args[1], strings.Join(args[2:], "")) + "\n"))
+                default:
+                    rl.Write([]byte("Usage: /emsg <nick> <text>, /fingerprint [nick], /verify <nick> <fingerprint>\n"))
+                }
+            } else if room, text, _ := strings.Cut(strings.TrimPrefix(input, "#"), " "); strings.HasPrefix(input, "#") && e2e != nil && e2e.isEncryptedRoom(strings.ToLower(room)) {
+                /* Messages to encrypted rooms are sealed with this device's sender key */
+                for _, line := range e2e.sendRoom(bot, strings.ToLower(room), strings.TrimSpace(text)) {
+                    rl.Write([]byte(line + "\n"))
+                }
+            } else if input == "/logout" {
+                os.Remove(tokenPath(serverAddr))
+                bot.SendLine(input)
+            } else if input != "" {
+                if err := bot.SendLine(input); err != nil {
+                    rl.Write([]byte("Unable to send: " + err.Error() + "\n"))
                 }
-                timeoutTimer.Reset(timeoutLimit)
             }
             rl.SetPrompt("> ")
             rl.Refresh()
         case err := <-errorChan:
-            fmt.Println("\nConnection error or input error: ", err)
-            return
-        case <-timeoutTimer.C:
-            fmt.Println("\nThe connection to the server timed out.")
+            fmt.Println("\nInput error: ", err)
             return
         }
     }
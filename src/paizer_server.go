@@ -12,27 +12,143 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"hash"
+	"html"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"math/big"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 )
 
 var (
-	clients    = make(map[string]*Client)
-	clientsMux sync.Mutex
-	uidCounter uint32
-	consoleMux sync.Mutex
-	upgrader   = websocket.Upgrader{
+	dataDir     = flag.String("data", "./data", "Directory for uploaded files and other server state")
+	maxFileSize = flag.Int64("max-file-size", 10<<20, "Maximum size of an uploaded file in bytes")
+	uploadQuota = flag.Int64("upload-quota", 200<<20, "Bytes each account may upload per day, 0 disables the limit")
+	offlineMax  = flag.Int("offline-max", 200, "Maximum number of messages queued for an offline account")
+	offlineAge  = flag.Duration("offline-max-age", 7*24*time.Hour, "Maximum age of a message queued for an offline account")
+	tokenTTL    = flag.Duration("token-ttl", 30*24*time.Hour, "Lifetime of a session token")
+	resumeGrace = flag.Duration("resume-grace", 2*time.Minute, "How long a disconnected session can be resumed with its previous UID")
+
+	logLevel      = flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	logFormat     = flag.String("log-format", "text", "Log output format: text or json")
+	logFile       = flag.String("log-file", "", "Write logs to this file instead of stdout")
+	logMaxSize    = flag.Int64("log-max-size", 100, "Rotate the log file once it exceeds this many MiB, 0 disables")
+	logMaxAge     = flag.Duration("log-max-age", 24*time.Hour, "Rotate the log file once it is this old, 0 disables")
+	logMaxBackups = flag.Int("log-max-backups", 7, "Number of rotated log files to keep, 0 keeps all")
+	logContent    = flag.Bool("log-content", true, "Include message text in the logs, disable for privacy")
+
+	historySize      = flag.Int("history-size", 100000, "Number of messages kept in the history and search index, the oldest are purged")
+	adminAddr        = flag.String("admin-addr", "127.0.0.1:8081", "Listen address of the admin API")
+	incomingRate     = flag.Int("incoming-rate", 30, "Messages per minute each incoming webhook may post")
+	webhookQueueSize = flag.Int("webhook-queue", 1000, "Maximum number of outgoing webhook deliveries waiting to be sent")
+
+	retentionAge      = flag.Duration("retention-age", 0, "Messages older than this are purged from the history, 0 keeps them until -history-size is reached")
+	retentionInterval = flag.Duration("retention-interval", time.Hour, "How often the retention rules are applied")
+
+	adminToken = flag.String("admin-token", os.Getenv("PAIZER_ADMIN_TOKEN"), "Bearer token of the admin API, which is disabled without one")
+
+	shutdownDrain = flag.Duration("shutdown-drain", 5*time.Second, "How long /readyz fails before the listeners close on shutdown")
+
+	filterWords = flag.String("filter-words", "", "Comma separated words that are masked in chat and direct messages")
+
+	httpPort      = flag.Int("http-port", 8080, "Port of the HTTP server for WebSocket clients, files and metrics")
+	nodeName      = flag.String("node", "", "Name of this node in a cluster, the host name by default")
+	clusterAddr   = flag.String("cluster-addr", "", "Listen address for cluster peers, clustering is disabled without one")
+	clusterPeers  = flag.String("cluster-peers", "", "Comma separated cluster addresses of the other nodes")
+	clusterSecret = flag.String("cluster-secret", os.Getenv("PAIZER_CLUSTER_SECRET"), "Shared secret the cluster nodes authenticate with")
+
+	federationName = flag.String("federation-name", "", "Name of this server for federation, users are addressed as nick@name. Federation is disabled without one")
+	federationAddr = flag.String("federation-addr", ":7400", "Listen address for federated servers")
+
+	ircAddr = flag.String("irc-addr", "", "Listen address of the IRC gateway, e.g. :6667. The gateway is disabled without one")
+
+	defaultRole = flag.String("default-role", "member", "Role of the accounts that were not granted one, guest makes the server read-only for them")
+)
+
+var (
+	clients          = make(map[string]*Client)
+	onlineAccounts   = make(map[string]*Account) // Accounts with at least one session, guarded by clientsMux
+	rooms            = make(map[string]*Room)    // Group rooms by name, guarded by clientsMux
+	serverRoles      = make(map[string]string)   // Server roles by account name, guarded by clientsMux
+	rolesUpdated     int64                       // Unix milliseconds, the newest serverRoles win between cluster nodes
+	clientsMux       sync.Mutex
+	uidCounter       uint32
+	accounts         = make(map[string]bool)              // Accounts that have logged in before, keyed by accountKey
+	offlineMux       sync.Mutex                           // Guards accounts and the offline queue files
+	sessionKey       []byte                               // HMAC key for session tokens
+	revokedTokens    = make(map[string]int64)             // Revoked token IDs and their expiry
+	resumable        = make(map[string]*resumableSession) // Recently closed sessions keyed by token ID
+	sseStreams       = make(map[string]*sseStream)        // SSE streams by key, guarded by clientsMux
+	uploadQuotas     = make(map[string]*quotaWindow)      // Bytes uploaded per account today
+	uploadMux        sync.Mutex                           // Guards uploadQuotas
+	tokensMux        sync.Mutex                           // Guards revokedTokens and resumable
+	deviceKeys       = make(map[string][]DeviceKey)       // Published identity keys per account
+	keysMux          sync.Mutex                           // Guards deviceKeys
+	history          []Message                            // Chat, file and direct messages, oldest first
+	historyFile      *os.File                             // history.jsonl, opened for appending
+	searchIndex      = make(map[string][]posting)         // Search tokens to the messages containing them
+	historyMux       sync.Mutex                           // Guards history, the history file and searchIndex
+	retentionWake    = make(chan struct{}, 1)             // Starts a retention run early
+	retentionMux     sync.Mutex                           // One retention run at a time, guards lastRetentionRun
+	lastRetentionRun RetentionRun                         // Reported by /admin/retention
+	bans             []*Ban                               // Guarded by bansMux
+	bansMux          sync.Mutex
+	webhooks         []*Webhook // Outgoing webhooks, guarded by webhooksMux
+	webhooksMux      sync.Mutex
+	webhookQueue     chan webhookDelivery
+	webhookLog       []webhookLogEntry // Recent deliveries, guarded by webhookLogMux
+	webhookLogMux    sync.Mutex
+	webhookClient    = &http.Client{Timeout: 10 * time.Second}
+	webhookBackoff   = time.Second      // Delay before the first retry, doubled after every attempt
+	incomingWebhooks []*IncomingWebhook // Guarded by incomingMux
+	incomingMux      sync.Mutex
+	plugins          []Plugin                                    // Registered at startup, read-only afterwards
+	nodeID           string                                      // Name of this node, unique in the cluster
+	backplane        Backplane                                   // Set up by initCluster
+	remoteSessions   = make(map[string]map[string]RemoteSession) // Sessions on other nodes by node and UID, guarded by clientsMux
+	federationKey    ed25519.PrivateKey                          // Signs federation handshakes
+	federationTLS    *tls.Config                                 // Encrypts federation links, set up by initFederation
+	federationPeers  []*FederationPeer                           // Guarded by federationMux
+	federationMux    sync.Mutex
+	upgrader         = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 		CheckOrigin: func(r *http.Request) bool {
@@ -41,26 +157,258 @@ var (
 	}
 )
 
+/* State reported by /healthz and /readyz */
+var (
+	startTime    = time.Now()
+	tcpListener  net.Listener // Set by the listener goroutines, guarded by listenersMux
+	ircListener  net.Listener
+	httpServer   *http.Server
+	listenersMux sync.Mutex
+	tcpReady     atomic.Bool
+	httpReady    atomic.Bool
+	shuttingDown atomic.Bool
+)
+
+/* Metrics exported on /metrics */
+var (
+	metricMessagesReceived  transportCounter
+	metricMessagesDelivered transportCounter
+	metricBytesIn           transportCounter
+	metricBytesOut          transportCounter
+	metricWriteFailures     transportCounter
+	metricMessagesBroadcast atomic.Int64
+	metricHeartbeatTimeouts atomic.Int64
+	metricRateLimited       atomic.Int64
+	metricPurgedMessages    atomic.Int64
+	metricPurgedFiles       atomic.Int64
+	metricPurgedBytes       atomic.Int64
+	metricBroadcastLatency  = newHistogram(0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1)
+)
+
 type Client struct {
 	UID        string
 	Username   string
 	IP         string
 	Conn       net.Conn        // For TCP client
 	WsConn     *websocket.Conn // For WebSocket client
+	SSE        *sseStream      // For Server-Sent Events client
 	LastBeat   time.Time
-	ClientType string // "tcp" or "websocket"
+	ClientType string    // "tcp", "websocket", "sse" or "irc"
+	JSONLines  bool      // TCP client sent "PROTOCOL JSON", it receives JSON messages instead of text lines
+	Connected  time.Time // Start of the session
+	Account    *Account  // Account this session belongs to, set by announceJoin
+	Token      *sessionToken
+	Upload     *fileUpload // File upload in progress, owned by the connection goroutine
+}
+
+/* All live sessions of one nickname, presence is reported per account */
+type Account struct {
+	Name     string
+	Sessions map[string]*Client // Keyed by UID
+	Mentions []Message          // Unread mentions, oldest first
 }
 
 type Message struct {
-	Type    string `json:"type"` // "chat", "join", "leave", "heartbeat"
-	UID     string `json:"uid,omitempty"`
-	User    string `json:"user,omitempty"`
-	Content string `json:"content,omitempty"`
+	Type      string                 `json:"type"`         // "chat", "join", "leave", "heartbeat", "mention", "mentions"
+	ID        string                 `json:"id,omitempty"` // Chat and file messages, assigned when they are broadcast
+	UID       string                 `json:"uid,omitempty"`
+	User      string                 `json:"user,omitempty"`
+	Content   string                 `json:"content,omitempty"`
+	IP        string                 `json:"ip,omitempty"`
+	Mentions  []string               `json:"mentions,omitempty"`  // UIDs mentioned in a chat message
+	Time      int64                  `json:"time,omitempty"`      // Unix milliseconds
+	File      *FileInfo              `json:"file,omitempty"`      // Metadata of a "file" message or upload
+	Token     string                 `json:"token,omitempty"`     // Session token, issued after login and accepted on "join"
+	To        string                 `json:"to,omitempty"`        // Recipient of a "dm"
+	E2E       json.RawMessage        `json:"e2e,omitempty"`       // End-to-end encrypted payload, opaque to the server
+	Keys      []DeviceKey            `json:"keys,omitempty"`      // Identity keys of User in a "keys" reply
+	OwnKeys   []DeviceKey            `json:"own_keys,omitempty"`  // Identity keys of the requester's own devices
+	Room      string                 `json:"room,omitempty"`      // Group room of a message, empty for the main chat
+	Encrypted bool                   `json:"encrypted,omitempty"` // The room is end-to-end encrypted
+	RoomKeys  map[string][]DeviceKey `json:"room_keys,omitempty"` // Identity keys of every room member in a "keys" reply
+	Search    *SearchPage            `json:"search,omitempty"`    // Results of a "search" request
+	Role      string                 `json:"role,omitempty"`      // Role of the sender of a chat or file message, unless it is "member"
+
+	Annotations map[string]string `json:"annotations,omitempty"` // Notes added by server plugins
+}
+
+/* A user or address that may not log in, until Expires unless it is zero */
+type Ban struct {
+	ID      string `json:"id"`
+	User    string `json:"user,omitempty"` // Account name
 	IP      string `json:"ip,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+/* An outgoing webhook, empty Events or Rooms subscribe to everything */
+type Webhook struct {
+	ID      string   `json:"id"`
+	URL     string   `json:"url"`
+	Secret  string   `json:"secret,omitempty"` // HMAC-SHA256 key of the X-Paizer-Signature header
+	Events  []string `json:"events,omitempty"` // "chat", "join", "leave", "room_join", "room_leave" and "mention"
+	Rooms   []string `json:"rooms,omitempty"`  // "" is the main chat
+	Created int64    `json:"created"`
+}
+
+/* An incoming webhook that posts to a room, or the main chat, as a bot */
+type IncomingWebhook struct {
+	ID        string `json:"id"`
+	Room      string `json:"room,omitempty"`
+	Name      string `json:"name"`       // Bot name the messages are attributed to
+	TokenHash string `json:"token_hash"` // SHA-256 of the secret URL token
+	Created   int64  `json:"created"`
+
+	tokens float64 // Rate limit bucket
+	last   time.Time
+}
+
+type webhookDelivery struct {
+	ID      string
+	Webhook *Webhook
+	Event   string
+	Message Message
+}
+
+type webhookLogEntry struct {
+	ID       string `json:"id"`
+	Webhook  string `json:"webhook"`
+	Event    string `json:"event"`
+	Attempts int    `json:"attempts"`
+	Status   int    `json:"status,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Time     int64  `json:"time"`
+}
+
+/* A named group room, only members receive its messages */
+type Room struct {
+	Name      string          `json:"name"`
+	Encrypted bool            `json:"encrypted"` // Members exchange ciphertext only
+	Creator   string          `json:"creator"`
+	Created   int64           `json:"created"`
+	Members   map[string]bool `json:"members"`           // Account names
+	Updated   int64           `json:"updated"`           // Unix milliseconds, the newest version wins between cluster nodes
+	Deleted   bool            `json:"deleted,omitempty"` // Tells the other cluster nodes to remove the room
+	Home      string          `json:"home,omitempty"`    // Server that hosts a room shared with us, named room@home
+	Shared    []string        `json:"shared,omitempty"`  // Servers a local room is shared with
+	Retention *Retention      `json:"retention,omitempty"`
+
+	Topic       string `json:"topic,omitempty"`
+	TopicBy     string `json:"topic_by,omitempty"`
+	TopicTime   int64  `json:"topic_time,omitempty"` // Unix milliseconds
+	Description string `json:"description,omitempty"`
+	TopicLock   bool   `json:"topic_lock,omitempty"` // Only moderators may change the topic and description
+
+	Roles map[string]string `json:"roles,omitempty"` // Room roles by account name, the creator is the owner unless listed
+
+	Visibility string           `json:"visibility,omitempty"` // "unlisted", "invite" or "password", public when empty
+	Password   string           `json:"password,omitempty"`   // Salted hash of the password of a "password" room
+	Invited    map[string]int64 `json:"invited,omitempty"`    // Invited accounts and when their invitation expires, Unix milliseconds
+	Invites    []*Invite        `json:"invites,omitempty"`
+	Requests   map[string]int64 `json:"requests,omitempty"` // Accounts asking to join an invite-only room and when they asked
+}
+
+/* An invite link to a room */
+type Invite struct {
+	Code    string `json:"code"`
+	Creator string `json:"creator"`
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires,omitempty"`  // Unix milliseconds, never when 0
+	MaxUses int    `json:"max_uses,omitempty"` // Without limit when 0
+	Uses    int    `json:"uses"`
 }
 
+type DeviceKey struct {
+	Device    string `json:"device"` // Hex SHA-256 prefix of the key
+	Key       string `json:"key"`    // Base64 X25519 public key
+	Published int64  `json:"published"`
+	Seen      int64  `json:"seen,omitempty"` // When the device last published its key, Unix seconds
+}
+
+type FileInfo struct {
+	ID     string `json:"id"` // SHA-256 of the content, also the storage key
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	MIME   string `json:"mime,omitempty"`
+	SHA256 string `json:"sha256,omitempty"` // Checksum announced by the uploader
+	URL    string `json:"url,omitempty"`
+}
+
+type fileUpload struct {
+	Name     string
+	Size     int64
+	SHA256   string
+	Received int64
+	Head     []byte // First bytes of the content, kept for type detection
+	Hash     hash.Hash
+	Tmp      *os.File
+}
+
+const (
+	maxUnreadMentions = 100
+	maxDeviceKeys     = 10
+	deviceKeyIdle     = 90 * 24 * time.Hour // Only keys of devices unseen for this long make room for a new one
+	maxWebhookLog     = 200
+	webhookAttempts   = 5
+	maxTopicLength    = 300
+	inviteTTL         = 7 * 24 * time.Hour // How long an invitation to a room is valid
+)
+
 /* Server main function */
 func main() {
+	flag.Parse()
+	if err := validateFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if err := initLogging(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to set up logging: %v\n", err)
+		os.Exit(2)
+	}
+	if err := initFileStore(); err != nil {
+		fatal("Unable to prepare file storage", err)
+	}
+	if err := initOfflineStore(); err != nil {
+		fatal("Unable to prepare offline message storage", err)
+	}
+	if err := initSessionTokens(); err != nil {
+		fatal("Unable to prepare session tokens", err)
+	}
+	if err := initKeyDirectory(); err != nil {
+		fatal("Unable to load identity keys", err)
+	}
+	if err := initRooms(); err != nil {
+		fatal("Unable to load rooms", err)
+	}
+	if err := initRoles(); err != nil {
+		fatal("Unable to load roles", err)
+	}
+	if err := initHistory(); err != nil {
+		fatal("Unable to load history", err)
+	}
+	if err := initBans(); err != nil {
+		fatal("Unable to load bans", err)
+	}
+	if err := initWebhooks(); err != nil {
+		fatal("Unable to load webhooks", err)
+	}
+	if err := initIncomingWebhooks(); err != nil {
+		fatal("Unable to load incoming webhooks", err)
+	}
+	if err := initCluster(); err != nil {
+		fatal("Unable to join the cluster", err)
+	}
+	if err := initFederation(); err != nil {
+		fatal("Unable to start federation", err)
+	}
+
+	/* Register your own plugins here, they run in this order */
+	if *filterWords != "" {
+		registerPlugin(newWordFilter(*filterWords))
+	}
+
 	fmt.Print("Please enter the listening port (press enter, default is 32768): ")
 	inputReader := bufio.NewReader(os.Stdin)
 	inputPort, _ := inputReader.ReadString('\n')
@@ -76,28 +424,88 @@ func main() {
 	}
 
 	go startTCPServer(port)
-	go startHTTPServer(8080)
+	go startHTTPServer(*httpPort)
+	go startAdminServer()
+	go startIRCServer()
+	go runRetention()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	shutdown()
+}
+
+/* Reject flag values the server cannot run with before anything is loaded */
+func validateFlags() error {
+	if *incomingRate <= 0 {
+		return fmt.Errorf("invalid -incoming-rate %d, it must be at least 1", *incomingRate)
+	}
+	if *retentionInterval <= 0 || *retentionAge < 0 {
+		return fmt.Errorf("invalid -retention-interval %s or -retention-age %s", *retentionInterval, *retentionAge)
+	}
+	return nil
+}
+
+/*
+ * Graceful shutdown: fail readiness first so load balancers drain traffic,
+ * then warn the clients and close the listeners.
+ */
+func shutdown() {
+	shuttingDown.Store(true)
+	slog.Info("Shutting down", "drain", *shutdownDrain)
+	clientsMux.Lock()
+	deliverLocal(Message{Type: "system", Content: "The server is shutting down."}, "")
+	clientsMux.Unlock()
+	time.Sleep(*shutdownDrain)
+
+	listenersMux.Lock()
+	tcp, irc, web := tcpListener, ircListener, httpServer
+	listenersMux.Unlock()
+
+	if tcp != nil {
+		tcp.Close()
+	}
+	if irc != nil {
+		irc.Close()
+	}
+	clientsMux.Lock()
+	for _, client := range clients {
+		client.closeConnection()
+	}
+	clientsMux.Unlock()
 
-	select {}
+	if web != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		web.Shutdown(ctx)
+	}
+	backplane.Close()
+	slog.Info("Server stopped")
 }
 
 func startTCPServer(port int) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
-		log.Fatalf("Unable to start TCP server: %v", err)
+		fatal("Unable to start TCP server", err)
 	}
 	defer listener.Close()
 
-	currentTime := time.Now().Format("15:04:05")
-	fmt.Printf("[%s] TCP server starts and listens on port: %d\n", currentTime, port)
+	listenersMux.Lock()
+	tcpListener = listener
+	listenersMux.Unlock()
+	tcpReady.Store(true)
+	slog.Info("TCP server listening", "port", port)
 
 	go checkHeartbeats()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			currentTime := time.Now().Format("15:04:05")
-			fmt.Printf("[%s] Failed to accept TCP connection: %v\n", currentTime, err)
+			if shuttingDown.Load() {
+				tcpReady.Store(false)
+				return
+			}
+			slog.Warn("Failed to accept TCP connection", "error", err)
 			continue
 		}
 		go handleTCPConnection(conn)
@@ -109,349 +517,7933 @@ func startHTTPServer(port int) {
 	http.Handle("/", fs)
 
 	http.HandleFunc("/ws", handleWebSocket)
+	http.HandleFunc("GET /sse", handleSSE)
+	http.HandleFunc("POST /sse/send", handleSSESend)
+	http.HandleFunc("/upload", handleFileUpload)
+	http.HandleFunc("/files/", handleFileDownload)
+	http.HandleFunc("/metrics", handleMetrics)
+	http.HandleFunc("/healthz", handleHealth)
+	http.HandleFunc("/readyz", handleReady)
+	http.HandleFunc("POST /hooks/{id}/{token}", handleIncomingWebhook)
 
-	currentTime := time.Now().Format("15:04:05")
-	fmt.Printf("[%s] HTTP server starts and listens on port: %d\n", currentTime, port)
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		fatal("Unable to start HTTP server", err)
+	}
+	server := &http.Server{}
+	listenersMux.Lock()
+	httpServer = server
+	listenersMux.Unlock()
+	httpReady.Store(true)
+	slog.Info("HTTP server listening", "port", port)
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	err = server.Serve(listener)
+	httpReady.Store(false)
+	if !errors.Is(err, http.ErrServerClosed) {
+		fatal("HTTP server stopped", err)
+	}
 }
 
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade failed: %v", err)
+		slog.Warn("WebSocket upgrade failed", "ip", r.RemoteAddr, "error", err)
 		return
 	}
 	defer conn.Close()
 
 	_, msgBytes, err := conn.ReadMessage()
 	if err != nil {
-		log.Printf("Failed to read username from WebSocket: %v", err)
+		slog.Warn("Failed to read username from WebSocket", "ip", r.RemoteAddr, "error", err)
 		return
 	}
 
 	var msg Message
 	if err := json.Unmarshal(msgBytes, &msg); err != nil || msg.Type != "join" {
-		log.Printf("Invalid join message from WebSocket")
+		slog.Warn("Invalid join message from WebSocket", "ip", r.RemoteAddr)
 		return
 	}
 
-	username := msg.User
-	ip := strings.Split(r.RemoteAddr, ":")[0]
-
-	uid := fmt.Sprintf("%d", atomic.AddUint32(&uidCounter, 1))
-
-	client := &Client{
-		UID:        uid,
-		Username:   username,
-		IP:         ip,
-		WsConn:     conn,
-		LastBeat:   time.Now(),
-		ClientType: "websocket",
+	client, mentions := webLogin(msg, strings.Split(r.RemoteAddr, ":")[0], "websocket", func(reply Message) {
+		conn.WriteJSON(reply)
+	})
+	if client == nil {
+		return
 	}
+	client.WsConn = conn
+	defer abortUpload(client)
 
-	clientsMux.Lock()
-	clients[uid] = client
-	clientsMux.Unlock()
-
-	currentTime := time.Now().Format("15:04:05")
-	joinMsg := fmt.Sprintf("[%s] %s@%s Join the server (via Web).", currentTime, username, ip)
-
-	consoleMux.Lock()
-	fmt.Println(joinMsg)
-	consoleMux.Unlock()
-
-	broadcast(Message{
-		Type:    "join",
-		UID:     uid,
-		User:    username,
-		IP:      ip,
-		Content: "joined the server",
-	}, uid)
-
-	welcomeMsg := Message{
-		Type:    "system",
-		Content: "You have successfully joined the server via Web!",
+	if err := pluginsConnect(client); err != nil {
+		conn.WriteJSON(Message{Type: "system", Content: err.Error()})
+		return
 	}
-	conn.WriteJSON(welcomeMsg)
+	welcomeMsg := webWelcomeMessage(client)
+	announceJoin(client)
+	webWelcome(client, welcomeMsg, mentions)
 
 	for {
 		_, msgBytes, err := conn.ReadMessage()
 		if err != nil {
-			currentTime := time.Now().Format("15:04:05")
-			fmt.Printf("[%s] %s@%s WebSocket read error: %v\n", currentTime, username, ip, err)
-			removeClient(uid)
+			client.logger().Info("WebSocket read error", "error", err)
+			removeClient(client.UID)
 			return
 		}
+		metricBytesIn.Add("websocket", int64(len(msgBytes)))
 
 		var msg Message
 		if err := json.Unmarshal(msgBytes, &msg); err != nil {
-			log.Printf("Invalid message format from WebSocket: %v", err)
+			client.logger().Warn("Invalid message format from WebSocket", "error", err)
 			continue
 		}
-
-		switch msg.Type {
-		case "chat":
-			currentTime := time.Now().Format("15:04:05")
-			formattedMsg := fmt.Sprintf("[%s] [%s@%s] %s", currentTime, username, ip, msg.Content)
-
-			consoleMux.Lock()
-			fmt.Println(formattedMsg)
-			consoleMux.Unlock()
-
-			broadcast(Message{
-				Type:    "chat",
-				UID:     uid,
-				User:    username,
-				IP:      ip,
-				Content: msg.Content,
-			}, uid)
-
-		case "heartbeat":
-			client.LastBeat = time.Now()
-		}
+		handleWebMessage(client, msg)
 	}
 }
 
-func handleTCPConnection(conn net.Conn) {
-	defer conn.Close()
-
-	remoteAddr := conn.RemoteAddr().String()
-	ip, _, err := net.SplitHostPort(remoteAddr)
+/*
+ * Check the join request of a web client and prepare its session, reply sends the
+ * reasons a login is refused. The caller attaches the connection and runs the plugins.
+ */
+func webLogin(join Message, ip string, transport string, reply func(Message)) (*Client, []Message) {
+	username := join.User
 
-	if err != nil {
-		ip = remoteAddr
-	} else {
-		parsedIP := net.ParseIP(ip)
-		if parsedIP != nil {
-			ip = parsedIP.String()
+	var token *sessionToken
+	if join.Token != "" {
+		var err error
+		if token, err = verifySessionToken(join.Token); err != nil {
+			reply(Message{Type: "token_invalid", Content: "Session token rejected: " + err.Error()})
+			if username == "" {
+				return nil, nil
+			}
+		} else {
+			username = token.User
 		}
 	}
 
-	reader := bufio.NewReader(conn)
-	username, err := reader.ReadString('\n')
-	if err != nil {
-		currentTime := time.Now().Format("15:04:05")
-		fmt.Printf("[%s] Failed to read username: %v\n", currentTime, err)
-		return
+	if *federationName != "" && strings.Contains(username, "@") {
+		reply(Message{Type: "system", Content: nicknameAtNotice})
+		return nil, nil
+	}
+	if ban := findBan(username, ip); ban != nil {
+		slog.Info("Rejected banned login", "username", username, "ip", ip, "transport", transport)
+		reply(Message{Type: "system", Content: ban.notice()})
+		return nil, nil
+	}
+	if token == nil && needsToken(accountKey(username)) {
+		slog.Info("Rejected login without a session token", "username", username, "ip", ip, "transport", transport)
+		reply(Message{Type: "system", Content: roleTokenNotice})
+		return nil, nil
 	}
-	username = strings.TrimSpace(username)
-
-	uid := fmt.Sprintf("%d", atomic.AddUint32(&uidCounter, 1))
 
-	client := &Client{
+	uid, mentions := resumeSession(token)
+	return &Client{
 		UID:        uid,
 		Username:   username,
 		IP:         ip,
-		Conn:       conn,
 		LastBeat:   time.Now(),
-		ClientType: "tcp",
-	}
+		ClientType: transport,
+		Connected:  time.Now(),
+		Token:      token,
+	}, mentions
+}
 
+/*
+ * The welcome of a web client, a new session is issued its token here. Call it
+ * before announcing the session, requests handled after that read the token.
+ */
+func webWelcomeMessage(client *Client) Message {
+	welcomeMsg := Message{
+		Type:    "system",
+		UID:     client.UID,
+		Content: "You have successfully joined the server via Web!",
+	}
 	clientsMux.Lock()
-	clients[uid] = client
-	clientsMux.Unlock()
+	defer clientsMux.Unlock()
 
-	currentTime := time.Now().Format("15:04:05")
-	joinMsg := fmt.Sprintf("[%s] %s@%s Join the server.", currentTime, username, ip)
+	if client.Token == nil {
+		welcomeMsg.Token, client.Token = issueSessionToken(client.Username)
+	} else {
+		welcomeMsg.Content = "You have successfully resumed your session via Web!"
+	}
+	return welcomeMsg
+}
 
-	consoleMux.Lock()
-	fmt.Println(joinMsg)
-	consoleMux.Unlock()
+/* Send the welcome, room memberships and offline messages of an announced web client */
+func webWelcome(client *Client, welcomeMsg Message, mentions []Message) {
+	client.logger().Info("Joined the server")
 
-	broadcast(Message{
-		Type:    "join",
-		UID:     uid,
-		User:    username,
-		IP:      ip,
-		Content: "joined the server",
-	}, uid)
+	restoreMentions(client, mentions)
 
-	conn.Write([]byte("You have successfully joined the server!\n"))
+	clientsMux.Lock()
+	sendMessage(client, welcomeMsg)
+	clientsMux.Unlock()
+	sendRoomMemberships(client)
+	deliverOfflineMessages(client)
+}
 
-	messageChan := make(chan string)
-	errorChan := make(chan error)
+/* Handle a request from a WebSocket or SSE client */
+func handleWebMessage(client *Client, msg Message) {
+	if msg.Type != "heartbeat" {
+		metricMessagesReceived.Add(client.ClientType, 1)
+	}
 
-	go func() {
-		for {
-			msg, err := reader.ReadString('\n')
-			if err != nil {
-				errorChan <- err
-				return
-			}
-			messageChan <- strings.TrimSpace(msg)
+	switch msg.Type {
+	case "chat":
+		if len(msg.E2E) > 0 {
+			relayRoomE2E(client, msg.Room, msg.E2E)
+		} else {
+			handleChat(client, msg.Room, msg.Content)
 		}
-	}()
 
-	heartbeatTicker := time.NewTicker(5 * time.Second)
-	defer heartbeatTicker.Stop()
-	timeoutTimer := time.NewTimer(10 * time.Second)
-	defer timeoutTimer.Stop()
+	case "room_create":
+		createRoom(client, msg.Room, msg.Encrypted)
 
-	for {
-		select {
-		case msg := <-messageChan:
-			if msg == "HEARTBEAT" {
-				client.LastBeat = time.Now()
-				timeoutTimer.Reset(10 * time.Second)
-			} else {
-				currentTime := time.Now().Format("15:04:05")
-				formattedMsg := fmt.Sprintf("[%s] [%s@%s] %s", currentTime, username, ip, msg)
+	case "room_join":
+		joinRoom(client, msg.Room, msg.Content)
 
-				consoleMux.Lock()
-				fmt.Println(formattedMsg)
-				consoleMux.Unlock()
+	case "room_leave":
+		leaveRoom(client, msg.Room)
 
-				broadcast(Message{
-					Type:    "chat",
-					UID:     uid,
-					User:    username,
-					IP:      ip,
-					Content: msg,
-				}, uid)
-			}
-		case <-heartbeatTicker.C:
-			if _, err := conn.Write([]byte("HEARTBEAT\n")); err != nil {
-				currentTime := time.Now().Format("15:04:05")
-				fmt.Printf("[%s] %s@%s Failed to send heartbeat: %v\n", currentTime, username, ip, err)
-				removeClient(uid)
-				return
-			}
-		case <-timeoutTimer.C:
-			currentTime := time.Now().Format("15:04:05")
-			fmt.Printf("[%s] %s@%s Heartbeat timeout.\n", currentTime, username, ip)
-			removeClient(uid)
-			return
-		case err := <-errorChan:
-			currentTime := time.Now().Format("15:04:05")
-			fmt.Printf("[%s] %s@%s Connection Error: %v\n", currentTime, username, ip, err)
-			removeClient(uid)
-			return
-		}
-	}
-}
+	case "rooms":
+		listRooms(client)
 
-func broadcast(msg Message, excludeUID string) {
-	clientsMux.Lock()
-	defer clientsMux.Unlock()
+	case "topic", "description":
+		roomTopic(client, msg.Room, msg.Content, msg.Type == "description")
 
-	for uid, client := range clients {
-		if uid == excludeUID {
-			continue
+	case "topic_lock":
+		lockRoomTopic(client, msg.Room, msg.Content == "on")
+
+	case "grant", "ungrant":
+		role := msg.Content
+		if msg.Type == "ungrant" {
+			role = ""
 		}
+		grantRole(client, msg.To, role, msg.Room)
 
-		switch client.ClientType {
-		case "tcp":
-			var output string
-			switch msg.Type {
-			case "chat":
-				output = fmt.Sprintf("[%s] [%s@%s] %s\n",
-					time.Now().Format("15:04:05"), msg.User, shortIP(msg.IP), msg.Content)
-			case "join":
-				output = fmt.Sprintf("[%s] %s@%s joined the chat\n",
-					time.Now().Format("15:04:05"), msg.User, shortIP(msg.IP))
-			case "leave":
-				output = fmt.Sprintf("[%s] %s@%s left the chat\n",
-					time.Now().Format("15:04:05"), msg.User, shortIP(msg.IP))
-			case "system":
-				output = msg.Content + "\n"
-			}
+	case "roles":
+		listRoles(client, msg.Room)
 
-			if _, err := client.Conn.Write([]byte(output)); err != nil {
-				currentTime := time.Now().Format("15:04:05")
-				fmt.Printf("[%s] Failed to broadcast to TCP client: %v\n", currentTime, err)
-			}
+	case "kick":
+		kickUser(client, msg.To, msg.Room, msg.Content)
 
-		case "websocket":
-			if err := client.WsConn.WriteJSON(msg); err != nil {
-				currentTime := time.Now().Format("15:04:05")
-				fmt.Printf("[%s] Failed to broadcast to WebSocket client: %v\n", currentTime, err)
-			}
-		}
-	}
-}
+	case "room_delete":
+		deleteRoom(client, msg.Room)
 
-/* Address shortening function */
-func shortIP(ip string) string {
-	if len(ip) > 20 {
-		return ip[:10] + "..." + ip[len(ip)-6:]
-	}
-	return ip
-}
+	case "visibility":
+		visibility, password, _ := strings.Cut(msg.Content, " ")
+		setRoomVisibility(client, msg.Room, visibility, password)
 
-func removeClient(uid string) {
-	clientsMux.Lock()
-	client, exists := clients[uid]
-	clientsMux.Unlock()
+	case "invite":
+		inviteUser(client, msg.To, msg.Room)
 
-	if !exists {
-		return
-	}
+	case "invite_link":
+		handleInviteLinkCommand(client, msg.Room, strings.Fields(msg.Content))
 
-	currentTime := time.Now().Format("15:04:05")
-	leaveMsg := fmt.Sprintf("[%s] %s@%s Disconnected.", currentTime, client.Username, client.IP)
+	case "invites":
+		listInvites(client, msg.Room)
 
-	broadcastMsg := Message{
-		Type:    "leave",
-		UID:     client.UID,
-		User:    client.Username,
-		IP:      client.IP,
-		Content: "disconnected",
-	}
+	case "uninvite":
+		revokeInvite(client, msg.Room, msg.Content)
 
-	broadcast(broadcastMsg, uid)
+	case "approve", "deny":
+		answerJoinRequest(client, msg.Room, msg.To, msg.Type == "approve")
 
-	consoleMux.Lock()
-	fmt.Println(leaveMsg)
-	consoleMux.Unlock()
+	case "mentions":
+		sendUnreadMentions(client)
 
-	clientsMux.Lock()
-	delete(clients, uid)
-	clientsMux.Unlock()
+	case "sessions":
+		listSessions(client)
 
-	if client.Conn != nil {
-		client.Conn.Close()
-	}
-	if client.WsConn != nil {
-		client.WsConn.Close()
-	}
-}
+	case "search":
+		searchMessages(client, msg.Content)
 
-func checkHeartbeats() {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	case "revoke":
+		revokeSession(client, msg.Content)
 
-	for range ticker.C {
-		clientsMux.Lock()
-		for uid, client := range clients {
-			if time.Since(client.LastBeat) > 10*time.Second {
-				currentTime := time.Now().Format("15:04:05")
-				fmt.Printf("[%s] %s@%s Heartbeat detection failed.\n", currentTime, client.Username, client.IP)
-
-				leaveMsg := Message{
-					Type:    "leave",
-					UID:     client.UID,
-					User:    client.Username,
-					IP:      client.IP,
-					Content: "disconnected",
-				}
+	case "logout":
+		logout(client)
 
-				if client.Conn != nil {
-					client.Conn.Close()
-				}
-				if client.WsConn != nil {
-					client.WsConn.Close()
-				}
-				delete(clients, uid)
+	case "dm":
+		relayDM(client, msg.To, msg.Content, msg.E2E)
 
-				consoleMsg := fmt.Sprintf("[%s] %s@%s Disconnected.", currentTime, client.Username, client.IP)
-				consoleMux.Lock()
-				fmt.Println(consoleMsg)
-				consoleMux.Unlock()
+	case "key_publish":
+		publishKey(client, msg.Content)
 
-				broadcast(leaveMsg, "")
-			}
+	case "keys":
+		if msg.Room != "" {
+			sendRoomKeys(client, msg.Room)
+		} else {
+			sendKeys(client, msg.To)
 		}
-		clientsMux.Unlock()
+
+	case "file_begin":
+		if msg.File == nil {
+			return
+		}
+		if err := beginUpload(client, msg.File.Name, msg.File.Size, msg.File.SHA256); err != nil {
+			sendFileError(client, err)
+		}
+
+	case "file_chunk":
+		data, err := base64.StdEncoding.DecodeString(msg.Content)
+		if err == nil {
+			err = writeUploadChunk(client, data)
+		}
+		if err != nil {
+			abortUpload(client)
+			sendFileError(client, err)
+		}
+
+	case "file_end":
+		if err := finishUpload(client); err != nil {
+			sendFileError(client, err)
+		}
+
+	case "file":
+		/* Share a file that was previously stored through the HTTP upload endpoint */
+		if msg.File == nil {
+			return
+		}
+		info, err := lookupFile(msg.File.ID, msg.File.Name)
+		if err != nil {
+			sendFileError(client, err)
+			return
+		}
+		shareFile(client, info)
+
+	case "heartbeat":
+		client.LastBeat = time.Now()
+	}
+}
+
+/*
+ * Server-Sent Events transport for networks where WebSocket upgrades fail. The
+ * browser receives the same JSON messages over GET /sse and sends requests with
+ * POST /sse/send?stream=<key>, the key arrives as the first "stream" message.
+ * The first request is the join, so session tokens never appear in a URL.
+ */
+const (
+	sseBuffer      = 1024
+	sseJoinTimeout = 30 * time.Second
+)
+
+type sseStream struct {
+	Key    string
+	client *Client       // Set once the join was accepted, guarded by clientsMux
+	join   chan Message  // The first request
+	joined atomic.Bool   // Only one join per stream
+	ready  chan struct{} // Closed when the session is registered
+	events chan []byte
+	done   chan struct{}
+	once   sync.Once
+	posts  sync.Mutex // Requests are handled one at a time, like a WebSocket's reads
+}
+
+func newSSEStream() *sseStream {
+	key := make([]byte, 16)
+	rand.Read(key)
+	return &sseStream{
+		Key:    hex.EncodeToString(key),
+		join:   make(chan Message, 1),
+		ready:  make(chan struct{}),
+		events: make(chan []byte, sseBuffer),
+		done:   make(chan struct{}),
+	}
+}
+
+/* Queue a message without blocking, a stream that falls this far behind is closed */
+func (s *sseStream) send(data []byte) bool {
+	select {
+	case <-s.done:
+		return false
+	case s.events <- data:
+		return true
+	default:
+		s.Close()
+		return false
+	}
+}
+
+func (s *sseStream) Close() {
+	s.once.Do(func() { close(s.done) })
+}
+
+func handleSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	write := func(data []byte) error {
+		n, err := fmt.Fprintf(w, "data: %s\n\n", data)
+		metricBytesOut.Add("sse", int64(n))
+		flusher.Flush()
+		return err
+	}
+	reply := func(msg Message) {
+		data, _ := json.Marshal(msg)
+		write(data)
+	}
+
+	stream := newSSEStream()
+	clientsMux.Lock()
+	sseStreams[stream.Key] = stream
+	clientsMux.Unlock()
+	defer func() {
+		clientsMux.Lock()
+		delete(sseStreams, stream.Key)
+		clientsMux.Unlock()
+		stream.Close()
+	}()
+	reply(Message{Type: "stream", Content: stream.Key})
+
+	/* EventSource cannot send a body, the join request is the first POST to the stream */
+	var join Message
+	select {
+	case join = <-stream.join:
+	case <-time.After(sseJoinTimeout):
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	client, mentions := webLogin(join, strings.Split(r.RemoteAddr, ":")[0], "sse", reply)
+	if client == nil {
+		return
+	}
+	client.SSE = stream
+	defer abortUpload(client)
+
+	if err := pluginsConnect(client); err != nil {
+		reply(Message{Type: "system", Content: err.Error()})
+		return
+	}
+
+	/* Requests are only accepted once the session is registered and has its token, every exit below removes it */
+	welcomeMsg := webWelcomeMessage(client)
+	announceJoin(client)
+	clientsMux.Lock()
+	stream.client = client
+	clientsMux.Unlock()
+	close(stream.ready)
+
+	/* The welcome can queue more messages than the buffer holds, so it runs while this handler writes */
+	go webWelcome(client, welcomeMsg, mentions)
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case data := <-stream.events:
+			if err := write(data); err != nil {
+				client.logger().Info("SSE write error", "error", err)
+				removeClient(client.UID)
+				return
+			}
+
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+
+		case <-stream.done:
+			/* Send what was queued before the stream was closed, like a logout notice */
+			for len(stream.events) > 0 {
+				write(<-stream.events)
+			}
+			removeClient(client.UID)
+			return
+
+		case <-r.Context().Done():
+			client.logger().Info("SSE stream closed")
+			removeClient(client.UID)
+			return
+		}
+	}
+}
+
+/* Requests from SSE clients, one JSON message per POST */
+func handleSSESend(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	clientsMux.Lock()
+	stream := sseStreams[r.URL.Query().Get("stream")]
+	clientsMux.Unlock()
+	if stream == nil {
+		http.Error(w, "Unknown stream", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	metricBytesIn.Add("sse", int64(len(body)))
+
+	var msg Message
+	if err := json.Unmarshal(body, &msg); err != nil {
+		http.Error(w, "Invalid message", http.StatusBadRequest)
+		return
+	}
+
+	if msg.Type == "join" {
+		if !stream.joined.CompareAndSwap(false, true) {
+			http.Error(w, "The stream already joined", http.StatusConflict)
+			return
+		}
+		stream.join <- msg
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	/* Requests sent right after the join wait for the session */
+	select {
+	case <-stream.ready:
+	case <-stream.done:
+		http.Error(w, "Unknown stream", http.StatusNotFound)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	clientsMux.Lock()
+	client := stream.client
+	clientsMux.Unlock()
+
+	stream.posts.Lock()
+	handleWebMessage(client, msg)
+	stream.posts.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleTCPConnection(conn net.Conn) {
+	conn = &countingConn{Conn: conn, transport: "tcp"}
+	defer conn.Close()
+
+	remoteAddr := conn.RemoteAddr().String()
+	ip, _, err := net.SplitHostPort(remoteAddr)
+
+	if err != nil {
+		ip = remoteAddr
+	} else {
+		parsedIP := net.ParseIP(ip)
+		if parsedIP != nil {
+			ip = parsedIP.String()
+		}
+	}
+
+	/*
+	 * The first line is either a nickname or "TOKEN <session token>" to resume a session.
+	 * Bots send "PROTOCOL JSON" before it to receive every message as a JSON line.
+	 */
+	reader := bufio.NewReader(conn)
+	var token *sessionToken
+	var username string
+	var jsonLines bool
+	for username == "" {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			slog.Info("Failed to read username", "ip", ip, "transport", "tcp", "error", err)
+			return
+		}
+		line = strings.TrimSpace(line)
+
+		if line == "PROTOCOL JSON" {
+			jsonLines = true
+		} else if !strings.HasPrefix(line, "TOKEN ") {
+			username = line
+		} else if token, err = verifySessionToken(strings.TrimPrefix(line, "TOKEN ")); err != nil {
+			writeTCPLine(conn, jsonLines, Message{Type: "token_invalid", Content: "Session token rejected: " + err.Error()}, "TOKEN INVALID "+err.Error())
+		} else {
+			username = token.User
+		}
+	}
+
+	if *federationName != "" && strings.Contains(username, "@") {
+		writeTCPLine(conn, jsonLines, Message{Type: "system", Content: nicknameAtNotice}, nicknameAtNotice)
+		return
+	}
+	if ban := findBan(username, ip); ban != nil {
+		slog.Info("Rejected banned login", "username", username, "ip", ip, "transport", "tcp")
+		writeTCPLine(conn, jsonLines, Message{Type: "system", Content: ban.notice()}, ban.notice())
+		return
+	}
+	if token == nil && needsToken(accountKey(username)) {
+		slog.Info("Rejected login without a session token", "username", username, "ip", ip, "transport", "tcp")
+		writeTCPLine(conn, jsonLines, Message{Type: "system", Content: roleTokenNotice}, roleTokenNotice)
+		return
+	}
+
+	uid, mentions := resumeSession(token)
+
+	client := &Client{
+		UID:        uid,
+		Username:   username,
+		IP:         ip,
+		Conn:       conn,
+		LastBeat:   time.Now(),
+		ClientType: "tcp",
+		JSONLines:  jsonLines,
+		Connected:  time.Now(),
+		Token:      token,
+	}
+	defer abortUpload(client)
+
+	if err := pluginsConnect(client); err != nil {
+		writeTCPLine(conn, jsonLines, Message{Type: "system", Content: err.Error()}, err.Error())
+		return
+	}
+
+	/* The token is set before the session is announced, others read it under clientsMux */
+	welcomeMsg := Message{
+		Type:    "system",
+		UID:     uid,
+		User:    username,
+		Content: "You have successfully joined the server!",
+	}
+	clientsMux.Lock()
+	if token == nil {
+		welcomeMsg.Token, client.Token = issueSessionToken(username)
+	} else {
+		welcomeMsg.Content = "You have successfully resumed your session!"
+	}
+	clientsMux.Unlock()
+
+	client.logger().Info("Joined the server")
+
+	announceJoin(client)
+	restoreMentions(client, mentions)
+
+	if jsonLines {
+		clientsMux.Lock()
+		sendMessage(client, welcomeMsg)
+		clientsMux.Unlock()
+	} else {
+		conn.Write([]byte(welcomeMsg.Content + "\n"))
+		if welcomeMsg.Token != "" {
+			conn.Write([]byte("TOKEN " + welcomeMsg.Token + "\n"))
+		}
+	}
+	sendRoomMemberships(client)
+	deliverOfflineMessages(client)
+
+	messageChan := make(chan string)
+	errorChan := make(chan error)
+
+	go func() {
+		for {
+			msg, err := reader.ReadString('\n')
+			if err != nil {
+				errorChan <- err
+				return
+			}
+			messageChan <- strings.TrimSpace(msg)
+		}
+	}()
+
+	heartbeat := "HEARTBEAT\n"
+	if jsonLines {
+		heartbeat = `{"type":"heartbeat"}` + "\n"
+	}
+	heartbeatTicker := time.NewTicker(5 * time.Second)
+	defer heartbeatTicker.Stop()
+	timeoutTimer := time.NewTimer(10 * time.Second)
+	defer timeoutTimer.Stop()
+
+	for {
+		select {
+		case msg := <-messageChan:
+			if msg != "HEARTBEAT" {
+				metricMessagesReceived.Add("tcp", 1)
+			}
+			if msg == "HEARTBEAT" {
+				client.LastBeat = time.Now()
+				timeoutTimer.Reset(10 * time.Second)
+			} else if msg == "/mentions" {
+				sendUnreadMentions(client)
+			} else if msg == "/logout" {
+				logout(client)
+			} else if msg == "/sessions" {
+				listSessions(client)
+			} else if msg == "/search" || strings.HasPrefix(msg, "/search ") {
+				searchMessages(client, strings.TrimSpace(strings.TrimPrefix(msg, "/search")))
+			} else if strings.HasPrefix(msg, "/revoke ") {
+				revokeSession(client, strings.TrimSpace(strings.TrimPrefix(msg, "/revoke ")))
+			} else if strings.HasPrefix(msg, "FILE ") {
+				handleTCPFileCommand(client, msg)
+			} else if strings.HasPrefix(msg, "/msg ") || strings.HasPrefix(msg, "E2E ") || strings.HasPrefix(msg, "KEY PUBLISH ") || strings.HasPrefix(msg, "KEY GET ") {
+				handleTCPDirectCommand(client, msg)
+			} else if strings.HasPrefix(msg, "#") || strings.HasPrefix(msg, "KEY ROOM ") || isRoomCommand(msg) {
+				handleTCPRoomCommand(client, msg)
+			} else if isRoleCommand(msg) {
+				handleTCPRoleCommand(client, msg)
+			} else {
+				handleChat(client, "", msg)
+			}
+		case <-heartbeatTicker.C:
+			if _, err := conn.Write([]byte(heartbeat)); err != nil {
+				metricWriteFailures.Add("tcp", 1)
+				client.logger().Info("Failed to send heartbeat", "error", err)
+				removeClient(uid)
+				return
+			}
+		case <-timeoutTimer.C:
+			metricHeartbeatTimeouts.Add(1)
+			client.logger().Info("Heartbeat timeout")
+			removeClient(uid)
+			return
+		case err := <-errorChan:
+			client.logger().Info("Connection error", "error", err)
+			removeClient(uid)
+			return
+		}
+	}
+}
+
+func broadcast(msg Message, excludeUID string) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	start := time.Now()
+	defer func() {
+		metricMessagesBroadcast.Add(1)
+		metricBroadcastLatency.Observe(time.Since(start))
+	}()
+	if (msg.Type == "chat" || msg.Type == "file") && msg.ID == "" {
+		msg.ID = newMessageID()
+	}
+	switch msg.Type {
+	case "chat", "join", "leave", "room_join", "room_leave":
+		emitWebhookEvent(msg.Type, msg)
+	}
+	publishCluster(ClusterEvent{Kind: "broadcast", Msg: &msg, Exclude: excludeUID})
+	forwardRoomMessage(msg)
+	deliverLocal(msg, excludeUID)
+}
+
+/* Deliver a broadcast to the clients of this node, the caller must hold clientsMux */
+func deliverLocal(msg Message, excludeUID string) {
+	recordHistory(msg)
+
+	var room *Room
+	if msg.Room != "" {
+		room = rooms[msg.Room]
+	}
+
+	for uid, client := range clients {
+		if uid == excludeUID {
+			continue
+		}
+		/* Room messages only reach the sessions of its members */
+		if msg.Room != "" && (room == nil || !room.Members[client.Account.Name]) {
+			continue
+		}
+		sendMessage(client, msg)
+	}
+}
+
+/* Deliver a message to a single client, the caller must hold clientsMux */
+func sendMessage(client *Client, msg Message) {
+	metricMessagesDelivered.Add(client.ClientType, 1)
+
+	switch client.ClientType {
+	case "tcp":
+		line := formatTCPMessage(msg)
+		if client.JSONLines {
+			data, _ := json.Marshal(msg)
+			line = string(data) + "\n"
+		}
+		if _, err := client.Conn.Write([]byte(line)); err != nil {
+			metricWriteFailures.Add("tcp", 1)
+			client.logger().Warn("Failed to send message", "type", msg.Type, "error", err)
+		}
+
+	case "websocket":
+		data, _ := json.Marshal(msg)
+		metricBytesOut.Add("websocket", int64(len(data)))
+		if err := client.WsConn.WriteMessage(websocket.TextMessage, data); err != nil {
+			metricWriteFailures.Add("websocket", 1)
+			client.logger().Warn("Failed to send message", "type", msg.Type, "error", err)
+		}
+
+	case "sse":
+		data, _ := json.Marshal(msg)
+		if !client.SSE.send(data) {
+			metricWriteFailures.Add("sse", 1)
+			client.logger().Warn("Failed to send message", "type", msg.Type, "error", "stream closed or full")
+		}
+
+	case "irc":
+		if _, err := client.Conn.Write([]byte(formatIRCMessage(client, msg))); err != nil {
+			metricWriteFailures.Add("irc", 1)
+			client.logger().Warn("Failed to send message", "type", msg.Type, "error", err)
+		}
+	}
+}
+
+/* Write a handshake reply before the client is registered, as JSON or as a text line */
+func writeTCPLine(conn net.Conn, jsonLines bool, msg Message, text string) {
+	if jsonLines {
+		data, _ := json.Marshal(msg)
+		text = string(data)
+	}
+	conn.Write([]byte(text + "\n"))
+}
+
+/* Render a message as a line of the TCP text protocol */
+func formatTCPMessage(msg Message) string {
+	/* Clients decrypt end-to-end encrypted payloads themselves, so these are sent as JSON */
+	if len(msg.E2E) > 0 {
+		data, _ := json.Marshal(msg)
+		return "E2E " + string(data) + "\n"
+	}
+
+	switch msg.Type {
+	case "chat":
+		if msg.Room != "" {
+			return fmt.Sprintf("[%s] [#%s] [%s] %s\n",
+				time.Now().Format("15:04:05"), msg.Room, sender(msg), msg.Content)
+		}
+		return fmt.Sprintf("[%s] [%s] %s\n",
+			time.Now().Format("15:04:05"), sender(msg), msg.Content)
+	case "join":
+		return fmt.Sprintf("[%s] %s joined the chat\n",
+			time.Now().Format("15:04:05"), sender(msg))
+	case "leave":
+		return fmt.Sprintf("[%s] %s left the chat\n",
+			time.Now().Format("15:04:05"), sender(msg))
+	case "file":
+		return fmt.Sprintf("[%s] [%s] shared a file: %s (%s, %d bytes) /get %s\n",
+			time.Now().Format("15:04:05"), sender(msg),
+			msg.File.Name, msg.File.MIME, msg.File.Size, msg.File.ID[:12])
+	case "dm":
+		return fmt.Sprintf("[%s] [%s -> %s] %s\n",
+			time.UnixMilli(msg.Time).Format("15:04:05"), sender(msg), msg.To, msg.Content)
+	case "keys":
+		data, _ := json.Marshal(msg)
+		return "KEYS " + string(data) + "\n"
+	case "room_joined", "room_left", "room_join", "room_leave", "room_online", "topic_change":
+		data, _ := json.Marshal(msg)
+		return "ROOM " + string(data) + "\n"
+	case "mention":
+		where := ""
+		if msg.Room != "" {
+			where = " in #" + msg.Room
+		}
+		if msg.Content == "" {
+			return fmt.Sprintf("MENTION [%s] %s mentioned you%s\n", time.UnixMilli(msg.Time).Format("15:04:05"), sender(msg), where)
+		}
+		return fmt.Sprintf("MENTION [%s] %s mentioned you%s: %s\n",
+			time.UnixMilli(msg.Time).Format("15:04:05"), sender(msg), where, msg.Content)
+	case "system", "room_topic", "invite", "join_request":
+		return msg.Content + "\n"
+	case "search_results":
+		lines := msg.Content + "\n"
+		for _, result := range msg.Search.Results {
+			where := ""
+			if result.Room != "" {
+				where = " [#" + result.Room + "]"
+			}
+			who := result.User
+			if result.To != "" {
+				who += " -> " + result.To
+			}
+			lines += fmt.Sprintf("  [%s]%s [%s] %s\n",
+				time.UnixMilli(result.Time).Format("2006-01-02 15:04"), where, who, result.Snippet)
+		}
+		return lines
+	}
+	return ""
+}
+
+/* Relay a chat line to the main chat or a group room and notify the users it mentions */
+func handleChat(client *Client, room string, content string) {
+	if room != "" {
+		var err error
+		if room, err = roomName(room); err != nil {
+			roomNotice(client, err.Error())
+			return
+		}
+		if !checkRoomPost(client, room, false) {
+			return
+		}
+	} else if !checkMainPost(client) {
+		return
+	}
+	if content == "" {
+		return
+	}
+	if err := postChat(client, room, content); err != nil {
+		rejectNotice(client, err)
+	}
+}
+
+/*
+ * Relay a chat line that passed the room checks through the plugins, log it and
+ * notify the users it mentions. Returns the plugin error if it was rejected.
+ */
+func postChat(client *Client, room string, content string) error {
+	chatMsg := Message{
+		Type:    "chat",
+		UID:     client.UID,
+		User:    client.Username,
+		IP:      client.IP,
+		Role:    messageRole(client, room),
+		Content: content,
+		Room:    room,
+		Time:    time.Now().UnixMilli(),
+	}
+	if err := filterMessage(client, &chatMsg); err != nil {
+		return err
+	}
+
+	logger := client.logger()
+	if room != "" {
+		logger = logger.With("room", room)
+	}
+	logger.Info("Chat message", contentAttr(chatMsg.Content))
+
+	var offline []string
+	chatMsg.Mentions, offline = parseMentions(chatMsg.Content, client, room)
+	broadcast(chatMsg, client.UID)
+	notifyMentions(chatMsg)
+	queueOfflineMentions(chatMsg, offline)
+	return nil
+}
+
+/*
+ * Collect the UIDs addressed by @nickname, @here and @room tokens,
+ * along with the known accounts that were mentioned while offline
+ */
+func parseMentions(content string, sender *Client, room string) ([]string, []string) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	seen := make(map[string]bool)
+	var uids, offline []string
+	add := func(uid string, account string) {
+		if account != sender.Account.Name && !seen[uid] {
+			seen[uid] = true
+			uids = append(uids, uid)
+		}
+	}
+	remote := allRemoteSessions()
+
+	for _, word := range strings.Fields(content) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+		name := strings.TrimRight(word[1:], ".,:;!?)'\"")
+		if name == "" {
+			continue
+		}
+
+		/* @here and @room address everyone online in the room, the main chat includes everyone */
+		if name == "here" || name == "room" {
+			for uid, client := range clients {
+				if room == "" || (rooms[room] != nil && rooms[room].Members[client.Account.Name]) {
+					add(uid, client.Account.Name)
+				}
+			}
+			for _, session := range remote {
+				if room == "" || (rooms[room] != nil && rooms[room].Members[session.Account]) {
+					add(session.UID, session.Account)
+				}
+			}
+			continue
+		}
+
+		online := false
+		for uid, client := range clients {
+			if strings.EqualFold(client.Username, name) {
+				add(uid, client.Account.Name)
+				online = true
+			}
+		}
+		for _, session := range remote {
+			if strings.EqualFold(session.User, name) {
+				add(session.UID, session.Account)
+				online = true
+			}
+		}
+
+		account := accountKey(name)
+		if !online && !seen[account] && account != sender.Account.Name && isKnownAccount(account) {
+			seen[account] = true
+			offline = append(offline, account)
+		}
+	}
+	return uids, offline
+}
+
+/* Send a mention notification to every client addressed by a chat message */
+func notifyMentions(msg Message) {
+	if len(msg.Mentions) == 0 {
+		return
+	}
+
+	mention := Message{
+		Type:    "mention",
+		UID:     msg.UID,
+		User:    msg.User,
+		IP:      msg.IP,
+		Content: msg.Content,
+		Room:    msg.Room,
+		Time:    time.Now().UnixMilli(),
+	}
+
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	notified := make(map[*Account]bool)
+	for _, uid := range msg.Mentions {
+		client, exists := clients[uid]
+		if !exists {
+			continue
+		}
+
+		account := client.Account
+		addressed := mentionFor(mention, account.Name)
+		if !notified[account] {
+			notified[account] = true
+			account.Mentions = append(account.Mentions, addressed)
+			if len(account.Mentions) > maxUnreadMentions {
+				account.Mentions = account.Mentions[len(account.Mentions)-maxUnreadMentions:]
+			}
+			addressed.To = account.Name
+			emitWebhookEvent("mention", addressed)
+			addressed.To = ""
+		}
+		sendMessage(client, addressed)
+	}
+}
+
+/*
+ * Users mentioned in an invite-only or password protected room they are not a member of
+ * only learn where they were mentioned, not what was said. The caller must hold clientsMux.
+ */
+func mentionFor(mention Message, account string) Message {
+	room := rooms[mention.Room]
+	if room != nil && (room.Visibility == "invite" || room.Visibility == "password") && !room.Members[account] {
+		mention.Content = ""
+	}
+	return mention
+}
+
+/* Replay an account's unread mentions and mark them as read */
+func sendUnreadMentions(client *Client) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	unread := client.Account.Mentions
+	client.Account.Mentions = nil
+
+	if len(unread) == 0 {
+		sendMessage(client, Message{Type: "system", Content: "You have no unread mentions."})
+		return
+	}
+
+	sendMessage(client, Message{
+		Type:    "system",
+		Content: fmt.Sprintf("You have %d unread mentions:", len(unread)),
+	})
+	for _, mention := range unread {
+		content := mention.Content
+		if content == "" {
+			content = "mentioned you in #" + mention.Room
+		}
+		sendMessage(client, Message{
+			Type: "system",
+			Content: fmt.Sprintf("[%s] [%s@%s] %s", time.UnixMilli(mention.Time).Format("15:04:05"),
+				mention.User, shortIP(mention.IP), content),
+		})
+	}
+}
+
+/* Sender of a message as user@ip, users of other servers are already written as nick@server */
+func sender(msg Message) string {
+	name := msg.User
+	if msg.IP != "" {
+		name += "@" + shortIP(msg.IP)
+	}
+	if msg.Role != "" {
+		name += " (" + msg.Role + ")"
+	}
+	return name
+}
+
+/* Address shortening function */
+func shortIP(ip string) string {
+	if len(ip) > 20 {
+		return ip[:10] + "..." + ip[len(ip)-6:]
+	}
+	return ip
+}
+
+/*
+ * Add a client to the session registry and announce it. Presence is per account,
+ * so only the first session broadcasts a join, later ones notify the other sessions.
+ */
+func announceJoin(client *Client) {
+	clientsMux.Lock()
+	clients[client.UID] = client
+
+	name := accountKey(client.Username)
+	account, exists := onlineAccounts[name]
+	if !exists {
+		account = &Account{Name: name, Sessions: make(map[string]*Client)}
+		onlineAccounts[name] = account
+	}
+	account.Sessions[client.UID] = client
+	client.Account = account
+	publishCluster(ClusterEvent{Kind: "session_up", Session: localSession(client)})
+
+	/* Presence is cluster-wide, sessions on other nodes count as well */
+	online := exists || remoteOnline(name)
+	if online {
+		notice := Message{
+			Type:    "system",
+			Content: fmt.Sprintf("New session %s (%s) from %s.", client.UID, client.ClientType, client.IP),
+		}
+		for _, session := range account.Sessions {
+			if session != client {
+				sendMessage(session, notice)
+			}
+		}
+		publishCluster(ClusterEvent{Kind: "account", Account: name, Msg: &notice})
+	}
+	clientsMux.Unlock()
+
+	if !online {
+		broadcast(Message{
+			Type:    "join",
+			UID:     client.UID,
+			User:    client.Username,
+			IP:      client.IP,
+			Content: "joined the server",
+		}, client.UID)
+	}
+}
+
+func removeClient(uid string) {
+	clientsMux.Lock()
+	client, exists := clients[uid]
+	lastSession := false
+	var mentions []Message
+	if exists {
+		delete(clients, uid)
+		delete(client.Account.Sessions, uid)
+		if len(client.Account.Sessions) == 0 {
+			delete(onlineAccounts, client.Account.Name)
+			lastSession = !remoteOnline(client.Account.Name)
+			mentions = client.Account.Mentions
+		}
+		publishCluster(ClusterEvent{Kind: "session_down", Session: localSession(client)})
+	}
+	clientsMux.Unlock()
+
+	if !exists {
+		return
+	}
+	suspendSession(client, mentions)
+
+	if lastSession {
+		broadcast(Message{
+			Type:    "leave",
+			UID:     client.UID,
+			User:    client.Username,
+			IP:      client.IP,
+			Content: "disconnected",
+		}, uid)
+	}
+
+	client.logger().Info("Disconnected", "last_session", lastSession)
+	pluginsDisconnect(client)
+	client.closeConnection()
+}
+
+/* List the active sessions of a client's account */
+func listSessions(client *Client) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	sessions := make([]*Client, 0, len(client.Account.Sessions))
+	for _, session := range client.Account.Sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Connected.Before(sessions[j].Connected)
+	})
+
+	var remote []RemoteSession
+	for _, session := range allRemoteSessions() {
+		if session.Account == client.Account.Name {
+			remote = append(remote, session)
+		}
+	}
+
+	sendMessage(client, Message{
+		Type:    "system",
+		Content: fmt.Sprintf("Active sessions for %s (%d):", client.Username, len(sessions)+len(remote)),
+	})
+	for _, session := range sessions {
+		line := fmt.Sprintf("  %s  %s from %s since %s", session.UID, session.ClientType,
+			session.IP, session.Connected.Format("2006-01-02 15:04:05"))
+		if session == client {
+			line += " (this session)"
+		}
+		sendMessage(client, Message{Type: "system", Content: line})
+	}
+	for _, session := range remote {
+		sendMessage(client, Message{Type: "system", Content: fmt.Sprintf("  %s  %s from %s since %s on node %s", session.UID, session.Transport,
+			session.IP, session.Connected.Format("2006-01-02 15:04:05"), session.Node)})
+	}
+}
+
+/* Disconnect another session of the same account */
+func revokeSession(client *Client, uid string) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	target, exists := client.Account.Sessions[uid]
+	if !exists {
+		notice := "No such session: " + uid
+		for _, session := range allRemoteSessions() {
+			if session.UID == uid && session.Account == client.Account.Name {
+				notice = "Session " + uid + " is connected to node " + session.Node + ", revoke it from a session on that node."
+			}
+		}
+		sendMessage(client, Message{Type: "system", Content: notice})
+		return
+	}
+	if target == client {
+		sendMessage(client, Message{Type: "system", Content: "Use quit to end the current session."})
+		return
+	}
+
+	if target.Token != nil {
+		revokeSessionToken(target.Token.ID, target.Token.Expires)
+	}
+	sendMessage(target, Message{Type: "system", Content: "This session was revoked from session " + client.UID + "."})
+	target.closeConnection()
+	sendMessage(client, Message{Type: "system", Content: "Session " + uid + " revoked."})
+}
+
+func checkHeartbeats() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var expired []*Client
+
+		clientsMux.Lock()
+		for _, client := range clients {
+			/* The IRC gateway checks its sessions with PING */
+			if client.ClientType != "irc" && time.Since(client.LastBeat) > 10*time.Second {
+				expired = append(expired, client)
+			}
+		}
+		clientsMux.Unlock()
+
+		/* removeClient broadcasts the leave message, which needs clientsMux */
+		for _, client := range expired {
+			metricHeartbeatTimeouts.Add(1)
+			client.logger().Info("Heartbeat detection failed")
+			removeClient(client.UID)
+		}
+	}
+}
+
+func initFileStore() error {
+	return os.MkdirAll(filepath.Join(*dataDir, "files", "tmp"), 0755)
+}
+
+/* Content-addressed location of a stored file */
+func filePath(id string) string {
+	return filepath.Join(*dataDir, "files", id[:2], id)
+}
+
+func isHexID(id string) bool {
+	if len(id) < 8 || len(id) > sha256.Size*2 {
+		return false
+	}
+	for _, c := range id {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+/* Resolve a full or abbreviated file ID to the full SHA-256 */
+func resolveFileID(id string) (string, error) {
+	if !isHexID(id) {
+		return "", errors.New("invalid file id")
+	}
+	if len(id) == sha256.Size*2 {
+		if _, err := os.Stat(filePath(id)); err != nil {
+			return "", errors.New("file not found")
+		}
+		return id, nil
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(*dataDir, "files", id[:2], id+"*"))
+	switch len(matches) {
+	case 0:
+		return "", errors.New("file not found")
+	case 1:
+		return filepath.Base(matches[0]), nil
+	}
+	return "", errors.New("ambiguous file id")
+}
+
+func detectContentType(name string, head []byte) string {
+	contentType := http.DetectContentType(head)
+	if contentType == "application/octet-stream" {
+		if byExt := mime.TypeByExtension(filepath.Ext(name)); byExt != "" {
+			contentType = byExt
+		}
+	}
+	return contentType
+}
+
+func fileURL(id, name string) string {
+	return "/files/" + id + "?name=" + url.QueryEscape(name)
+}
+
+/* Build the metadata of an already stored file */
+func lookupFile(id, name string) (*FileInfo, error) {
+	id, err := resolveFileID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filePath(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+
+	name = filepath.Base(name)
+	if name == "." || name == "/" {
+		name = id[:12]
+	}
+
+	return &FileInfo{
+		ID:     id,
+		Name:   name,
+		Size:   stat.Size(),
+		MIME:   detectContentType(name, head[:n]),
+		SHA256: id,
+		URL:    fileURL(id, name),
+	}, nil
+}
+
+func newFileUpload(name string, size int64, checksum string) (*fileUpload, error) {
+	name = filepath.Base(strings.TrimSpace(name))
+	if name == "" || name == "." || name == "/" {
+		return nil, errors.New("missing file name")
+	}
+	if size <= 0 {
+		return nil, errors.New("invalid file size")
+	}
+	if size > *maxFileSize {
+		return nil, fmt.Errorf("file is larger than the %d byte limit", *maxFileSize)
+	}
+	checksum = strings.ToLower(checksum)
+	if checksum != "" && (len(checksum) != sha256.Size*2 || !isHexID(checksum)) {
+		return nil, errors.New("invalid SHA-256 checksum")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(*dataDir, "files", "tmp"), "upload-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileUpload{
+		Name:   name,
+		Size:   size,
+		SHA256: checksum,
+		Hash:   sha256.New(),
+		Tmp:    tmp,
+	}, nil
+}
+
+func (u *fileUpload) Write(p []byte) (int, error) {
+	if u.Received+int64(len(p)) > u.Size {
+		return 0, errors.New("file is larger than announced")
+	}
+	if len(u.Head) < 512 {
+		u.Head = append(u.Head, p[:min(len(p), 512-len(u.Head))]...)
+	}
+
+	n, err := u.Tmp.Write(p)
+	u.Hash.Write(p[:n])
+	u.Received += int64(n)
+	return n, err
+}
+
+/* Verify the received content and move it to its content-addressed location */
+func (u *fileUpload) Finish() (*FileInfo, error) {
+	defer u.Abort()
+
+	if u.Received != u.Size {
+		return nil, fmt.Errorf("received %d of %d bytes", u.Received, u.Size)
+	}
+	id := hex.EncodeToString(u.Hash.Sum(nil))
+	if u.SHA256 != "" && u.SHA256 != id {
+		return nil, errors.New("SHA-256 checksum mismatch")
+	}
+
+	if err := u.Tmp.Close(); err != nil {
+		return nil, err
+	}
+	dest := filePath(id)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dest); err != nil {
+		if err := os.Rename(u.Tmp.Name(), dest); err != nil {
+			return nil, err
+		}
+	}
+
+	return &FileInfo{
+		ID:     id,
+		Name:   u.Name,
+		Size:   u.Size,
+		MIME:   detectContentType(u.Name, u.Head),
+		SHA256: id,
+		URL:    fileURL(id, u.Name),
+	}, nil
+}
+
+func (u *fileUpload) Abort() {
+	u.Tmp.Close()
+	os.Remove(u.Tmp.Name())
+}
+
+/* Bytes an account uploaded since Start */
+type quotaWindow struct {
+	Start time.Time
+	Bytes int64
+}
+
+/* Charge an upload to the daily quota of an account */
+func reserveUpload(account string, size int64) error {
+	if *uploadQuota <= 0 {
+		return nil
+	}
+
+	uploadMux.Lock()
+	defer uploadMux.Unlock()
+
+	window := uploadQuotas[account]
+	if window == nil || time.Since(window.Start) > 24*time.Hour {
+		window = &quotaWindow{Start: time.Now()}
+		uploadQuotas[account] = window
+	}
+	if window.Bytes+size > *uploadQuota {
+		return fmt.Errorf("the upload quota of %d bytes per day is used up", *uploadQuota)
+	}
+	window.Bytes += size
+	return nil
+}
+
+func beginUpload(client *Client, name string, size int64, checksum string) error {
+	abortUpload(client)
+	if err := reserveUpload(client.Account.Name, size); err != nil {
+		return err
+	}
+
+	upload, err := newFileUpload(name, size, checksum)
+	if err != nil {
+		return err
+	}
+	client.Upload = upload
+	return nil
+}
+
+func writeUploadChunk(client *Client, data []byte) error {
+	if client.Upload == nil {
+		return errors.New("no upload in progress")
+	}
+	_, err := client.Upload.Write(data)
+	return err
+}
+
+func finishUpload(client *Client) error {
+	if client.Upload == nil {
+		return errors.New("no upload in progress")
+	}
+	upload := client.Upload
+	client.Upload = nil
+
+	info, err := upload.Finish()
+	if err != nil {
+		return err
+	}
+	shareFile(client, info)
+	return nil
+}
+
+func abortUpload(client *Client) {
+	if client.Upload != nil {
+		client.Upload.Abort()
+		client.Upload = nil
+	}
+}
+
+func sendFileError(client *Client, err error) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	sendMessage(client, Message{Type: "system", Content: "File transfer failed: " + err.Error()})
+}
+
+/* Announce a stored file to everyone, including the uploader */
+func shareFile(client *Client, info *FileInfo) {
+	if !checkMainPost(client) {
+		return
+	}
+	msg := Message{
+		Type: "file",
+		UID:  client.UID,
+		User: client.Username,
+		IP:   client.IP,
+		Role: messageRole(client, ""),
+		File: info,
+	}
+	if err := filterMessage(client, &msg); err != nil {
+		rejectNotice(client, err)
+		return
+	}
+
+	client.logger().Info("Shared file", "file", info.Name, "mime", info.MIME, "size", info.Size, "sha256", info.ID)
+	broadcast(msg, "")
+}
+
+/*
+ * TCP clients transfer files with line framed commands:
+ *   FILE BEGIN <size> <sha256> <name>
+ *   FILE CHUNK <base64 data>
+ *   FILE END
+ */
+func handleTCPFileCommand(client *Client, line string) {
+	fields := strings.SplitN(line, " ", 5)
+	if len(fields) < 2 {
+		return
+	}
+
+	var err error
+	switch fields[1] {
+	case "BEGIN":
+		if len(fields) != 5 {
+			err = errors.New("malformed FILE BEGIN")
+			break
+		}
+		size, convErr := strconv.ParseInt(fields[2], 10, 64)
+		if convErr != nil {
+			err = errors.New("invalid file size")
+			break
+		}
+		err = beginUpload(client, fields[4], size, fields[3])
+
+	case "CHUNK":
+		if len(fields) != 3 {
+			err = errors.New("malformed FILE CHUNK")
+			break
+		}
+		data, decodeErr := base64.StdEncoding.DecodeString(fields[2])
+		if decodeErr != nil {
+			err = decodeErr
+			break
+		}
+		err = writeUploadChunk(client, data)
+
+	case "END":
+		err = finishUpload(client)
+		if err != nil {
+			sendFileError(client, err)
+		}
+		return
+
+	default:
+		err = fmt.Errorf("unknown command FILE %s", fields[1])
+	}
+
+	if err != nil {
+		abortUpload(client)
+		sendFileError(client, err)
+	}
+}
+
+/* Store a file posted as multipart form field "file" and return its metadata */
+func handleFileUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	/* Scripts upload with the session token of the account the file is charged to */
+	token, err := verifySessionToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if err != nil {
+		http.Error(w, "a valid session token is required", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, *maxFileSize+1<<20)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	if header.Size > *maxFileSize {
+		http.Error(w, fmt.Sprintf("file is larger than the %d byte limit", *maxFileSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := reserveUpload(accountKey(token.User), header.Size); err != nil {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	upload, err := newFileUpload(header.Filename, header.Size, r.FormValue("sha256"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := io.Copy(upload, file); err != nil {
+		upload.Abort()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	info, err := upload.Finish()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+func handleFileDownload(w http.ResponseWriter, r *http.Request) {
+	id, err := resolveFileID(strings.TrimPrefix(r.URL.Path, "/files/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(filePath(id))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	name := filepath.Base(r.URL.Query().Get("name"))
+	if name == "." || name == "/" {
+		name = id
+	}
+
+	/*
+	 * The type comes from the content and never from the name in the URL, and files
+	 * are downloaded rather than rendered, so an uploaded page cannot run on this origin.
+	 * Images still show in the web client's <img> previews.
+	 */
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	w.Header().Set("Content-Type", http.DetectContentType(head[:n]))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("ETag", `"`+id+`"`)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	http.ServeContent(w, r, name, stat.ModTime(), f)
+}
+
+/* Accounts are identified by nickname, case-insensitively */
+func accountKey(username string) string {
+	return strings.ToLower(username)
+}
+
+func offlineQueuePath(account string) string {
+	return filepath.Join(*dataDir, "offline", hex.EncodeToString([]byte(account))+".jsonl")
+}
+
+func accountsPath() string {
+	return filepath.Join(*dataDir, "accounts.json")
+}
+
+func initOfflineStore() error {
+	if err := os.MkdirAll(filepath.Join(*dataDir, "offline"), 0755); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(accountsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return err
+	}
+	for _, name := range names {
+		accounts[name] = true
+	}
+	return nil
+}
+
+func isKnownAccount(account string) bool {
+	offlineMux.Lock()
+	defer offlineMux.Unlock()
+
+	return accounts[account]
+}
+
+/* Record an account on login so it can receive messages while offline */
+func rememberAccount(account string) {
+	offlineMux.Lock()
+	defer offlineMux.Unlock()
+
+	if accounts[account] {
+		return
+	}
+	accounts[account] = true
+
+	names := make([]string, 0, len(accounts))
+	for name := range accounts {
+		names = append(names, name)
+	}
+	data, _ := json.Marshal(names)
+	if err := os.WriteFile(accountsPath(), data, 0644); err != nil {
+		slog.Error("Failed to save accounts", "error", err)
+	}
+}
+
+/* Read a queue, dropping messages older than the configured age, the caller must hold offlineMux */
+func loadOfflineQueue(account string) []Message {
+	data, err := os.ReadFile(offlineQueuePath(account))
+	if err != nil {
+		return nil
+	}
+
+	cutoff := time.Now().Add(-*offlineAge).UnixMilli()
+	var queue []Message
+	for _, line := range strings.Split(string(data), "\n") {
+		var msg Message
+		if line == "" || json.Unmarshal([]byte(line), &msg) != nil {
+			continue
+		}
+		if msg.Time >= cutoff {
+			queue = append(queue, msg)
+		}
+	}
+	return queue
+}
+
+/* Persist a message for an account that is not connected */
+func queueOfflineMessage(account string, msg Message) {
+	offlineMux.Lock()
+	defer offlineMux.Unlock()
+
+	queue := append(loadOfflineQueue(account), msg)
+	if len(queue) > *offlineMax {
+		queue = queue[len(queue)-*offlineMax:]
+	}
+
+	var buf strings.Builder
+	for _, queued := range queue {
+		line, _ := json.Marshal(queued)
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := os.WriteFile(offlineQueuePath(account), []byte(buf.String()), 0644); err != nil {
+		slog.Error("Failed to queue offline message", "username", account, "error", err)
+	}
+}
+
+func queueOfflineMentions(msg Message, names []string) {
+	for _, account := range names {
+		clientsMux.Lock()
+		mention := mentionFor(Message{
+			Type:    "mention",
+			UID:     msg.UID,
+			User:    msg.User,
+			IP:      msg.IP,
+			Content: msg.Content,
+			Room:    msg.Room,
+			Time:    time.Now().UnixMilli(),
+		}, account)
+		clientsMux.Unlock()
+		queueOfflineMessage(account, mention)
+
+		mention.To = account
+		emitWebhookEvent("mention", mention)
+	}
+}
+
+/* Deliver and clear the messages queued for a client's account while it was away */
+func deliverOfflineMessages(client *Client) {
+	name := client.Account.Name
+	rememberAccount(name)
+
+	offlineMux.Lock()
+	queue := loadOfflineQueue(name)
+	os.Remove(offlineQueuePath(name))
+	offlineMux.Unlock()
+
+	if len(queue) == 0 {
+		return
+	}
+
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	sendMessage(client, Message{
+		Type:    "system",
+		Content: fmt.Sprintf("You have %d messages while you were away:", len(queue)),
+	})
+	account := client.Account
+	for _, msg := range queue {
+		if msg.Type == "mention" {
+			account.Mentions = append(account.Mentions, msg)
+		}
+		sendMessage(client, msg)
+	}
+	if len(account.Mentions) > maxUnreadMentions {
+		account.Mentions = account.Mentions[len(account.Mentions)-maxUnreadMentions:]
+	}
+}
+
+type sessionToken struct {
+	ID      string `json:"id"`
+	User    string `json:"user"`
+	Expires int64  `json:"exp"` // Unix seconds
+}
+
+/* State kept for a disconnected session so a reconnect within the grace window can reclaim it */
+type resumableSession struct {
+	UID      string
+	Mentions []Message
+	Expires  time.Time
+}
+
+func sessionKeyPath() string {
+	return filepath.Join(*dataDir, "session.key")
+}
+
+func revokedTokensPath() string {
+	return filepath.Join(*dataDir, "revoked_tokens.json")
+}
+
+/* Load or create the token signing key and the revocation list */
+func initSessionTokens() error {
+	key, err := os.ReadFile(sessionKeyPath())
+	if errors.Is(err, os.ErrNotExist) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if err := os.WriteFile(sessionKeyPath(), key, 0600); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	sessionKey = key
+
+	data, err := os.ReadFile(revokedTokensPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &revokedTokens)
+}
+
+func signToken(payload string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/* Issue a signed token that lets the session log in again without a nickname */
+func issueSessionToken(username string) (string, *sessionToken) {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	token := &sessionToken{
+		ID:      hex.EncodeToString(id),
+		User:    username,
+		Expires: time.Now().Add(*tokenTTL).Unix(),
+	}
+	data, _ := json.Marshal(token)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + signToken(payload), token
+}
+
+func verifySessionToken(raw string) (*sessionToken, error) {
+	payload, signature, found := strings.Cut(raw, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(signToken(payload))) {
+		return nil, errors.New("invalid signature")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	var token sessionToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, err
+	}
+
+	if time.Now().Unix() > token.Expires {
+		return nil, errors.New("token expired")
+	}
+	tokensMux.Lock()
+	_, revoked := revokedTokens[token.ID]
+	tokensMux.Unlock()
+	if revoked {
+		return nil, errors.New("token revoked")
+	}
+	return &token, nil
+}
+
+/* Reject a token from now on, the entry is kept until the token would have expired anyway */
+func revokeSessionToken(id string, expires int64) {
+	if id == "" {
+		return
+	}
+
+	tokensMux.Lock()
+	defer tokensMux.Unlock()
+
+	now := time.Now().Unix()
+	for revokedID, exp := range revokedTokens {
+		if exp < now {
+			delete(revokedTokens, revokedID)
+		}
+	}
+	revokedTokens[id] = expires
+	delete(resumable, id)
+
+	data, _ := json.Marshal(revokedTokens)
+	if err := os.WriteFile(revokedTokensPath(), data, 0600); err != nil {
+		slog.Error("Failed to save revoked tokens", "error", err)
+	}
+}
+
+/* Remember a closed session for the resume grace window */
+func suspendSession(client *Client, mentions []Message) {
+	if client.Token == nil {
+		return
+	}
+
+	tokensMux.Lock()
+	defer tokensMux.Unlock()
+
+	if _, revoked := revokedTokens[client.Token.ID]; revoked {
+		return
+	}
+	for id, session := range resumable {
+		if time.Now().After(session.Expires) {
+			delete(resumable, id)
+		}
+	}
+	resumable[client.Token.ID] = &resumableSession{
+		UID:      client.UID,
+		Mentions: mentions,
+		Expires:  time.Now().Add(*resumeGrace),
+	}
+}
+
+/* Reclaim a suspended session, falling back to a fresh UID once the grace window is over */
+func resumeSession(token *sessionToken) (string, []Message) {
+	if token != nil {
+		tokensMux.Lock()
+		session, exists := resumable[token.ID]
+		delete(resumable, token.ID)
+		tokensMux.Unlock()
+
+		if exists && time.Now().Before(session.Expires) {
+			clientsMux.Lock()
+			_, inUse := clients[session.UID]
+			clientsMux.Unlock()
+			if !inUse {
+				return session.UID, session.Mentions
+			}
+		}
+	}
+	/* UIDs of clustered nodes carry the node name so they are unique in the cluster */
+	if *clusterAddr != "" {
+		return fmt.Sprintf("%s-%d", nodeID, atomic.AddUint32(&uidCounter, 1)), nil
+	}
+	return fmt.Sprintf("%d", atomic.AddUint32(&uidCounter, 1)), nil
+}
+
+/* Put back the unread mentions of a resumed session */
+func restoreMentions(client *Client, mentions []Message) {
+	if len(mentions) == 0 {
+		return
+	}
+
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	account := client.Account
+	account.Mentions = append(mentions, account.Mentions...)
+	if len(account.Mentions) > maxUnreadMentions {
+		account.Mentions = account.Mentions[len(account.Mentions)-maxUnreadMentions:]
+	}
+}
+
+/* Revoke the current session's token and disconnect it */
+func logout(client *Client) {
+	revokeSessionToken(client.Token.ID, client.Token.Expires)
+
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	sendMessage(client, Message{Type: "system", Content: "You have been logged out, your session token is no longer valid."})
+	client.closeConnection()
+}
+
+func keysPath() string {
+	return filepath.Join(*dataDir, "keys.json")
+}
+
+func initKeyDirectory() error {
+	data, err := os.ReadFile(keysPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &deviceKeys)
+}
+
+/* Device IDs are derived from the public key, so clients can compute them too */
+func deviceID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:16])
+}
+
+/* Add a device's X25519 identity key to its account's key directory */
+func publishKey(client *Client, encoded string) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		clientsMux.Lock()
+		sendMessage(client, Message{Type: "system", Content: "Invalid identity key."})
+		clientsMux.Unlock()
+		return
+	}
+
+	keysMux.Lock()
+	name := client.Account.Name
+	id := deviceID(key)
+	now := time.Now().Unix()
+	keys := deviceKeys[name]
+	if i := slices.IndexFunc(keys, func(existing DeviceKey) bool { return existing.Device == id }); i >= 0 {
+		keys[i].Seen = now
+		saveKeys()
+		publishCluster(ClusterEvent{Kind: "keys", Keys: map[string][]DeviceKey{name: slices.Clone(keys)}})
+		keysMux.Unlock()
+		return
+	}
+
+	/*
+	 * A full directory only gives up the key of a device that has been away for a long
+	 * time, so whoever logs in with a nickname cannot push the owner's devices out
+	 */
+	if len(keys) >= maxDeviceKeys {
+		oldest := slices.MinFunc(keys, func(a, b DeviceKey) int { return cmp.Compare(a.lastSeen(), b.lastSeen()) })
+		if time.Since(time.Unix(oldest.lastSeen(), 0)) < deviceKeyIdle {
+			keysMux.Unlock()
+			client.logger().Warn("Identity key refused, the account has too many devices", "device", id)
+			roomNotice(client, fmt.Sprintf("This account already has %d devices with identity keys, end-to-end encryption is unavailable on this one.", maxDeviceKeys))
+			return
+		}
+		keys = slices.DeleteFunc(slices.Clone(keys), func(existing DeviceKey) bool { return existing.Device == oldest.Device })
+	}
+	keys = append(keys, DeviceKey{Device: id, Key: encoded, Published: now, Seen: now})
+	deviceKeys[name] = keys
+
+	client.logger().Info("Published identity key", "device", id)
+	saveKeys()
+	publishCluster(ClusterEvent{Kind: "keys", Keys: map[string][]DeviceKey{name: keys}})
+	keysMux.Unlock()
+}
+
+func (k DeviceKey) lastSeen() int64 {
+	return max(k.Seen, k.Published)
+}
+
+/* The caller must hold keysMux */
+func saveKeys() {
+	data, _ := json.Marshal(deviceKeys)
+	if err := os.WriteFile(keysPath(), data, 0644); err != nil {
+		slog.Error("Failed to save identity keys", "error", err)
+	}
+}
+
+/* Reply with the identity keys of a user and of the requester's own devices */
+func sendKeys(client *Client, user string) {
+	keysMux.Lock()
+	reply := Message{
+		Type:    "keys",
+		User:    user,
+		Keys:    append([]DeviceKey(nil), deviceKeys[accountKey(user)]...),
+		OwnKeys: append([]DeviceKey(nil), deviceKeys[client.Account.Name]...),
+	}
+	keysMux.Unlock()
+
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	sendMessage(client, reply)
+}
+
+/*
+ * Deliver a direct message to every session of the recipient and echo it to the
+ * sender's other sessions. End-to-end encrypted payloads are relayed untouched.
+ */
+func relayDM(client *Client, to string, content string, e2e json.RawMessage) {
+	to = strings.TrimSpace(to)
+	name := accountKey(to)
+	if name == "" || (content == "" && len(e2e) == 0) {
+		return
+	}
+
+	dm := Message{
+		Type:    "dm",
+		UID:     client.UID,
+		User:    client.Username,
+		IP:      client.IP,
+		To:      to,
+		Content: content,
+		E2E:     e2e,
+		Time:    time.Now().UnixMilli(),
+		ID:      newMessageID(),
+	}
+	if err := filterMessage(client, &dm); err != nil {
+		rejectNotice(client, err)
+		return
+	}
+
+	client.logger().Info("Direct message", "to", to, "encrypted", len(e2e) > 0, contentAttr(dm.Content))
+
+	if _, server := splitAddress(to); server != "" && *federationName != "" {
+		relayFederatedDM(client, dm)
+		return
+	}
+
+	clientsMux.Lock()
+	target, online := onlineAccounts[name]
+	if online {
+		for _, session := range target.Sessions {
+			sendMessage(session, dm)
+		}
+	}
+	if target != client.Account {
+		for _, session := range client.Account.Sessions {
+			if session != client {
+				sendMessage(session, dm)
+			}
+		}
+	}
+	/* Sessions on other nodes, the sender's own session is never among them */
+	publishCluster(ClusterEvent{Kind: "account", Account: name, Msg: &dm})
+	if name != client.Account.Name {
+		publishCluster(ClusterEvent{Kind: "account", Account: client.Account.Name, Msg: &dm})
+	}
+	online = online || remoteOnline(name)
+	clientsMux.Unlock()
+
+	if online {
+		recordHistory(dm)
+		return
+	}
+
+	notice := "No such user: " + to
+	if isKnownAccount(name) {
+		recordHistory(dm)
+		queueOfflineMessage(name, dm)
+		notice = to + " is offline, the message will be delivered when they log in."
+	}
+	clientsMux.Lock()
+	sendMessage(client, Message{Type: "system", Content: notice})
+	clientsMux.Unlock()
+}
+
+/*
+ * TCP clients use these commands for direct messages and identity keys:
+ *   /msg <nick> <text>
+ *   E2E <JSON message with "to" and "e2e">
+ *   KEY PUBLISH <base64 X25519 public key>
+ *   KEY GET <nick>
+ */
+func handleTCPDirectCommand(client *Client, line string) {
+	switch {
+	case strings.HasPrefix(line, "/msg "):
+		to, content, _ := strings.Cut(strings.TrimPrefix(line, "/msg "), " ")
+		relayDM(client, to, strings.TrimSpace(content), nil)
+
+	case strings.HasPrefix(line, "E2E "):
+		var msg Message
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "E2E ")), &msg); err != nil {
+			return
+		}
+		if msg.Room != "" {
+			relayRoomE2E(client, msg.Room, msg.E2E)
+		} else {
+			relayDM(client, msg.To, "", msg.E2E)
+		}
+
+	case strings.HasPrefix(line, "KEY PUBLISH "):
+		publishKey(client, strings.TrimPrefix(line, "KEY PUBLISH "))
+
+	case strings.HasPrefix(line, "KEY GET "):
+		sendKeys(client, strings.TrimSpace(strings.TrimPrefix(line, "KEY GET ")))
+	}
+}
+
+func roomsPath() string {
+	return filepath.Join(*dataDir, "rooms.json")
+}
+
+func initRooms() error {
+	data, err := os.ReadFile(roomsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &rooms)
+}
+
+/* Persist the room list, the caller must hold clientsMux */
+func saveRooms() {
+	data, _ := json.Marshal(rooms)
+	if err := os.WriteFile(roomsPath(), data, 0644); err != nil {
+		slog.Error("Failed to save rooms", "error", err)
+	}
+}
+
+/* Normalize a room name, with or without the leading '#' */
+func roomName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "#"))
+	base, server, federated := strings.Cut(name, "@")
+	if base == "" || len(base) > 32 {
+		return "", errors.New("room names must be 1 to 32 characters long")
+	}
+	for _, c := range base {
+		if !strings.ContainsRune("abcdefghijklmnopqrstuvwxyz0123456789_-", c) {
+			return "", errors.New("room names may only contain letters, digits, '_' and '-'")
+		}
+	}
+	/* Rooms shared by other servers are named room@server */
+	if federated {
+		if _, err := serverName(server); err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+/* Deliver a message to every session of an account on any node, the caller must hold clientsMux */
+func sendToAccount(account *Account, msg Message) {
+	for _, session := range account.Sessions {
+		sendMessage(session, msg)
+	}
+	publishCluster(ClusterEvent{Kind: "account", Account: account.Name, Msg: &msg})
+}
+
+/* Deliver a message to an account whether or not it has sessions on this node, the caller must hold clientsMux */
+func sendToAccountName(name string, msg Message) {
+	if account := onlineAccounts[name]; account != nil {
+		sendToAccount(account, msg)
+		return
+	}
+	publishCluster(ClusterEvent{Kind: "account", Account: name, Msg: &msg})
+}
+
+func roomNotice(client *Client, text string) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	sendMessage(client, Message{Type: "system", Content: text})
+}
+
+func createRoom(client *Client, name string, encrypted bool) {
+	name, err := roomName(name)
+	if err != nil {
+		roomNotice(client, err.Error())
+		return
+	}
+	if strings.Contains(name, "@") {
+		roomNotice(client, "Rooms of other servers are shared by their admins, use /join "+name+" once it is shared.")
+		return
+	}
+	if err := pluginsJoin(client, name); err != nil {
+		roomNotice(client, err.Error())
+		return
+	}
+
+	clientsMux.Lock()
+	if err := checkPermission(client, "create", nil); err != nil {
+		clientsMux.Unlock()
+		roomNotice(client, err.Error())
+		return
+	}
+	if _, exists := rooms[name]; exists {
+		clientsMux.Unlock()
+		roomNotice(client, "Room #"+name+" already exists, use /join "+name+".")
+		return
+	}
+	room := &Room{
+		Name:      name,
+		Encrypted: encrypted,
+		Creator:   client.Account.Name,
+		Created:   time.Now().Unix(),
+		Members:   map[string]bool{client.Account.Name: true},
+	}
+	rooms[name] = room
+	roomChanged(room)
+	sendToAccount(client.Account, roomJoinedMessage(room, "You created #"+name))
+	clientsMux.Unlock()
+
+	client.logger().Info("Created room", "room", name, "encrypted", encrypted)
+}
+
+func roomJoinedMessage(room *Room, text string) Message {
+	if room.Encrypted {
+		text += " (end-to-end encrypted)"
+	}
+	return Message{Type: "room_joined", Room: room.Name, Encrypted: room.Encrypted, Content: text + "."}
+}
+
+/* Join a room, key is the password or an invite code of a room that is not open to everyone */
+func joinRoom(client *Client, name string, key string) {
+	name, err := roomName(name)
+	if err != nil {
+		roomNotice(client, err.Error())
+		return
+	}
+	if err := pluginsJoin(client, name); err != nil {
+		roomNotice(client, err.Error())
+		return
+	}
+
+	/* The password hash is slow on purpose, so it is checked before taking the lock */
+	var passwordOK bool
+	if key != "" {
+		clientsMux.Lock()
+		blocked := joinBlocked(client.IP, name)
+		var hash string
+		if room := rooms[name]; room != nil && room.Visibility == "password" {
+			hash = room.Password
+		}
+		clientsMux.Unlock()
+		if blocked {
+			roomNotice(client, "Too many wrong passwords or invite codes for #"+name+", try again later.")
+			return
+		}
+		passwordOK = hash != "" && checkRoomPassword(hash, key)
+	}
+
+	clientsMux.Lock()
+	room, exists := rooms[name]
+	if !exists {
+		clientsMux.Unlock()
+		roomNotice(client, "No such room: #"+name+", use /create "+name+" to create it.")
+		return
+	}
+	if room.Members[client.Account.Name] {
+		clientsMux.Unlock()
+		roomNotice(client, "You are already a member of #"+name+".")
+		return
+	}
+	if err := checkPermission(client, "join", room); err != nil {
+		clientsMux.Unlock()
+		roomNotice(client, err.Error())
+		return
+	}
+	/* Moderators get into every room */
+	if room.Visibility == "invite" || room.Visibility == "password" {
+		staff := roleRank(roomRole(room, client.Account.Name)) >= roleRank(permissions["invite"].Role)
+		if !staff && !admitToRoom(room, client.Account.Name, key, passwordOK) {
+			switch {
+			case room.Visibility == "invite" && key == "":
+				requestToJoin(client, room)
+			case key == "":
+				sendMessage(client, Message{Type: "system", Content: "#" + name + " is password protected: /join " + name + " <password>"})
+			default:
+				joinFailures[client.IP+" "+name] = append(joinFailures[client.IP+" "+name], time.Now())
+				sendMessage(client, Message{Type: "system", Content: "Wrong password or invite code for #" + name + "."})
+			}
+			clientsMux.Unlock()
+			return
+		}
+	}
+	delete(room.Requests, client.Account.Name)
+	room.Members[client.Account.Name] = true
+	roomChanged(room)
+	federateMembership(room, client.Username, true)
+	sendToAccount(client.Account, roomJoinedMessage(room, "You joined #"+name))
+	if room.Topic != "" || room.Description != "" {
+		sendToAccount(client.Account, roomTopicMessage(room))
+	}
+	clientsMux.Unlock()
+
+	broadcast(Message{
+		Type:      "room_join",
+		UID:       client.UID,
+		User:      client.Username,
+		IP:        client.IP,
+		Room:      name,
+		Encrypted: room.Encrypted,
+		Content:   client.Username + " joined #" + name,
+	}, client.UID)
+}
+
+func leaveRoom(client *Client, name string) {
+	name, err := roomName(name)
+	if err != nil {
+		roomNotice(client, err.Error())
+		return
+	}
+
+	clientsMux.Lock()
+	room, exists := rooms[name]
+	if !exists || !room.Members[client.Account.Name] {
+		clientsMux.Unlock()
+		roomNotice(client, "You are not a member of #"+name+".")
+		return
+	}
+	delete(room.Members, client.Account.Name)
+	roomChanged(room)
+	federateMembership(room, client.Username, false)
+	sendToAccount(client.Account, Message{Type: "room_left", Room: name, Encrypted: room.Encrypted, Content: "You left #" + name + "."})
+	clientsMux.Unlock()
+	pluginsLeave(client, name)
+
+	/* Members of encrypted rooms rotate their sender keys when they see this */
+	broadcast(Message{
+		Type:      "room_leave",
+		UID:       client.UID,
+		User:      client.Username,
+		IP:        client.IP,
+		Room:      name,
+		Encrypted: room.Encrypted,
+		Content:   client.Username + " left #" + name,
+	}, client.UID)
+}
+
+func listRooms(client *Client) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	/* Rooms that are not public are only listed to their members */
+	names := make([]string, 0, len(rooms))
+	for name, room := range rooms {
+		if roomVisible(room, client.Account.Name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		sendMessage(client, Message{Type: "system", Content: "There are no rooms yet, use /create <room> [e2e] to create one."})
+		return
+	}
+	sendMessage(client, Message{Type: "system", Content: fmt.Sprintf("Rooms (%d):", len(names))})
+	for _, name := range names {
+		room := rooms[name]
+		line := fmt.Sprintf("  #%s  %d members", name, len(room.Members))
+		if room.Encrypted {
+			line += "  🔒 end-to-end encrypted"
+		}
+		if room.Home != "" {
+			line += "  🌐 shared by " + room.Home
+		} else if len(room.Shared) > 0 {
+			line += "  🌐 shared with " + strings.Join(room.Shared, ", ")
+		}
+		if room.Visibility != "" {
+			line += "  " + visibilityLabels[room.Visibility]
+		}
+		if room.Members[client.Account.Name] {
+			line += "  (joined)"
+		}
+		if room.Topic != "" {
+			line += "\n      " + room.Topic
+		}
+		sendMessage(client, Message{Type: "system", Content: line})
+	}
+}
+
+/* Describe a room's topic, description and creation, the caller must hold clientsMux */
+func roomTopicMessage(room *Room) Message {
+	lines := []string{"#" + room.Name + ": " + room.Topic}
+	if room.Topic == "" {
+		lines[0] = "#" + room.Name + " has no topic."
+	} else if room.TopicBy != "" {
+		lines = append(lines, fmt.Sprintf("  Set by %s on %s", room.TopicBy, time.UnixMilli(room.TopicTime).Format("2006-01-02 15:04")))
+	}
+	if room.Description != "" {
+		lines = append(lines, "  "+room.Description)
+	}
+	created := fmt.Sprintf("  Created by %s on %s, %d members", room.Creator, time.Unix(room.Created, 0).Format("2006-01-02"), len(room.Members))
+	if room.Visibility != "" {
+		created += ", " + visibilityLabels[room.Visibility]
+	}
+	if room.TopicLock {
+		created += ", only moderators may change the topic"
+	}
+	lines = append(lines, created)
+	return Message{Type: "room_topic", Room: room.Name, User: room.TopicBy, Time: room.TopicTime, Content: strings.Join(lines, "\n")}
+}
+
+/* Members may change the topic of a room unless it was locked for moderators, the caller must hold clientsMux */
+func canChangeTopic(client *Client, room *Room) error {
+	switch {
+	case !room.Members[client.Account.Name]:
+		return errors.New("You are not a member of #" + room.Name + ".")
+	case room.Home != "":
+		return errors.New("The topic of #" + room.Name + " is set on " + room.Home + ".")
+	}
+	return checkPermission(client, "topic", room)
+}
+
+/*
+ * Show the topic of a room without text, or set its topic or description.
+ * "-" clears it. Topic changes are announced to the members with a topic_change.
+ */
+func roomTopic(client *Client, name string, text string, description bool) {
+	name, err := roomName(name)
+	if err != nil {
+		roomNotice(client, err.Error())
+		return
+	}
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) > maxTopicLength {
+		roomNotice(client, fmt.Sprintf("Topics and descriptions may be at most %d characters long.", maxTopicLength))
+		return
+	}
+
+	clientsMux.Lock()
+	room, exists := rooms[name]
+	if !exists || !roomVisible(room, client.Account.Name) {
+		clientsMux.Unlock()
+		roomNotice(client, "No such room: #"+name+".")
+		return
+	}
+	if text == "" {
+		sendMessage(client, roomTopicMessage(room))
+		clientsMux.Unlock()
+		return
+	}
+	if err := canChangeTopic(client, room); err != nil {
+		clientsMux.Unlock()
+		roomNotice(client, err.Error())
+		return
+	}
+	if text == "-" {
+		text = ""
+	}
+	if description {
+		room.Description = text
+		roomChanged(room)
+		sendToAccount(client.Account, Message{Type: "system", Content: "The description of #" + name + " was updated."})
+		clientsMux.Unlock()
+		return
+	}
+	room.Topic = text
+	room.TopicBy = client.Username
+	room.TopicTime = time.Now().UnixMilli()
+	roomChanged(room)
+	clientsMux.Unlock()
+
+	client.logger().Info("Changed room topic", "room", name)
+	broadcast(Message{
+		Type:    "topic_change",
+		UID:     client.UID,
+		User:    client.Username,
+		IP:      client.IP,
+		Room:    name,
+		Content: text,
+		Time:    room.TopicTime,
+	}, "")
+}
+
+/* Let only moderators change the topic and description of a room */
+func lockRoomTopic(client *Client, name string, locked bool) {
+	name, err := roomName(name)
+	if err != nil {
+		roomNotice(client, err.Error())
+		return
+	}
+
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	room, exists := rooms[name]
+	if !exists {
+		sendMessage(client, Message{Type: "system", Content: "No such room: #" + name + "."})
+		return
+	}
+	if err := checkPermission(client, "topic_lock", room); err != nil {
+		sendMessage(client, Message{Type: "system", Content: err.Error()})
+		return
+	}
+	room.TopicLock = locked
+	roomChanged(room)
+	if locked {
+		sendMessage(client, Message{Type: "system", Content: "Only moderators may change the topic of #" + name + " now."})
+	} else {
+		sendMessage(client, Message{Type: "system", Content: "Every member may change the topic of #" + name + " now."})
+	}
+}
+
+/* How rooms that are not public are marked in listings */
+var visibilityLabels = map[string]string{
+	"unlisted": "unlisted",
+	"invite":   "invite only",
+	"password": "password protected",
+}
+
+/* Public rooms are listed to everyone, the others only to their members. The caller must hold clientsMux */
+func roomVisible(room *Room, account string) bool {
+	return room.Visibility == "" || room.Members[account]
+}
+
+/*
+ * Room passwords are stored as PBKDF2-HMAC-SHA256 hashes, "pbkdf2-sha256$iterations$salt$hash"
+ * with the salt and hash in hex. Guessing over the network is limited by joinFailures.
+ */
+const (
+	roomPasswordIterations = 100000
+	maxJoinFailures        = 5
+	joinFailureWindow      = 10 * time.Minute
+)
+
+var joinFailures = make(map[string][]time.Time) // Wrong room passwords and invite codes by IP and room, guarded by clientsMux
+
+/* PBKDF2 with a single block, SHA-256 output is as long as the derived key */
+func pbkdf2SHA256(password string, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := slices.Clone(u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+/* Slow on purpose, call it without holding clientsMux */
+func hashRoomPassword(password string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key := pbkdf2SHA256(password, salt, roomPasswordIterations)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%x$%x", roomPasswordIterations, salt, key)
+}
+
+/* Slow on purpose, call it without holding clientsMux */
+func checkRoomPassword(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	salt, saltErr := hex.DecodeString(parts[2])
+	if err != nil || saltErr != nil || iterations < 1 {
+		return false
+	}
+	key := pbkdf2SHA256(password, salt, iterations)
+	return hmac.Equal([]byte(hex.EncodeToString(key)), []byte(parts[3]))
+}
+
+/* Whether an address used up its attempts at the keys of a room, the caller must hold clientsMux */
+func joinBlocked(ip string, room string) bool {
+	key := ip + " " + room
+	cutoff := time.Now().Add(-joinFailureWindow)
+	joinFailures[key] = slices.DeleteFunc(joinFailures[key], func(failed time.Time) bool { return failed.Before(cutoff) })
+	if len(joinFailures[key]) == 0 {
+		delete(joinFailures, key)
+		return false
+	}
+	return len(joinFailures[key]) >= maxJoinFailures
+}
+
+/* Drop expired invitations and used up invite links, the caller must hold clientsMux */
+func pruneInvites(room *Room) {
+	now := time.Now().UnixMilli()
+	maps.DeleteFunc(room.Invited, func(_ string, expires int64) bool { return expires <= now })
+	room.Invites = slices.DeleteFunc(room.Invites, func(invite *Invite) bool {
+		return (invite.Expires != 0 && invite.Expires <= now) || (invite.MaxUses != 0 && invite.Uses >= invite.MaxUses)
+	})
+}
+
+/*
+ * Let an account into a room that is not open to everyone with an invitation,
+ * an invite code or the room password, using up what it was let in with.
+ * passwordOK tells whether key is the room password. The caller must hold clientsMux.
+ */
+func admitToRoom(room *Room, account string, key string, passwordOK bool) bool {
+	pruneInvites(room)
+	if _, invited := room.Invited[account]; invited {
+		delete(room.Invited, account)
+		return true
+	}
+	if key == "" {
+		return false
+	}
+	for _, invite := range room.Invites {
+		if hmac.Equal([]byte(invite.Code), []byte(key)) {
+			invite.Uses++
+			return true
+		}
+	}
+	return room.Visibility == "password" && passwordOK
+}
+
+/* Ask the moderators of an invite-only room to let an account in, the caller must hold clientsMux */
+func requestToJoin(client *Client, room *Room) {
+	if room.Requests == nil {
+		room.Requests = make(map[string]int64)
+	}
+	room.Requests[client.Account.Name] = time.Now().UnixMilli()
+	roomChanged(room)
+
+	request := Message{
+		Type:    "join_request",
+		User:    client.Username,
+		IP:      client.IP,
+		Room:    room.Name,
+		Content: fmt.Sprintf("%s asks to join #%s, /approve %s %s or /deny %s %s.", client.Username, room.Name, room.Name, client.Account.Name, room.Name, client.Account.Name),
+	}
+	for member := range room.Members {
+		if roleRank(roomRole(room, member)) >= roleRank(permissions["invite"].Role) {
+			sendToAccountName(member, request)
+		}
+	}
+	sendMessage(client, Message{Type: "system", Content: "#" + room.Name + " is invite only, its moderators were asked to let you in."})
+}
+
+/*
+ * Make a room public, unlisted (joinable by name), invite only (joinable with
+ * an invitation, an invite link or the approval of a moderator) or password
+ * protected (joinable with the password, an invitation or an invite link).
+ */
+func setRoomVisibility(client *Client, name string, visibility string, password string) {
+	name, err := roomName(name)
+	if err != nil {
+		roomNotice(client, err.Error())
+		return
+	}
+	if visibility == "public" {
+		visibility = ""
+	} else if _, known := visibilityLabels[visibility]; !known {
+		roomNotice(client, "Rooms are public, unlisted, invite or password.")
+		return
+	}
+	if visibility == "password" && password == "" {
+		roomNotice(client, "Password protected rooms need a password: /visibility "+name+" password <password>")
+		return
+	}
+
+	managed := func() (*Room, error) {
+		room := rooms[name]
+		switch {
+		case room == nil:
+			return nil, errors.New("No such room: #" + name + ".")
+		case room.Home != "":
+			return nil, errors.New("The visibility of #" + name + " is set on " + room.Home + ".")
+		}
+		return room, checkPermission(client, "visibility", room)
+	}
+
+	/* Hashing is slow, only do it for moderators and without holding clientsMux */
+	var hash string
+	if visibility == "password" {
+		clientsMux.Lock()
+		_, err = managed()
+		clientsMux.Unlock()
+		if err != nil {
+			roomNotice(client, err.Error())
+			return
+		}
+		hash = hashRoomPassword(password)
+	}
+
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	room, err := managed()
+	if err != nil {
+		sendMessage(client, Message{Type: "system", Content: err.Error()})
+		return
+	}
+
+	room.Visibility = visibility
+	room.Password = hash
+	if visibility != "invite" {
+		room.Requests = nil
+	}
+	roomChanged(room)
+	client.logger().Info("Changed room visibility", "room", name, "visibility", visibility)
+
+	if visibility == "" {
+		sendMessage(client, Message{Type: "system", Content: "#" + name + " is public now."})
+	} else {
+		sendMessage(client, Message{Type: "system", Content: "#" + name + " is " + visibilityLabels[visibility] + " now."})
+	}
+}
+
+/* Look up a room the client may manage invitations of, the caller must hold clientsMux */
+func inviteRoom(client *Client, name string) (*Room, error) {
+	name, err := roomName(name)
+	if err != nil {
+		return nil, err
+	}
+	room := rooms[name]
+	if room == nil || !roomVisible(room, client.Account.Name) {
+		return nil, errors.New("No such room: #" + name + ".")
+	}
+	/* Anyone may be pointed to a public or unlisted room by its members */
+	if room.Visibility == "" || room.Visibility == "unlisted" {
+		if !room.Members[client.Account.Name] {
+			return nil, errors.New("You are not a member of #" + name + ".")
+		}
+		return room, nil
+	}
+	return room, checkPermission(client, "invite", room)
+}
+
+/* Invite an account to a room, the invitation lets it join once within inviteTTL */
+func inviteUser(client *Client, target string, name string) {
+	target = accountKey(strings.TrimPrefix(target, "@"))
+
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	room, err := inviteRoom(client, name)
+	if err == nil && room.Members[target] {
+		err = errors.New(target + " is already a member of #" + room.Name + ".")
+	}
+	if err == nil && !isKnownAccount(target) {
+		err = errors.New("No such user: " + target)
+	}
+	if err != nil {
+		sendMessage(client, Message{Type: "system", Content: err.Error()})
+		return
+	}
+
+	if room.Visibility != "" && room.Visibility != "unlisted" {
+		if room.Invited == nil {
+			room.Invited = make(map[string]int64)
+		}
+		room.Invited[target] = time.Now().Add(inviteTTL).UnixMilli()
+		delete(room.Requests, target)
+		roomChanged(room)
+	}
+	client.logger().Info("Invited user", "account", target, "room", room.Name)
+
+	sendToAccountName(target, Message{
+		Type:    "invite",
+		User:    client.Username,
+		IP:      client.IP,
+		Room:    room.Name,
+		Content: fmt.Sprintf("%s invited you to #%s, /join %s to accept.", client.Username, room.Name, room.Name),
+		Time:    time.Now().UnixMilli(),
+	})
+	sendMessage(client, Message{Type: "system", Content: "Invited " + target + " to #" + room.Name + "."})
+}
+
+/* Create an invite link that expires after ttl (never when 0) and can be used uses times (without limit when 0) */
+func createInviteLink(client *Client, name string, ttl time.Duration, uses int) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	room, err := inviteRoom(client, name)
+	if err != nil {
+		sendMessage(client, Message{Type: "system", Content: err.Error()})
+		return
+	}
+
+	code := make([]byte, 12)
+	rand.Read(code)
+	invite := &Invite{
+		Code:    base64.RawURLEncoding.EncodeToString(code),
+		Creator: client.Account.Name,
+		Created: time.Now().UnixMilli(),
+		MaxUses: uses,
+	}
+	if ttl > 0 {
+		invite.Expires = time.Now().Add(ttl).UnixMilli()
+	}
+	pruneInvites(room)
+	room.Invites = append(room.Invites, invite)
+	roomChanged(room)
+	client.logger().Info("Created invite link", "room", room.Name, "expires", invite.Expires, "uses", uses)
+
+	sendMessage(client, Message{Type: "system", Content: fmt.Sprintf("Invite to #%s (%s): /join %s %s or /?room=%s&invite=%s on the web client",
+		room.Name, describeInvite(invite), room.Name, invite.Code, room.Name, invite.Code)})
+}
+
+func describeInvite(invite *Invite) string {
+	limits := "never expires"
+	if invite.Expires != 0 {
+		limits = "expires " + time.UnixMilli(invite.Expires).Format("2006-01-02 15:04")
+	}
+	if invite.MaxUses != 0 {
+		limits += fmt.Sprintf(", used %d of %d times", invite.Uses, invite.MaxUses)
+	} else {
+		limits += fmt.Sprintf(", used %d times", invite.Uses)
+	}
+	return limits
+}
+
+/* Parse the optional expiry and usage limit of /invitelink, by default links expire after inviteTTL */
+func handleInviteLinkCommand(client *Client, room string, args []string) {
+	ttl, uses := inviteTTL, 0
+	var err error
+	if len(args) > 0 {
+		if ttl, err = time.ParseDuration(args[0]); err != nil || ttl < 0 {
+			roomNotice(client, "Invalid expiry "+args[0]+", use e.g. 24h, or 0 for links that never expire.")
+			return
+		}
+	}
+	if len(args) > 1 {
+		if uses, err = strconv.Atoi(args[1]); err != nil || uses < 0 {
+			roomNotice(client, "Invalid number of uses "+args[1]+", use 0 for links without a limit.")
+			return
+		}
+	}
+	createInviteLink(client, room, ttl, uses)
+}
+
+/* List the invite links, pending invitations and join requests of a room */
+func listInvites(client *Client, name string) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	room, err := inviteRoom(client, name)
+	if err != nil {
+		sendMessage(client, Message{Type: "system", Content: err.Error()})
+		return
+	}
+	pruneInvites(room)
+
+	lines := []string{"Invites of #" + room.Name + ":"}
+	for _, invite := range room.Invites {
+		lines = append(lines, fmt.Sprintf("  %s by %s, %s", invite.Code, invite.Creator, describeInvite(invite)))
+	}
+	var invited, requests []string
+	for account, expires := range room.Invited {
+		invited = append(invited, fmt.Sprintf("  %s is invited until %s", account, time.UnixMilli(expires).Format("2006-01-02 15:04")))
+	}
+	for account, asked := range room.Requests {
+		requests = append(requests, fmt.Sprintf("  %s asked to join on %s", account, time.UnixMilli(asked).Format("2006-01-02 15:04")))
+	}
+	sort.Strings(invited)
+	sort.Strings(requests)
+	lines = append(append(lines, invited...), requests...)
+	if len(lines) == 1 {
+		lines[0] = "#" + room.Name + " has no invites or join requests."
+	}
+	sendMessage(client, Message{Type: "system", Content: strings.Join(lines, "\n")})
+}
+
+/* Revoke an invite link by its code or the invitation of an account */
+func revokeInvite(client *Client, name string, what string) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	room, err := inviteRoom(client, name)
+	if err != nil {
+		sendMessage(client, Message{Type: "system", Content: err.Error()})
+		return
+	}
+
+	count := len(room.Invites) + len(room.Invited)
+	room.Invites = slices.DeleteFunc(room.Invites, func(invite *Invite) bool { return invite.Code == what })
+	delete(room.Invited, accountKey(what))
+	if count == len(room.Invites)+len(room.Invited) {
+		sendMessage(client, Message{Type: "system", Content: "No such invite: " + what})
+		return
+	}
+	roomChanged(room)
+	sendMessage(client, Message{Type: "system", Content: "Revoked the invite " + what + " to #" + room.Name + "."})
+}
+
+/* Let an account that asked to join an invite-only room in, or turn it down */
+func answerJoinRequest(client *Client, name string, target string, approve bool) {
+	target = accountKey(strings.TrimPrefix(target, "@"))
+
+	clientsMux.Lock()
+	room, err := inviteRoom(client, name)
+	if err == nil {
+		if _, asked := room.Requests[target]; !asked {
+			err = errors.New(target + " has not asked to join #" + room.Name + ", use /invite " + target + " " + room.Name + ".")
+		}
+	}
+	if err != nil {
+		clientsMux.Unlock()
+		roomNotice(client, err.Error())
+		return
+	}
+
+	delete(room.Requests, target)
+	if !approve {
+		roomChanged(room)
+		sendToAccountName(target, Message{Type: "system", Content: "Your request to join #" + room.Name + " was turned down."})
+		sendMessage(client, Message{Type: "system", Content: "Turned down " + target + "'s request to join #" + room.Name + "."})
+		clientsMux.Unlock()
+		return
+	}
+
+	/*
+	 * An approval is an invitation, the target joins through joinRoom so the plugins
+	 * and its own join permission apply. A session on this node joins right away.
+	 */
+	if room.Invited == nil {
+		room.Invited = make(map[string]int64)
+	}
+	room.Invited[target] = time.Now().Add(inviteTTL).UnixMilli()
+	roomChanged(room)
+	var session *Client
+	if account, online := onlineAccounts[target]; online {
+		for _, s := range account.Sessions {
+			session = s
+			break
+		}
+	}
+	if session == nil {
+		sendToAccountName(target, Message{
+			Type:    "invite",
+			User:    client.Username,
+			IP:      client.IP,
+			Room:    room.Name,
+			Content: fmt.Sprintf("%s let you into #%s, /join %s to enter.", client.Username, room.Name, room.Name),
+			Time:    time.Now().UnixMilli(),
+		})
+	}
+	sendMessage(client, Message{Type: "system", Content: "Approved " + target + "'s request to join #" + room.Name + "."})
+	clientsMux.Unlock()
+
+	client.logger().Info("Approved join request", "account", target, "room", room.Name)
+	if session != nil {
+		joinRoom(session, room.Name, "")
+	}
+}
+
+/*
+ * Tell a new session which rooms its account belongs to. The other members of
+ * encrypted rooms are told a new device came online, so they hand it their sender keys.
+ */
+func sendRoomMemberships(client *Client) {
+	clientsMux.Lock()
+	var encrypted []string
+	for _, room := range rooms {
+		if room.Members[client.Account.Name] {
+			sendMessage(client, roomJoinedMessage(room, "You are a member of #"+room.Name))
+			if room.Encrypted {
+				encrypted = append(encrypted, room.Name)
+			}
+		}
+	}
+	clientsMux.Unlock()
+
+	for _, name := range encrypted {
+		broadcast(Message{Type: "room_online", UID: client.UID, User: client.Username, IP: client.IP, Room: name, Encrypted: true}, client.UID)
+	}
+}
+
+/* Check that a client may post to a room, with or without end-to-end encryption */
+func checkRoomPost(client *Client, name string, encrypted bool) bool {
+	clientsMux.Lock()
+	room, exists := rooms[name]
+	member := exists && room.Members[client.Account.Name]
+	var denied error
+	if member {
+		denied = checkPermission(client, "send", room)
+	}
+	clientsMux.Unlock()
+
+	switch {
+	case !member:
+		roomNotice(client, "You are not a member of #"+name+".")
+	case denied != nil:
+		roomNotice(client, denied.Error())
+	case room.Encrypted && !encrypted:
+		roomNotice(client, "#"+name+" is end-to-end encrypted, plaintext messages are not accepted.")
+	case !room.Encrypted && encrypted:
+		roomNotice(client, "#"+name+" is not end-to-end encrypted.")
+	default:
+		return true
+	}
+	return false
+}
+
+/* Check that a client may post to the main chat, guests may only read it */
+func checkMainPost(client *Client) bool {
+	clientsMux.Lock()
+	err := checkPermission(client, "send", nil)
+	clientsMux.Unlock()
+
+	if err != nil {
+		roomNotice(client, err.Error())
+		return false
+	}
+	return true
+}
+
+/* Relay ciphertext to an encrypted room, the server only sees the routing metadata */
+func relayRoomE2E(client *Client, name string, e2e json.RawMessage) {
+	name, err := roomName(name)
+	if err != nil || len(e2e) == 0 || !checkRoomPost(client, name, true) {
+		return
+	}
+
+	msg := Message{
+		Type:      "chat",
+		UID:       client.UID,
+		User:      client.Username,
+		IP:        client.IP,
+		Role:      messageRole(client, name),
+		Room:      name,
+		Encrypted: true,
+		E2E:       e2e,
+		Time:      time.Now().UnixMilli(),
+	}
+	if err := filterMessage(client, &msg); err != nil {
+		rejectNotice(client, err)
+		return
+	}
+
+	client.logger().Info("Chat message", "room", name, "encrypted", true)
+	broadcast(msg, client.UID)
+}
+
+/*
+ * Reply with the identity keys of the room members that are online, for sender
+ * key distribution. Room messages are not stored, so offline members get a fresh
+ * key when they come back.
+ */
+func sendRoomKeys(client *Client, name string) {
+	name, err := roomName(name)
+	if err != nil {
+		return
+	}
+
+	clientsMux.Lock()
+	room, exists := rooms[name]
+	var members []string
+	if exists && room.Members[client.Account.Name] {
+		for member := range room.Members {
+			if onlineAccounts[member] != nil || remoteOnline(member) {
+				members = append(members, member)
+			}
+		}
+	}
+	clientsMux.Unlock()
+
+	reply := Message{Type: "keys", Room: name, RoomKeys: make(map[string][]DeviceKey)}
+	keysMux.Lock()
+	for _, member := range members {
+		reply.RoomKeys[member] = append([]DeviceKey(nil), deviceKeys[member]...)
+	}
+	keysMux.Unlock()
+
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	sendMessage(client, reply)
+}
+
+/*
+ * TCP clients manage rooms with these commands:
+ *   /create <room> [e2e]
+ *   /join <room> [<password or invite code>]
+ *   /leave <room>
+ *   /rooms
+ *   /topic <room> [<text>|-]
+ *   /description <room> <text>|-
+ *   /topiclock <room> on|off
+ *   /visibility <room> public|unlisted|invite|password [<password>]
+ *   /invite <user> <room>
+ *   /invitelink <room> [<expiry>|0] [<max uses>]
+ *   /invites <room>
+ *   /uninvite <room> <user or code>
+ *   /approve <room> <user>
+ *   /deny <room> <user>
+ *   #<room> <text>
+ *   KEY ROOM <room>
+ */
+func handleTCPRoomCommand(client *Client, line string) {
+	args := strings.Fields(line)
+	switch {
+	case strings.HasPrefix(line, "#"):
+		room, content, _ := strings.Cut(strings.TrimPrefix(line, "#"), " ")
+		handleChat(client, room, strings.TrimSpace(content))
+	case args[0] == "/create" && len(args) > 1:
+		createRoom(client, args[1], len(args) > 2 && args[2] == "e2e")
+	case args[0] == "/join" && len(args) > 1:
+		joinRoom(client, args[1], strings.Join(args[2:], " "))
+	case args[0] == "/leave" && len(args) > 1:
+		leaveRoom(client, args[1])
+	case args[0] == "/rooms":
+		listRooms(client)
+	case (args[0] == "/topic" || args[0] == "/description") && len(args) > 1:
+		roomTopic(client, args[1], strings.Join(args[2:], " "), args[0] == "/description")
+	case args[0] == "/topiclock" && len(args) > 2:
+		lockRoomTopic(client, args[1], args[2] == "on")
+	case args[0] == "/visibility" && len(args) > 2:
+		setRoomVisibility(client, args[1], args[2], strings.Join(args[3:], " "))
+	case args[0] == "/invite" && len(args) > 2:
+		inviteUser(client, args[1], args[2])
+	case args[0] == "/invitelink" && len(args) > 1:
+		handleInviteLinkCommand(client, args[1], args[2:])
+	case args[0] == "/invites" && len(args) > 1:
+		listInvites(client, args[1])
+	case args[0] == "/uninvite" && len(args) > 2:
+		revokeInvite(client, args[1], args[2])
+	case (args[0] == "/approve" || args[0] == "/deny") && len(args) > 2:
+		answerJoinRequest(client, args[1], args[2], args[0] == "/approve")
+	case args[0] == "KEY" && len(args) > 2:
+		sendRoomKeys(client, args[2])
+	}
+}
+
+func isRoomCommand(line string) bool {
+	command, _, _ := strings.Cut(line, " ")
+	switch command {
+	case "/create", "/join", "/leave", "/rooms", "/topic", "/description", "/topiclock",
+		"/visibility", "/invite", "/invitelink", "/invites", "/uninvite", "/approve", "/deny":
+		return true
+	}
+	return false
+}
+
+/* Roles from the least to the most privileged */
+var roleNames = []string{"guest", "member", "moderator", "admin", "owner"}
+
+/*
+ * The least privileged role that may take each action, and how the action is
+ * described server-wide and in a room (%s is the room name).
+ */
+var permissions = map[string]struct{ Role, Server, Room string }{
+	"create":      {"member", "create rooms", ""},
+	"join":        {"member", "", "join #%s"},
+	"send":        {"member", "post in the main chat", "post in #%s"},
+	"topic":       {"member", "", "change the topic of #%s"},
+	"topic_lock":  {"moderator", "", "lock the topic of #%s"},
+	"kick":        {"moderator", "kick users", "kick users from #%s"},
+	"delete_room": {"admin", "", "delete #%s"},
+	"grant":       {"admin", "grant roles", "grant roles in #%s"},
+	"invite":      {"moderator", "", "invite users to #%s"},
+	"visibility":  {"admin", "", "change the visibility of #%s"},
+}
+
+func roleRank(role string) int {
+	return slices.Index(roleNames, role)
+}
+
+/* "an admin", "a moderator" */
+func withArticle(role string) string {
+	if strings.ContainsRune("aeiou", rune(role[0])) {
+		return "an " + role
+	}
+	return "a " + role
+}
+
+func rolesPath() string {
+	return filepath.Join(*dataDir, "roles.json")
+}
+
+func initRoles() error {
+	if _, err := roleName(*defaultRole); err != nil || *defaultRole == "owner" || *defaultRole == "admin" {
+		return fmt.Errorf("invalid -default-role %q", *defaultRole)
+	}
+	data, err := os.ReadFile(rolesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	/* The file's modification time is when the roles last changed, see saveRoles */
+	if stat, err := os.Stat(rolesPath()); err == nil {
+		rolesUpdated = stat.ModTime().UnixMilli()
+	}
+	return json.Unmarshal(data, &serverRoles)
+}
+
+/* Persist the server roles, the caller must hold clientsMux */
+func saveRoles() {
+	data, _ := json.Marshal(serverRoles)
+	if err := os.WriteFile(rolesPath(), data, 0644); err != nil {
+		slog.Error("Failed to save roles", "error", err)
+		return
+	}
+	updated := time.UnixMilli(rolesUpdated)
+	os.Chtimes(rolesPath(), updated, updated)
+}
+
+/* Save the server roles and hand them to the other cluster nodes, the caller must hold clientsMux */
+func rolesChanged() {
+	rolesUpdated = time.Now().UnixMilli()
+	saveRoles()
+	publishCluster(ClusterEvent{Kind: "roles", Roles: maps.Clone(serverRoles), Updated: rolesUpdated})
+}
+
+/*
+ * Replace the server roles with another node's when they changed later than ours,
+ * merging would bring back roles that were taken away. The caller must hold clientsMux.
+ */
+func mergeRoles(roles map[string]string, updated int64) {
+	if updated <= rolesUpdated {
+		return
+	}
+	serverRoles, rolesUpdated = roles, updated
+	if serverRoles == nil {
+		serverRoles = make(map[string]string)
+	}
+	saveRoles()
+}
+
+func roleName(role string) (string, error) {
+	role = strings.ToLower(strings.TrimSpace(role))
+	if roleRank(role) < 0 {
+		return "", errors.New("roles are " + strings.Join(roleNames, ", "))
+	}
+	return role, nil
+}
+
+const roleTokenNotice = "This account holds a role, log in with its session token."
+
+/*
+ * Whether an account holds a role above the default or created a room. Anyone can
+ * log in with a nickname nobody uses, so these accounts have to use a session token.
+ */
+func needsToken(account string) bool {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	if roleRank(serverRoles[account]) > roleRank(*defaultRole) {
+		return true
+	}
+	for _, room := range rooms {
+		if room.Creator == account || roleRank(room.Roles[account]) > roleRank("member") {
+			return true
+		}
+	}
+	return false
+}
+
+/* Role of an account on the whole server, the caller must hold clientsMux */
+func serverRole(account string) string {
+	if role, exists := serverRoles[account]; exists {
+		return role
+	}
+	return *defaultRole
+}
+
+/*
+ * Role of an account in a room, the caller must hold clientsMux. The creator owns
+ * a room unless given another role. A room role replaces the server role, except
+ * that moderators and above of the server keep their powers in every room.
+ */
+func roomRole(room *Room, account string) string {
+	role := serverRole(account)
+	inRoom, exists := room.Roles[account]
+	if !exists && room.Creator == account {
+		inRoom, exists = "owner", true
+	}
+	if exists && (roleRank(role) < roleRank("moderator") || roleRank(inRoom) > roleRank(role)) {
+		role = inRoom
+	}
+	return role
+}
+
+/*
+ * Check that a client may take an action in a room, or on the server when room
+ * is nil. The caller must hold clientsMux.
+ */
+func checkPermission(client *Client, action string, room *Room) error {
+	perm := permissions[action]
+	if action == "topic" && room != nil && room.TopicLock {
+		perm.Role = permissions["topic_lock"].Role
+	}
+	role, what := serverRole(client.Account.Name), perm.Server
+	if room != nil {
+		role, what = roomRole(room, client.Account.Name), fmt.Sprintf(perm.Room, room.Name)
+	}
+	if roleRank(role) < roleRank(perm.Role) {
+		return fmt.Errorf("You need the %s role to %s.", perm.Role, what)
+	}
+	return nil
+}
+
+/* Role shown next to the sender of a message, members have none */
+func messageRole(client *Client, room string) string {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	role := serverRole(client.Account.Name)
+	if r := rooms[room]; r != nil {
+		role = roomRole(r, client.Account.Name)
+	}
+	if role == "member" {
+		return ""
+	}
+	return role
+}
+
+/*
+ * Give an account a role on the server, or in a room when room is not empty.
+ * An empty role removes the account's role, it falls back to the default.
+ * Only roles below the granting client's own can be handed out or taken away,
+ * except by owners.
+ */
+func grantRole(client *Client, target string, role string, room string) {
+	target = accountKey(strings.TrimPrefix(target, "@"))
+	if role != "" {
+		var err error
+		if role, err = roleName(role); err != nil {
+			roomNotice(client, err.Error())
+			return
+		}
+	}
+	if room != "" {
+		var err error
+		if room, err = roomName(room); err != nil {
+			roomNotice(client, err.Error())
+			return
+		}
+	}
+
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	r := rooms[room]
+	if room != "" && r == nil {
+		sendMessage(client, Message{Type: "system", Content: "No such room: #" + room + "."})
+		return
+	}
+	if err := checkPermission(client, "grant", r); err != nil {
+		sendMessage(client, Message{Type: "system", Content: err.Error()})
+		return
+	}
+	own, current, where := serverRole(client.Account.Name), serverRole(target), "on the server"
+	if r != nil {
+		own, current, where = roomRole(r, client.Account.Name), roomRole(r, target), "in #"+r.Name
+	}
+	if own != "owner" && (roleRank(role) >= roleRank(own) || roleRank(current) >= roleRank(own)) {
+		sendMessage(client, Message{Type: "system", Content: "You can only change the roles of users below " + own + " " + where + "."})
+		return
+	}
+
+	if r != nil {
+		if r.Roles == nil {
+			r.Roles = make(map[string]string)
+		}
+		if role == "" {
+			delete(r.Roles, target)
+		} else {
+			r.Roles[target] = role
+		}
+		roomChanged(r)
+	} else {
+		if role == "" {
+			delete(serverRoles, target)
+		} else {
+			serverRoles[target] = role
+		}
+		rolesChanged()
+	}
+
+	role = serverRole(target)
+	if r != nil {
+		role = roomRole(r, target)
+	}
+	client.logger().Info("Changed role", "account", target, "role", role, "room", room)
+	sendMessage(client, Message{Type: "system", Content: fmt.Sprintf("%s is now %s %s.", target, withArticle(role), where)})
+	notice := Message{Type: "system", Content: fmt.Sprintf("%s made you %s %s.", client.Username, withArticle(role), where)}
+	sendToAccountName(target, notice)
+}
+
+/* List the accounts with a role other than the default on the server or in a room */
+func listRoles(client *Client, room string) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	roles := serverRoles
+	title := fmt.Sprintf("Roles on the server, everyone else is %s:", *defaultRole)
+	if room != "" {
+		name, _ := roomName(room)
+		r := rooms[name]
+		if r == nil || !roomVisible(r, client.Account.Name) {
+			sendMessage(client, Message{Type: "system", Content: "No such room: #" + name + "."})
+			return
+		}
+		roles = maps.Clone(r.Roles)
+		if roles == nil {
+			roles = make(map[string]string)
+		}
+		if _, exists := roles[r.Creator]; !exists {
+			roles[r.Creator] = "owner"
+		}
+		title = "Roles in #" + name + ", the server roles apply to everyone else:"
+	}
+
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{title}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("  %-20s %s", name, roles[name]))
+	}
+	sendMessage(client, Message{Type: "system", Content: strings.Join(lines, "\n")})
+}
+
+/*
+ * Remove a user from a room, or disconnect all their sessions when room is
+ * empty. Moderators can only kick users below their own role.
+ */
+func kickUser(client *Client, target string, room string, reason string) {
+	target = accountKey(strings.TrimPrefix(target, "@"))
+	if room != "" {
+		var err error
+		if room, err = roomName(room); err != nil {
+			roomNotice(client, err.Error())
+			return
+		}
+	}
+
+	clientsMux.Lock()
+	r := rooms[room]
+	if room != "" && r == nil {
+		clientsMux.Unlock()
+		roomNotice(client, "No such room: #"+room+".")
+		return
+	}
+	if err := checkPermission(client, "kick", r); err != nil {
+		clientsMux.Unlock()
+		roomNotice(client, err.Error())
+		return
+	}
+	own, theirs := serverRole(client.Account.Name), serverRole(target)
+	if r != nil {
+		own, theirs = roomRole(r, client.Account.Name), roomRole(r, target)
+	}
+	if roleRank(theirs) >= roleRank(own) {
+		clientsMux.Unlock()
+		roomNotice(client, "You can only kick users below "+own+".")
+		return
+	}
+
+	text := "You were kicked by " + client.Username
+	if r != nil {
+		text = "You were removed from #" + room + " by " + client.Username
+	}
+	if reason != "" {
+		text += ": " + reason
+	}
+
+	if r == nil {
+		account := onlineAccounts[target]
+		if account == nil {
+			clientsMux.Unlock()
+			roomNotice(client, target+" is not online on this node.")
+			return
+		}
+		for _, session := range account.Sessions {
+			disconnect(session, text+".")
+		}
+		clientsMux.Unlock()
+		client.logger().Info("Kicked user", "account", target, "reason", reason)
+		roomNotice(client, "Kicked "+target+".")
+		return
+	}
+
+	if !r.Members[target] {
+		clientsMux.Unlock()
+		roomNotice(client, target+" is not a member of #"+room+".")
+		return
+	}
+	delete(r.Members, target)
+	roomChanged(r)
+	federateMembership(r, target, false)
+	left := Message{Type: "room_left", Room: room, Encrypted: r.Encrypted, Content: text + "."}
+	sendToAccountName(target, left)
+	clientsMux.Unlock()
+
+	client.logger().Info("Kicked user from room", "account", target, "room", room, "reason", reason)
+	/* Members of encrypted rooms rotate their sender keys when they see this */
+	broadcast(Message{
+		Type:      "room_leave",
+		User:      target,
+		Room:      room,
+		Encrypted: r.Encrypted,
+		Content:   target + " was removed from #" + room + " by " + client.Username,
+	}, "")
+}
+
+/* Delete a room for all its members, its history is kept until the retention rules purge it */
+func deleteRoom(client *Client, name string) {
+	name, err := roomName(name)
+	if err != nil {
+		roomNotice(client, err.Error())
+		return
+	}
+
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	room := rooms[name]
+	switch {
+	case room == nil:
+		err = errors.New("No such room: #" + name + ".")
+	case room.Home != "":
+		err = errors.New("#" + name + " is shared by " + room.Home + ", leave it instead.")
+	default:
+		err = checkPermission(client, "delete_room", room)
+	}
+	if err != nil {
+		sendMessage(client, Message{Type: "system", Content: err.Error()})
+		return
+	}
+
+	room.Deleted = true
+	delete(rooms, name)
+	roomChanged(room)
+	client.logger().Info("Deleted room", "room", name)
+
+	left := Message{Type: "room_left", Room: name, Encrypted: room.Encrypted, Content: "#" + name + " was deleted by " + client.Username + "."}
+	for member := range room.Members {
+		sendToAccountName(member, left)
+	}
+	if !room.Members[client.Account.Name] {
+		sendMessage(client, Message{Type: "system", Content: "Deleted #" + name + "."})
+	}
+}
+
+/*
+ * TCP clients manage roles and moderate with these commands:
+ *   /grant <user> <role> [<room>]
+ *   /ungrant <user> [<room>]
+ *   /roles [<room>]
+ *   /kick <user> [#<room>] [<reason>]
+ *   /delete <room>
+ */
+func handleTCPRoleCommand(client *Client, line string) {
+	args := strings.Fields(line)
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+	switch {
+	case args[0] == "/grant" && len(args) > 2:
+		grantRole(client, args[1], args[2], arg(3))
+	case args[0] == "/ungrant" && len(args) > 1:
+		grantRole(client, args[1], "", arg(2))
+	case args[0] == "/roles":
+		listRoles(client, arg(1))
+	case args[0] == "/kick" && len(args) > 1:
+		room, reason := "", args[2:]
+		if strings.HasPrefix(arg(2), "#") {
+			room, reason = args[2], args[3:]
+		}
+		kickUser(client, args[1], room, strings.Join(reason, " "))
+	case args[0] == "/delete" && len(args) > 1:
+		deleteRoom(client, args[1])
+	default:
+		roomNotice(client, "Usage: /grant <user> <role> [<room>], /ungrant <user> [<room>], /roles [<room>], /kick <user> [#<room>] [<reason>] or /delete <room>")
+	}
+}
+
+func isRoleCommand(line string) bool {
+	command, _, _ := strings.Cut(line, " ")
+	switch command {
+	case "/grant", "/ungrant", "/roles", "/kick", "/delete":
+		return true
+	}
+	return false
+}
+
+/* A counter with one value per transport */
+type transportCounter struct {
+	TCP       atomic.Int64
+	WebSocket atomic.Int64
+	SSE       atomic.Int64
+	IRC       atomic.Int64
+}
+
+/* Other transports, such as the webhook and federation senders, are not counted */
+func (c *transportCounter) Add(transport string, n int64) {
+	switch transport {
+	case "tcp":
+		c.TCP.Add(n)
+	case "websocket":
+		c.WebSocket.Add(n)
+	case "sse":
+		c.SSE.Add(n)
+	case "irc":
+		c.IRC.Add(n)
+	}
+}
+
+func (c *transportCounter) Total() int64 {
+	return c.TCP.Load() + c.WebSocket.Load() + c.SSE.Load() + c.IRC.Load()
+}
+
+/* A latency histogram with fixed buckets, in seconds */
+type histogram struct {
+	Bounds []float64
+	Counts []atomic.Int64
+	Sum    atomic.Int64 // Nanoseconds
+	Count  atomic.Int64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{Bounds: bounds, Counts: make([]atomic.Int64, len(bounds))}
+}
+
+func (h *histogram) Observe(d time.Duration) {
+	for i, bound := range h.Bounds {
+		if d.Seconds() <= bound {
+			h.Counts[i].Add(1)
+		}
+	}
+	h.Sum.Add(int64(d))
+	h.Count.Add(1)
+}
+
+/* Counts the bytes of a TCP or IRC connection in both directions */
+type countingConn struct {
+	net.Conn
+	transport string
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	metricBytesIn.Add(c.transport, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	metricBytesOut.Add(c.transport, int64(n))
+	return n, err
+}
+
+/* Serve the server metrics in the Prometheus text exposition format */
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	connected := map[string]int{"tcp": 0, "websocket": 0, "sse": 0, "irc": 0}
+	clientsMux.Lock()
+	for _, client := range clients {
+		connected[client.ClientType]++
+	}
+	accountCount := len(onlineAccounts)
+	clientsMux.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	gauge := func(name, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	counter := func(name, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	}
+	perTransport := func(name string, c *transportCounter) {
+		fmt.Fprintf(w, "%s{transport=\"tcp\"} %d\n", name, c.TCP.Load())
+		fmt.Fprintf(w, "%s{transport=\"websocket\"} %d\n", name, c.WebSocket.Load())
+		fmt.Fprintf(w, "%s{transport=\"sse\"} %d\n", name, c.SSE.Load())
+		fmt.Fprintf(w, "%s{transport=\"irc\"} %d\n", name, c.IRC.Load())
+	}
+
+	gauge("paizer_connected_clients", "Connected sessions by transport.")
+	fmt.Fprintf(w, "paizer_connected_clients{transport=\"tcp\"} %d\n", connected["tcp"])
+	fmt.Fprintf(w, "paizer_connected_clients{transport=\"websocket\"} %d\n", connected["websocket"])
+	fmt.Fprintf(w, "paizer_connected_clients{transport=\"sse\"} %d\n", connected["sse"])
+	fmt.Fprintf(w, "paizer_connected_clients{transport=\"irc\"} %d\n", connected["irc"])
+	gauge("paizer_online_accounts", "Accounts with at least one session.")
+	fmt.Fprintf(w, "paizer_online_accounts %d\n", accountCount)
+
+	counter("paizer_messages_received_total", "Messages and commands received from clients, excluding heartbeats.")
+	perTransport("paizer_messages_received_total", &metricMessagesReceived)
+	counter("paizer_messages_broadcast_total", "Messages broadcast to the main chat or a room.")
+	fmt.Fprintf(w, "paizer_messages_broadcast_total %d\n", metricMessagesBroadcast.Load())
+	counter("paizer_messages_delivered_total", "Messages written to individual sessions.")
+	perTransport("paizer_messages_delivered_total", &metricMessagesDelivered)
+	counter("paizer_bytes_received_total", "Bytes received from clients, WebSocket counts frame payloads.")
+	perTransport("paizer_bytes_received_total", &metricBytesIn)
+	counter("paizer_bytes_sent_total", "Bytes sent to clients, WebSocket counts frame payloads.")
+	perTransport("paizer_bytes_sent_total", &metricBytesOut)
+	counter("paizer_write_failures_total", "Failed writes to clients.")
+	perTransport("paizer_write_failures_total", &metricWriteFailures)
+	counter("paizer_heartbeat_timeouts_total", "Sessions dropped after missing their heartbeats.")
+	fmt.Fprintf(w, "paizer_heartbeat_timeouts_total %d\n", metricHeartbeatTimeouts.Load())
+	counter("paizer_rate_limited_total", "Messages rejected by rate limiting.")
+	fmt.Fprintf(w, "paizer_rate_limited_total %d\n", metricRateLimited.Load())
+	counter("paizer_retention_purged_messages_total", "Messages purged from the history by the retention rules.")
+	fmt.Fprintf(w, "paizer_retention_purged_messages_total %d\n", metricPurgedMessages.Load())
+	counter("paizer_retention_purged_files_total", "Attachments deleted by the retention rules.")
+	fmt.Fprintf(w, "paizer_retention_purged_files_total %d\n", metricPurgedFiles.Load())
+	counter("paizer_retention_purged_bytes_total", "Bytes of history and attachments purged by the retention rules.")
+	fmt.Fprintf(w, "paizer_retention_purged_bytes_total %d\n", metricPurgedBytes.Load())
+
+	name := "paizer_broadcast_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time to fan a broadcast out to every recipient.\n# TYPE %s histogram\n", name, name)
+	for i, bound := range metricBroadcastLatency.Bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, metricBroadcastLatency.Counts[i].Load())
+	}
+	count := metricBroadcastLatency.Count.Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, time.Duration(metricBroadcastLatency.Sum.Load()).Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+
+	gauge("go_goroutines", "Number of goroutines that currently exist.")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+}
+
+/*
+ * Set up the structured logger. Records go to stdout, or to -log-file which is
+ * rotated once it grows past -log-max-size or gets older than -log-max-age.
+ */
+func initLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *logFile != "" {
+		file, err := openRotatingFile(*logFile)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	switch *logFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(out, options)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(out, options)))
+	default:
+		return fmt.Errorf("unknown log format %q, use text or json", *logFormat)
+	}
+	return nil
+}
+
+/* Log a startup failure and exit */
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+/* Logger with the fields that identify a session */
+func (c *Client) logger() *slog.Logger {
+	return slog.With("uid", c.UID, "username", c.Username, "ip", c.IP, "transport", c.ClientType)
+}
+
+/* Close the session's connection, its handler then removes the client */
+func (c *Client) closeConnection() {
+	if c.Conn != nil {
+		c.Conn.Close()
+	}
+	if c.WsConn != nil {
+		c.WsConn.Close()
+	}
+	if c.SSE != nil {
+		c.SSE.Close()
+	}
+}
+
+/* Message text is only logged with -log-content, the zero Attr is dropped by the handlers */
+func contentAttr(content string) slog.Attr {
+	if !*logContent {
+		return slog.Attr{}
+	}
+	return slog.String("content", content)
+}
+
+/* A log file that is renamed with a timestamp suffix and replaced when it gets too big or too old */
+type rotatingFile struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string) (*rotatingFile, error) {
+	r := &rotatingFile{path: path}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size, r.opened = file, info.Size(), info.ModTime()
+	if r.size == 0 {
+		r.opened = time.Now()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tooBig := *logMaxSize > 0 && r.size+int64(len(p)) > *logMaxSize<<20
+	tooOld := *logMaxAge > 0 && time.Since(r.opened) > *logMaxAge
+	/* A failed rotation keeps writing to the current file, it is tried again on the next write */
+	if r.size > 0 && (tooBig || tooOld) {
+		if err := r.rotate(); err != nil && r.file == nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	/* Backups sort by name, a counter keeps two rotations within a microsecond apart */
+	stamp := time.Now().Format("20060102-150405.000000")
+	rotated := r.path + "." + stamp
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(rotated); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%s-%d", r.path, stamp, i)
+	}
+
+	r.file.Close()
+	r.file = nil
+	if err := os.Rename(r.path, rotated); err != nil {
+		if openErr := r.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+
+	/* Keep the newest -log-max-backups rotated files */
+	if *logMaxBackups > 0 {
+		old, _ := filepath.Glob(r.path + ".*")
+		sort.Strings(old)
+		for len(old) > *logMaxBackups {
+			os.Remove(old[0])
+			old = old[1:]
+		}
+	}
+	return r.open()
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+/* Liveness probe, the process is up and serving HTTP */
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"status": "ok",
+		"uptime": time.Since(startTime).Round(time.Second).String(),
+	})
+}
+
+/* Readiness probe, fails while a listener is down, storage is not writable or the server is shutting down */
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"tcp":      "ok",
+		"http":     "ok",
+		"storage":  "ok",
+		"shutdown": "ok",
+	}
+	if !tcpReady.Load() {
+		checks["tcp"] = "not listening"
+	}
+	if !httpReady.Load() {
+		checks["http"] = "not listening"
+	}
+	if err := checkStorage(); err != nil {
+		checks["storage"] = err.Error()
+	}
+	if shuttingDown.Load() {
+		checks["shutdown"] = "shutting down"
+	}
+
+	status, code := "ready", http.StatusOK
+	for _, result := range checks {
+		if result != "ok" {
+			status, code = "not ready", http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, map[string]any{"status": status, "checks": checks})
+}
+
+/* Check that the data directory accepts writes */
+func checkStorage() error {
+	file, err := os.CreateTemp(*dataDir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func historyPath() string {
+	return filepath.Join(*dataDir, "history.jsonl")
+}
+
+/* Load the persisted history and build the search index */
+func initHistory() error {
+	data, err := os.ReadFile(historyPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	historyMux.Lock()
+	defer historyMux.Unlock()
+
+	for _, line := range strings.Split(string(data), "\n") {
+		var msg Message
+		if line == "" || json.Unmarshal([]byte(line), &msg) != nil {
+			continue
+		}
+		history = append(history, msg)
+	}
+	rebuildSearchIndex()
+
+	historyFile, err = os.OpenFile(historyPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	return err
+}
+
+/* A random ID for a chat or file message, it stays the same on every node */
+func newMessageID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+/* Persist and index a chat, file or direct message, the retention job purges old ones */
+func recordHistory(msg Message) {
+	if msg.Type != "chat" && msg.Type != "file" && msg.Type != "dm" {
+		return
+	}
+	if msg.Time == 0 {
+		msg.Time = time.Now().UnixMilli()
+	}
+	if msg.ID == "" {
+		msg.ID = newMessageID()
+	}
+
+	historyMux.Lock()
+	defer historyMux.Unlock()
+
+	history = append(history, msg)
+	indexMessage(len(history)-1, msg)
+	if historyFile != nil {
+		data, _ := json.Marshal(msg)
+		if _, err := historyFile.Write(append(data, '\n')); err != nil {
+			slog.Error("Failed to save history", "error", err)
+		}
+	}
+
+	/* Purge early rather than letting the history grow far past its limit between runs */
+	if len(history) > *historySize+max(*historySize/10, 100) {
+		wakeRetention()
+	}
+}
+
+/* Rewrite the history file with the messages still kept, the caller must hold historyMux */
+func compactHistory() {
+	var buf bytes.Buffer
+	for _, msg := range history {
+		data, _ := json.Marshal(msg)
+		buf.Write(append(data, '\n'))
+	}
+
+	tmp := historyPath() + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		slog.Error("Failed to compact history", "error", err)
+		return
+	}
+	historyFile.Close()
+	if err := os.Rename(tmp, historyPath()); err != nil {
+		slog.Error("Failed to compact history", "error", err)
+	}
+	file, err := os.OpenFile(historyPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		slog.Error("Failed to reopen history", "error", err)
+	}
+	historyFile = file
+	rebuildSearchIndex()
+}
+
+/* The most recent messages of the main chat or a room, oldest first */
+func recentHistory(room string, limit int) []Message {
+	historyMux.Lock()
+	defer historyMux.Unlock()
+
+	var messages []Message
+	for i := len(history) - 1; i >= 0 && len(messages) < limit; i-- {
+		if history[i].Type != "dm" && history[i].Room == room {
+			messages = append(messages, history[i])
+		}
+	}
+	slices.Reverse(messages)
+	return messages
+}
+
+/*
+ * Full-text search over the history. Latin and other space separated scripts are
+ * indexed by word, CJK text by overlapping pairs of characters since it has no
+ * spaces. Postings refer to messages by their index in history.
+ */
+const searchPageSize = 10
+
+type posting struct {
+	Index int // Position of the message in history
+	Count int // Occurrences of the term in the message
+}
+
+/* A page of search results, Snippet marks the matches with ** */
+type SearchPage struct {
+	Query   string         `json:"query"`
+	Page    int            `json:"page"`
+	Pages   int            `json:"pages"`
+	Total   int            `json:"total"`
+	Results []SearchResult `json:"results,omitempty"`
+}
+
+type SearchResult struct {
+	ID      string `json:"id"`
+	Room    string `json:"room,omitempty"`
+	User    string `json:"user"`
+	To      string `json:"to,omitempty"` // Recipient of a direct message
+	Time    int64  `json:"time"`
+	Snippet string `json:"snippet"`
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+/*
+ * Split text into search terms: runs of letters and digits, with CJK runs kept
+ * separate. Terms are lower case, the index splits CJK terms further into bigrams.
+ */
+func searchTerms(text string) []string {
+	var terms []string
+	var current []rune
+	cjk := false
+	flush := func() {
+		if len(current) > 0 {
+			terms = append(terms, string(current))
+			current = current[:0]
+		}
+	}
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			if !cjk {
+				flush()
+			}
+			cjk = true
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r):
+			if cjk {
+				flush()
+			}
+			cjk = false
+		default:
+			flush()
+			continue
+		}
+		current = append(current, unicode.ToLower(r))
+	}
+	flush()
+	return terms
+}
+
+/* The index keys of a term, CJK terms become overlapping bigrams */
+func termTokens(term string) []string {
+	runes := []rune(term)
+	if !isCJK(runes[0]) || len(runes) == 1 {
+		return []string{term}
+	}
+	tokens := make([]string, 0, len(runes)-1)
+	for i := 0; i+1 < len(runes); i++ {
+		tokens = append(tokens, string(runes[i:i+2]))
+	}
+	return tokens
+}
+
+/* The text a message is found by, file messages by their file name */
+func searchableText(msg Message) string {
+	if msg.Type == "file" && msg.File != nil {
+		return msg.File.Name
+	}
+	return msg.Content
+}
+
+/* Add a message to the index, the caller must hold historyMux */
+func indexMessage(index int, msg Message) {
+	counts := make(map[string]int)
+	for _, term := range searchTerms(searchableText(msg)) {
+		for _, token := range termTokens(term) {
+			counts[token]++
+		}
+	}
+	for token, count := range counts {
+		searchIndex[token] = append(searchIndex[token], posting{index, count})
+	}
+}
+
+/* Index the kept history from scratch, the caller must hold historyMux */
+func rebuildSearchIndex() {
+	searchIndex = make(map[string][]posting)
+	for i, msg := range history {
+		indexMessage(i, msg)
+	}
+}
+
+/* A parsed search request: free text plus from:, in:, after:, before:, sort: and page: filters */
+type searchQuery struct {
+	Text   string
+	From   string
+	Room   *string // nil searches the main chat and every room
+	After  int64
+	Before int64
+	Recent bool
+	Page   int
+}
+
+func parseSearchQuery(raw string) (searchQuery, error) {
+	query := searchQuery{Page: 1}
+	var words []string
+	for _, word := range strings.Fields(raw) {
+		key, value, found := strings.Cut(word, ":")
+		if !found || value == "" {
+			if strings.HasPrefix(word, "#") && len(word) > 1 {
+				key, value, found = "in", word, true
+			} else {
+				words = append(words, word)
+				continue
+			}
+		}
+		switch strings.ToLower(key) {
+		case "from":
+			query.From = accountKey(value)
+		case "in":
+			room := ""
+			if value != "main" {
+				var err error
+				if room, err = roomName(value); err != nil {
+					return query, err
+				}
+			}
+			query.Room = &room
+		case "after", "before":
+			day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+			if err != nil {
+				return query, fmt.Errorf("dates are written as YYYY-MM-DD, not %q", value)
+			}
+			if key == "after" {
+				query.After = day.UnixMilli()
+			} else {
+				query.Before = day.UnixMilli()
+			}
+		case "sort":
+			query.Recent = value == "recent"
+		case "page":
+			page, err := strconv.Atoi(value)
+			if err != nil || page < 1 {
+				return query, fmt.Errorf("invalid page %q", value)
+			}
+			query.Page = page
+		default:
+			words = append(words, word)
+		}
+	}
+	query.Text = strings.Join(words, " ")
+	return query, nil
+}
+
+/*
+ * Search the messages a client can read: the main chat, the rooms its account is
+ * a member of and its own direct messages. Results are ranked by the terms' frequency weighted by how rare
+ * they are, newer messages first among equals, or only by recency with sort:recent.
+ */
+func searchHistory(client *Client, query searchQuery) SearchPage {
+	clientsMux.Lock()
+	readable := map[string]bool{"": true}
+	for name, room := range rooms {
+		if room.Members[client.Account.Name] {
+			readable[name] = true
+		}
+	}
+	clientsMux.Unlock()
+
+	terms := searchTerms(query.Text)
+	var tokens []string
+	for _, term := range terms {
+		tokens = append(tokens, termTokens(term)...)
+	}
+
+	historyMux.Lock()
+	defer historyMux.Unlock()
+
+	/* Every token has to match, candidates come from the rarest one */
+	scores := make(map[int]float64)
+	if len(tokens) == 0 {
+		for i := range history {
+			scores[i] = 0
+		}
+	}
+	slices.SortFunc(tokens, func(a, b string) int { return len(searchIndex[a]) - len(searchIndex[b]) })
+	for i, token := range tokens {
+		weight := math.Log(1 + float64(len(history))/float64(len(searchIndex[token])+1))
+		matched := make(map[int]float64)
+		for _, p := range searchIndex[token] {
+			score, candidate := scores[p.Index]
+			if i == 0 || candidate {
+				matched[p.Index] = score + float64(p.Count)*weight
+			}
+		}
+		scores = matched
+	}
+
+	var seqs []int
+	for seq := range scores {
+		msg := history[seq]
+		own := accountKey(msg.User) == client.Account.Name || accountKey(msg.To) == client.Account.Name
+		switch {
+		case len(msg.E2E) > 0:
+		case msg.Type == "dm" && !own:
+		case msg.Type != "dm" && !readable[msg.Room]:
+		case query.Room != nil && (msg.Type == "dm" || msg.Room != *query.Room):
+		case query.From != "" && accountKey(msg.User) != query.From:
+		case query.After != 0 && msg.Time < query.After:
+		case query.Before != 0 && msg.Time >= query.Before:
+		default:
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool {
+		if !query.Recent && scores[seqs[i]] != scores[seqs[j]] {
+			return scores[seqs[i]] > scores[seqs[j]]
+		}
+		return seqs[i] > seqs[j]
+	})
+
+	page := SearchPage{Query: query.Text, Page: query.Page, Total: len(seqs)}
+	page.Pages = (len(seqs) + searchPageSize - 1) / searchPageSize
+	start := min((query.Page-1)*searchPageSize, len(seqs))
+	for _, seq := range seqs[start:min(start+searchPageSize, len(seqs))] {
+		msg := history[seq]
+		page.Results = append(page.Results, SearchResult{
+			ID:      msg.ID,
+			Room:    msg.Room,
+			User:    msg.User,
+			To:      msg.To,
+			Time:    msg.Time,
+			Snippet: searchSnippet(searchableText(msg), terms),
+		})
+	}
+	return page
+}
+
+/* Up to 120 characters around the first match, every match wrapped in ** */
+func searchSnippet(text string, terms []string) string {
+	const width = 120
+
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	isWord := func(i int) bool {
+		return i >= 0 && i < len(lower) && (unicode.IsLetter(lower[i]) || unicode.IsDigit(lower[i])) && !isCJK(lower[i])
+	}
+
+	/* Words only match whole words, like the index, CJK terms anywhere */
+	marked := make([]bool, len(runes))
+	first := -1
+	for _, term := range terms {
+		needle := []rune(term)
+		cjk := isCJK(needle[0])
+		for i := 0; i+len(needle) <= len(lower); i++ {
+			if !slices.Equal(lower[i:i+len(needle)], needle) {
+				continue
+			}
+			if !cjk && (isWord(i-1) || isWord(i+len(needle))) {
+				continue
+			}
+			for j := i; j < i+len(needle); j++ {
+				marked[j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+
+	start := max(0, min(first-width/3, len(runes)-width))
+	end := min(len(runes), start+width)
+	var out strings.Builder
+	if start > 0 {
+		out.WriteString("…")
+	}
+	for i := start; i < end; i++ {
+		if marked[i] && (i == start || !marked[i-1]) {
+			out.WriteString("**")
+		}
+		out.WriteRune(runes[i])
+		if marked[i] && (i == end-1 || !marked[i+1]) {
+			out.WriteString("**")
+		}
+	}
+	if end < len(runes) {
+		out.WriteString("…")
+	}
+	return strings.ReplaceAll(out.String(), "\n", " ")
+}
+
+/* Answer a search request with a page of results */
+func searchMessages(client *Client, raw string) {
+	query, err := parseSearchQuery(raw)
+	if err == nil && strings.TrimSpace(raw) == "" {
+		err = errors.New("usage: /search <words> [from:<nick>] [in:<room>|in:main] [after:YYYY-MM-DD] [before:YYYY-MM-DD] [sort:recent] [page:<n>]")
+	}
+	if err != nil {
+		clientsMux.Lock()
+		sendMessage(client, Message{Type: "system", Content: "Search failed: " + err.Error()})
+		clientsMux.Unlock()
+		return
+	}
+
+	page := searchHistory(client, query)
+	content := fmt.Sprintf("%d results for %q, page %d of %d:", page.Total, raw, page.Page, max(page.Pages, 1))
+	if page.Total == 1 {
+		content = fmt.Sprintf("1 result for %q:", raw)
+	} else if page.Total == 0 {
+		content = fmt.Sprintf("No messages match %q.", raw)
+	}
+	client.logger().Info("Search", "query", raw, "results", page.Total)
+
+	clientsMux.Lock()
+	sendMessage(client, Message{Type: "search_results", Content: content, Search: &page})
+	clientsMux.Unlock()
+}
+
+/*
+ * Retention: a background job purges messages older than -retention-age or past
+ * -history-size, rooms can set their own rules and legal holds exempt a room from
+ * purging altogether. Shared files go once no kept message refers to them.
+ */
+type Retention struct {
+	MaxAge    string `json:"max_age,omitempty"`    // Go duration such as "720h", replaces -retention-age in this room
+	MaxCount  int    `json:"max_count,omitempty"`  // Only this many of the room's newest messages are kept
+	LegalHold bool   `json:"legal_hold,omitempty"` // Nothing in the room is purged
+}
+
+/* Outcome of a retention run */
+type RetentionRun struct {
+	Time     int64 `json:"time"`
+	Messages int   `json:"messages"` // Purged messages
+	Files    int   `json:"files"`    // Deleted attachments
+	Bytes    int64 `json:"bytes"`    // Size of the purged messages and attachments
+}
+
+func wakeRetention() {
+	select {
+	case retentionWake <- struct{}{}:
+	default:
+	}
+}
+
+/* Apply the retention rules on start, every -retention-interval and when the history grows past its limit */
+func runRetention() {
+	ticker := time.NewTicker(*retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		run := purgeHistory()
+		if run.Messages > 0 {
+			slog.Info("Purged history", "messages", run.Messages, "files", run.Files, "bytes", run.Bytes)
+		}
+		select {
+		case <-ticker.C:
+		case <-retentionWake:
+		}
+	}
+}
+
+func purgeHistory() RetentionRun {
+	retentionMux.Lock()
+	defer retentionMux.Unlock()
+
+	clientsMux.Lock()
+	policies := make(map[string]Retention)
+	for name, room := range rooms {
+		if room.Retention != nil {
+			policies[name] = *room.Retention
+		}
+	}
+	clientsMux.Unlock()
+
+	now := time.Now()
+	cutoff := func(age time.Duration) int64 {
+		if age <= 0 {
+			return 0
+		}
+		return now.Add(-age).UnixMilli()
+	}
+	serverCutoff := cutoff(*retentionAge)
+	roomCutoff := make(map[string]int64)
+	for name, policy := range policies {
+		if age, err := time.ParseDuration(policy.MaxAge); err == nil {
+			roomCutoff[name] = cutoff(age)
+		}
+	}
+
+	historyMux.Lock()
+	defer historyMux.Unlock()
+
+	/* Newest first, so the count limits keep the latest messages */
+	purge := make([]bool, len(history))
+	perRoom := make(map[string]int)
+	total := 0
+	for i := len(history) - 1; i >= 0; i-- {
+		msg := history[i]
+		room := ""
+		if msg.Type != "dm" {
+			room = msg.Room
+		}
+		policy := policies[room]
+		if room != "" && policy.LegalHold {
+			continue
+		}
+
+		limit, custom := roomCutoff[room]
+		if !custom || room == "" {
+			limit = serverCutoff
+		}
+		perRoom[room]++
+		switch {
+		case limit != 0 && msg.Time < limit:
+			purge[i] = true
+		case room != "" && policy.MaxCount > 0 && perRoom[room] > policy.MaxCount:
+			purge[i] = true
+		case total >= *historySize:
+			purge[i] = true
+		default:
+			total++
+		}
+	}
+
+	run := RetentionRun{Time: now.UnixMilli()}
+	kept := history[:0:0]
+	keptFiles := make(map[string]bool)
+	var purgedFiles []*FileInfo
+	for i, msg := range history {
+		if !purge[i] {
+			kept = append(kept, msg)
+			if msg.File != nil {
+				keptFiles[msg.File.ID] = true
+			}
+			continue
+		}
+		data, _ := json.Marshal(msg)
+		run.Messages++
+		run.Bytes += int64(len(data)) + 1
+		if msg.File != nil {
+			purgedFiles = append(purgedFiles, msg.File)
+		}
+	}
+	for _, file := range purgedFiles {
+		if keptFiles[file.ID] {
+			continue
+		}
+		keptFiles[file.ID] = true // Each file is deleted once
+		if info, err := os.Stat(filePath(file.ID)); err == nil && os.Remove(filePath(file.ID)) == nil {
+			run.Files++
+			run.Bytes += info.Size()
+		}
+	}
+
+	if run.Messages > 0 {
+		history = kept
+		compactHistory()
+	}
+	metricPurgedMessages.Add(int64(run.Messages))
+	metricPurgedFiles.Add(int64(run.Files))
+	metricPurgedBytes.Add(run.Bytes)
+	lastRetentionRun = run
+	return run
+}
+
+/* GET /admin/retention */
+func handleAdminRetention(w http.ResponseWriter, r *http.Request) {
+	clientsMux.Lock()
+	policies := make(map[string]Retention)
+	for name, room := range rooms {
+		if room.Retention != nil {
+			policies[name] = *room.Retention
+		}
+	}
+	clientsMux.Unlock()
+
+	retentionMux.Lock()
+	last := lastRetentionRun
+	retentionMux.Unlock()
+	historyMux.Lock()
+	messages := len(history)
+	historyMux.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"max_age":   retentionAge.String(),
+		"max_count": *historySize,
+		"interval":  retentionInterval.String(),
+		"messages":  messages,
+		"rooms":     policies,
+		"last_run":  last,
+	})
+}
+
+/* PUT /admin/rooms/{name}/retention {"max_age", "max_count", "legal_hold"}, an empty body clears the room's rules */
+func handleAdminRoomRetention(w http.ResponseWriter, r *http.Request) {
+	name, err := roomName(r.PathValue("name"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	var policy Retention
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil && !errors.Is(err, io.EOF) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	if policy.MaxAge != "" {
+		if age, err := time.ParseDuration(policy.MaxAge); err != nil || age <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid max_age"})
+			return
+		}
+	}
+	if policy.MaxCount < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid max_count"})
+		return
+	}
+
+	clientsMux.Lock()
+	room, exists := rooms[name]
+	if exists {
+		if policy == (Retention{}) {
+			room.Retention = nil
+		} else {
+			room.Retention = &policy
+		}
+		roomChanged(room)
+	}
+	clientsMux.Unlock()
+	if !exists {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such room"})
+		return
+	}
+
+	slog.Info("Room retention changed", "room", name, "max_age", policy.MaxAge, "max_count", policy.MaxCount, "legal_hold", policy.LegalHold)
+	wakeRetention()
+	writeJSON(w, http.StatusOK, policy)
+}
+
+func handleAdminRoles(w http.ResponseWriter, r *http.Request) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{"default": *defaultRole, "roles": serverRoles})
+}
+
+/* PUT /admin/roles/{user} {"role": "...", "room": "..."}, an empty role takes the account's role away */
+func handleAdminSetRole(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Role string `json:"role"`
+		Room string `json:"room"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+		return
+	}
+	account := accountKey(r.PathValue("user"))
+	if req.Role != "" {
+		role, err := roleName(req.Role)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		req.Role = role
+	}
+	if req.Room != "" {
+		name, err := roomName(req.Room)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		req.Room = name
+	}
+
+	clientsMux.Lock()
+	roles := serverRoles
+	room := rooms[req.Room]
+	if room != nil {
+		if room.Roles == nil {
+			room.Roles = make(map[string]string)
+		}
+		roles = room.Roles
+	}
+	if req.Room == "" || room != nil {
+		if req.Role == "" {
+			delete(roles, account)
+		} else {
+			roles[account] = req.Role
+		}
+		if room != nil {
+			roomChanged(room)
+		} else {
+			rolesChanged()
+		}
+	}
+	clientsMux.Unlock()
+	if req.Room != "" && room == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such room"})
+		return
+	}
+
+	slog.Info("Role changed", "account", account, "role", req.Role, "room", req.Room)
+	writeJSON(w, http.StatusOK, map[string]string{"user": account, "role": req.Role, "room": req.Room})
+}
+
+/* POST /admin/tokens/{user} issues a session token, for accounts with a role that lost theirs */
+func handleAdminIssueToken(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimSpace(r.PathValue("user"))
+	if user == "" || (*federationName != "" && strings.Contains(user, "@")) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user"})
+		return
+	}
+	raw, token := issueSessionToken(user)
+	slog.Info("Admin issued a session token", "account", accountKey(user), "token", token.ID)
+	writeJSON(w, http.StatusOK, map[string]any{"user": user, "token": raw, "expires": token.Expires})
+}
+
+/* POST /admin/retention/run purges now and reports what was removed */
+func handleAdminRunRetention(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, purgeHistory())
+}
+
+/* Messages of the main chat, a room or the direct messages between two accounts, oldest first */
+func conversationHistory(room string, pair []string) []Message {
+	historyMux.Lock()
+	defer historyMux.Unlock()
+
+	var messages []Message
+	for _, msg := range history {
+		if pair != nil {
+			from, to := accountKey(msg.User), accountKey(msg.To)
+			if msg.Type == "dm" && ((from == pair[0] && to == pair[1]) || (from == pair[1] && to == pair[0])) {
+				messages = append(messages, msg)
+			}
+		} else if msg.Type != "dm" && msg.Room == room {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+/* A message as a line of a transcript, in the format the server prints for TCP clients */
+func transcriptLine(msg Message) string {
+	content := msg.Content
+	if len(msg.E2E) > 0 {
+		content = "(end-to-end encrypted)"
+	}
+	stamp := time.UnixMilli(msg.Time).Format("15:04:05")
+
+	switch {
+	case msg.Type == "file" && msg.File != nil:
+		return fmt.Sprintf("[%s] [%s] shared a file: %s (%s, %d bytes) /get %s",
+			stamp, sender(msg), msg.File.Name, msg.File.MIME, msg.File.Size, msg.File.ID[:min(12, len(msg.File.ID))])
+	case msg.Type == "dm":
+		return fmt.Sprintf("[%s] [%s -> %s] %s", stamp, sender(msg), msg.To, content)
+	}
+	return fmt.Sprintf("[%s] [%s] %s", stamp, sender(msg), content)
+}
+
+/* Plain text transcript, a line with the date starts every day */
+func writeTranscript(w io.Writer, title string, messages []Message) {
+	fmt.Fprintf(w, "Paizer history of %s, exported %s\n", title, time.Now().Format(time.RFC3339))
+	day := ""
+	for _, msg := range messages {
+		if date := time.UnixMilli(msg.Time).Format("2006-01-02"); date != day {
+			day = date
+			fmt.Fprintf(w, "\n--- %s ---\n", day)
+		}
+		fmt.Fprintln(w, transcriptLine(msg))
+	}
+}
+
+/* A standalone HTML page of the transcript */
+func writeHTMLTranscript(w io.Writer, title string, messages []Message) {
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Paizer history of %[1]s</title>
+<style>
+body { font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif; max-width: 900px; margin: 20px auto; color: #2c3e50; }
+h2 { font-size: 1em; color: #7f8c8d; border-bottom: 1px solid #ecf0f1; }
+.message { margin: 4px 0; }
+.time { color: #95a5a6; font-size: 0.85em; margin-right: 8px; }
+.user { font-weight: bold; margin-right: 8px; }
+.content { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>Paizer history of %[1]s</h1>
+<p>Exported %[2]s, messages: %[3]d</p>
+`, html.EscapeString(title), time.Now().Format(time.RFC3339), len(messages))
+
+	day := ""
+	for _, msg := range messages {
+		if date := time.UnixMilli(msg.Time).Format("2006-01-02"); date != day {
+			day = date
+			fmt.Fprintf(w, "<h2>%s</h2>\n", day)
+		}
+
+		who := sender(msg)
+		if msg.Type == "dm" {
+			who += " → " + msg.To
+		}
+		var content string
+		switch {
+		case len(msg.E2E) > 0:
+			content = "<em>end-to-end encrypted</em>"
+		case msg.Type == "file" && msg.File != nil:
+			content = fmt.Sprintf(`📎 <a href="%s">%s</a> (%s, %d bytes)`, html.EscapeString(fileURL(msg.File.ID, msg.File.Name)),
+				html.EscapeString(msg.File.Name), html.EscapeString(msg.File.MIME), msg.File.Size)
+		default:
+			content = html.EscapeString(msg.Content)
+		}
+		fmt.Fprintf(w, "<div class=\"message\" id=\"m-%s\"><span class=\"time\">%s</span><span class=\"user\">%s</span><span class=\"content\">%s</span></div>\n",
+			html.EscapeString(msg.ID), time.UnixMilli(msg.Time).Format("15:04:05"), html.EscapeString(who), content)
+	}
+	fmt.Fprintln(w, "</body>\n</html>")
+}
+
+/*
+ * GET /admin/export?room=<room>&format=jsonl|text|html exports the main chat when
+ * room is empty, ?dm=<nick>,<nick> the direct messages between two users
+ */
+func handleAdminExport(w http.ResponseWriter, r *http.Request) {
+	room := r.URL.Query().Get("room")
+	title, name := "the main chat", "main"
+	if room != "" {
+		var err error
+		if room, err = roomName(room); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		title, name = "#"+room, room
+	}
+
+	var pair []string
+	if dm := r.URL.Query().Get("dm"); dm != "" {
+		first, second, found := strings.Cut(dm, ",")
+		if !found || accountKey(first) == "" || accountKey(second) == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "dm takes two nicknames separated by a comma"})
+			return
+		}
+		pair = []string{accountKey(first), accountKey(second)}
+		title, name = "the direct messages of "+first+" and "+second, "dm-"+pair[0]+"-"+pair[1]
+	}
+	messages := conversationHistory(room, pair)
+
+	/* Deleted rooms keep their history until it is purged, so they can still be exported */
+	clientsMux.Lock()
+	_, exists := rooms[room]
+	clientsMux.Unlock()
+	if room != "" && pair == nil && !exists && len(messages) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such room"})
+		return
+	}
+	name = "paizer-" + strings.NewReplacer("@", "_", "/", "_").Replace(name)
+	attachment := func(ext string) string {
+		return mime.FormatMediaType("attachment", map[string]string{"filename": name + ext})
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", attachment(".jsonl"))
+		encoder := json.NewEncoder(w)
+		for _, msg := range messages {
+			encoder.Encode(msg)
+		}
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", attachment(".txt"))
+		writeTranscript(w, title, messages)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Disposition", attachment(".html"))
+		writeHTMLTranscript(w, title, messages)
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "format must be jsonl, text or html"})
+	}
+}
+
+/*
+ * POST /admin/import with a JSON lines export as the body. Messages keep their IDs,
+ * authors and timestamps, IDs that are already known are skipped. Rooms that do not
+ * exist yet are created with the authors of their messages as members.
+ */
+func handleAdminImport(w http.ResponseWriter, r *http.Request) {
+	historyMux.Lock()
+	known := make(map[string]bool, len(history))
+	for _, msg := range history {
+		known[msg.ID] = true
+	}
+	historyMux.Unlock()
+
+	var imported []Message
+	skipped := 0
+	members := make(map[string]map[string]bool) // New rooms and their authors
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("line %d: %v", line, err)})
+			return
+		}
+		if (msg.Type != "chat" && msg.Type != "file" && msg.Type != "dm") || msg.User == "" || msg.Time == 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("line %d: not a chat, file or direct message", line)})
+			return
+		}
+		if msg.Room != "" {
+			room, err := roomName(msg.Room)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("line %d: %v", line, err)})
+				return
+			}
+			msg.Room = room
+		}
+		/* Retention deletes the blobs of purged file messages, so their IDs must name a stored file */
+		if msg.Type == "file" {
+			if msg.File == nil || len(msg.File.ID) != sha256.Size*2 || !isHexID(msg.File.ID) {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("line %d: a file message needs the SHA-256 of the file", line)})
+				return
+			}
+			if _, err := os.Stat(filePath(msg.File.ID)); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("line %d: file %s is not in the file store, copy ./data/files first", line, msg.File.ID)})
+				return
+			}
+		}
+		if msg.ID == "" {
+			msg.ID = newMessageID()
+		}
+		if known[msg.ID] {
+			skipped++
+			continue
+		}
+		known[msg.ID] = true
+		imported = append(imported, msg)
+
+		if msg.Type != "dm" && msg.Room != "" {
+			if members[msg.Room] == nil {
+				members[msg.Room] = make(map[string]bool)
+			}
+			members[msg.Room][accountKey(msg.User)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	created := []string{}
+	clientsMux.Lock()
+	for name, authors := range members {
+		if _, exists := rooms[name]; exists || strings.Contains(name, "@") {
+			continue
+		}
+		room := &Room{Name: name, Creator: "import", Created: time.Now().Unix(), Members: authors}
+		rooms[name] = room
+		roomChanged(room)
+		created = append(created, name)
+	}
+	clientsMux.Unlock()
+	sort.Strings(created)
+
+	/* Imported messages are merged into the history by time */
+	historyMux.Lock()
+	history = append(history, imported...)
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Time < history[j].Time })
+	compactHistory()
+	historyMux.Unlock()
+	wakeRetention()
+
+	slog.Info("Imported history", "imported", len(imported), "skipped", skipped, "rooms_created", len(created))
+	writeJSON(w, http.StatusOK, map[string]any{"imported": len(imported), "skipped": skipped, "rooms_created": created})
+}
+
+func bansPath() string {
+	return filepath.Join(*dataDir, "bans.json")
+}
+
+func initBans() error {
+	data, err := os.ReadFile(bansPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &bans)
+}
+
+/* Persist the ban list, the caller must hold bansMux */
+func saveBans() {
+	data, _ := json.Marshal(bans)
+	if err := os.WriteFile(bansPath(), data, 0644); err != nil {
+		slog.Error("Failed to save bans", "error", err)
+	}
+}
+
+func (b *Ban) matches(username string, ip string) bool {
+	if b.Expires != 0 && time.Now().Unix() > b.Expires {
+		return false
+	}
+	return (b.User != "" && b.User == accountKey(username)) || (b.IP != "" && b.IP == ip)
+}
+
+func (b *Ban) notice() string {
+	text := "You are banned from this server"
+	if b.Reason != "" {
+		text += ": " + b.Reason
+	}
+	if b.Expires != 0 {
+		text += fmt.Sprintf(" (until %s)", time.Unix(b.Expires, 0).Format("2006-01-02 15:04"))
+	}
+	return text + "."
+}
+
+/* Return the ban that applies to a login, if any */
+func findBan(username string, ip string) *Ban {
+	bansMux.Lock()
+	defer bansMux.Unlock()
+
+	for _, ban := range bans {
+		if ban.matches(username, ip) {
+			return ban
+		}
+	}
+	return nil
+}
+
+/* Tell a session why it is being dropped and close its connection, the caller must hold clientsMux */
+func disconnect(client *Client, reason string) {
+	sendMessage(client, Message{Type: "system", Content: reason})
+	client.closeConnection()
+}
+
+/* Start the admin API on its own listener, only when an admin token is configured */
+func startAdminServer() {
+	if *adminToken == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/stats", handleAdminStats)
+	mux.HandleFunc("GET /admin/clients", handleAdminClients)
+	mux.HandleFunc("GET /admin/rooms", handleAdminRooms)
+	mux.HandleFunc("GET /admin/history", handleAdminHistory)
+	mux.HandleFunc("GET /admin/export", handleAdminExport)
+	mux.HandleFunc("POST /admin/import", handleAdminImport)
+	mux.HandleFunc("GET /admin/retention", handleAdminRetention)
+	mux.HandleFunc("POST /admin/retention/run", handleAdminRunRetention)
+	mux.HandleFunc("PUT /admin/rooms/{name}/retention", handleAdminRoomRetention)
+	mux.HandleFunc("GET /admin/roles", handleAdminRoles)
+	mux.HandleFunc("PUT /admin/roles/{user}", handleAdminSetRole)
+	mux.HandleFunc("POST /admin/tokens/{user}", handleAdminIssueToken)
+	mux.HandleFunc("POST /admin/kick", handleAdminKick)
+	mux.HandleFunc("GET /admin/bans", handleAdminBans)
+	mux.HandleFunc("POST /admin/bans", handleAdminBan)
+	mux.HandleFunc("DELETE /admin/bans/{id}", handleAdminUnban)
+	mux.HandleFunc("POST /admin/broadcast", handleAdminBroadcast)
+	mux.HandleFunc("GET /admin/webhooks", handleAdminWebhooks)
+	mux.HandleFunc("POST /admin/webhooks", handleAdminAddWebhook)
+	mux.HandleFunc("DELETE /admin/webhooks/{id}", handleAdminDeleteWebhook)
+	mux.HandleFunc("GET /admin/webhooks/log", handleAdminWebhookLog)
+	mux.HandleFunc("GET /admin/incoming", handleAdminIncomingWebhooks)
+	mux.HandleFunc("POST /admin/incoming", handleAdminAddIncomingWebhook)
+	mux.HandleFunc("DELETE /admin/incoming/{id}", handleAdminDeleteIncomingWebhook)
+	mux.HandleFunc("GET /admin/federation", handleAdminFederation)
+	mux.HandleFunc("POST /admin/federation/peers", handleAdminAddFederationPeer)
+	mux.HandleFunc("DELETE /admin/federation/peers/{name}", handleAdminDeleteFederationPeer)
+	mux.HandleFunc("POST /admin/federation/share", handleAdminShareRoom)
+	mux.HandleFunc("DELETE /admin/federation/share", handleAdminShareRoom)
+
+	slog.Info("Admin API listening", "addr", *adminAddr)
+	fatal("Admin API stopped", http.ListenAndServe(*adminAddr, requireAdmin(mux)))
+}
+
+/* Check the "Authorization: Bearer <token>" header of every admin request */
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !hmac.Equal([]byte(token), []byte(*adminToken)) {
+			slog.Warn("Rejected admin request", "ip", r.RemoteAddr, "path", r.URL.Path)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid admin token"})
+			return
+		}
+		slog.Info("Admin request", "ip", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	connected := map[string]int{"tcp": 0, "websocket": 0, "sse": 0, "irc": 0}
+	clientsMux.Lock()
+	for _, client := range clients {
+		connected[client.ClientType]++
+	}
+	online := make(map[string]bool, len(onlineAccounts))
+	for name := range onlineAccounts {
+		online[name] = true
+	}
+	remote := allRemoteSessions()
+	for _, session := range remote {
+		online[session.Account] = true
+	}
+	accountCount, roomCount := len(online), len(rooms)
+	clientsMux.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"uptime":             time.Since(startTime).Round(time.Second).String(),
+		"clients":            connected,
+		"remote_clients":     len(remote),
+		"online_accounts":    accountCount,
+		"rooms":              roomCount,
+		"messages_received":  metricMessagesReceived.Total(),
+		"messages_broadcast": metricMessagesBroadcast.Load(),
+		"heartbeat_timeouts": metricHeartbeatTimeouts.Load(),
+		"goroutines":         runtime.NumGoroutine(),
+	})
+}
+
+func handleAdminClients(w http.ResponseWriter, r *http.Request) {
+	type session struct {
+		UID       string     `json:"uid"`
+		User      string     `json:"user"`
+		IP        string     `json:"ip"`
+		Transport string     `json:"transport"`
+		Connected time.Time  `json:"connected"`
+		LastBeat  *time.Time `json:"last_heartbeat,omitempty"`
+		Node      string     `json:"node"`
+	}
+
+	/* Sessions of the whole cluster, heartbeats are only known for this node */
+	clientsMux.Lock()
+	sessions := make([]session, 0, len(clients))
+	for _, client := range clients {
+		lastBeat := client.LastBeat
+		sessions = append(sessions, session{client.UID, client.Username, client.IP, client.ClientType, client.Connected, &lastBeat, nodeID})
+	}
+	for _, remote := range allRemoteSessions() {
+		sessions = append(sessions, session{remote.UID, remote.User, remote.IP, remote.Transport, remote.Connected, nil, remote.Node})
+	}
+	clientsMux.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Connected.Before(sessions[j].Connected) })
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func handleAdminRooms(w http.ResponseWriter, r *http.Request) {
+	clientsMux.Lock()
+	list := make([]Room, 0, len(rooms))
+	for _, room := range rooms {
+		copied := *room
+		copied.Members = maps.Clone(room.Members)
+		list = append(list, copied)
+	}
+	clientsMux.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, list)
+}
+
+/* GET /admin/history?room=<room>&limit=<n>, the main chat when room is empty */
+func handleAdminHistory(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+			return
+		}
+		limit = n
+	}
+	room := strings.ToLower(strings.TrimPrefix(r.URL.Query().Get("room"), "#"))
+	writeJSON(w, http.StatusOK, recentHistory(room, limit))
+}
+
+/* POST /admin/kick {"user": "...", "uid": "...", "reason": "..."}, disconnects one session or every session of a user */
+func handleAdminKick(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		User   string `json:"user"`
+		UID    string `json:"uid"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.User == "" && req.UID == "") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "user or uid is required"})
+		return
+	}
+
+	reason := "You have been disconnected by an administrator."
+	if req.Reason != "" {
+		reason = "You have been disconnected by an administrator: " + req.Reason
+	}
+
+	clientsMux.Lock()
+	var kicked []string
+	for uid, client := range clients {
+		if uid == req.UID || (req.User != "" && client.Account.Name == accountKey(req.User)) {
+			disconnect(client, reason)
+			kicked = append(kicked, uid)
+		}
+	}
+	clientsMux.Unlock()
+
+	if len(kicked) == 0 {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no matching session"})
+		return
+	}
+	slog.Info("Kicked sessions", "uids", kicked, "reason", req.Reason)
+	writeJSON(w, http.StatusOK, map[string]any{"kicked": kicked})
+}
+
+func handleAdminBans(w http.ResponseWriter, r *http.Request) {
+	bansMux.Lock()
+	defer bansMux.Unlock()
+
+	writeJSON(w, http.StatusOK, bans)
+}
+
+/* POST /admin/bans {"user": "...", "ip": "...", "reason": "...", "duration": "24h"}, permanent without a duration */
+func handleAdminBan(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		User     string `json:"user"`
+		IP       string `json:"ip"`
+		Reason   string `json:"reason"`
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.User == "" && req.IP == "") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "user or ip is required"})
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	ban := &Ban{
+		ID:      hex.EncodeToString(id),
+		User:    accountKey(req.User),
+		IP:      req.IP,
+		Reason:  req.Reason,
+		Created: time.Now().Unix(),
+	}
+	if req.Duration != "" {
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid duration"})
+			return
+		}
+		ban.Expires = time.Now().Add(duration).Unix()
+	}
+
+	bansMux.Lock()
+	bans = append(bans, ban)
+	saveBans()
+	bansMux.Unlock()
+
+	/* Banned users are dropped right away, and cannot resume their sessions */
+	clientsMux.Lock()
+	for _, client := range clients {
+		if ban.matches(client.Username, client.IP) {
+			if client.Token != nil {
+				revokeSessionToken(client.Token.ID, client.Token.Expires)
+			}
+			disconnect(client, ban.notice())
+		}
+	}
+	clientsMux.Unlock()
+
+	slog.Info("Added ban", "id", ban.ID, "username", ban.User, "ip", ban.IP, "reason", ban.Reason)
+	writeJSON(w, http.StatusCreated, ban)
+}
+
+func handleAdminUnban(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	bansMux.Lock()
+	defer bansMux.Unlock()
+
+	for i, ban := range bans {
+		if ban.ID == id {
+			bans = slices.Delete(bans, i, i+1)
+			saveBans()
+			slog.Info("Removed ban", "id", id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such ban"})
+}
+
+/* POST /admin/broadcast {"content": "...", "room": "..."}, a system message to everyone or to one room */
+func handleAdminBroadcast(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Content string `json:"content"`
+		Room    string `json:"room"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Content == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "content is required"})
+		return
+	}
+
+	msg := Message{Type: "system", Content: "[Admin] " + req.Content}
+	if req.Room != "" {
+		name, err := roomName(req.Room)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		msg.Room = name
+	}
+	broadcast(msg, "")
+	writeJSON(w, http.StatusOK, map[string]string{"status": "sent"})
+}
+
+func webhooksPath() string {
+	return filepath.Join(*dataDir, "webhooks.json")
+}
+
+/* Load the outgoing webhooks and start the delivery workers */
+func initWebhooks() error {
+	data, err := os.ReadFile(webhooksPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	} else if err == nil {
+		if err := json.Unmarshal(data, &webhooks); err != nil {
+			return err
+		}
+	}
+
+	webhookQueue = make(chan webhookDelivery, *webhookQueueSize)
+	for i := 0; i < 4; i++ {
+		go webhookWorker()
+	}
+	return nil
+}
+
+/* Persist the webhook list, the caller must hold webhooksMux */
+func saveWebhooks() {
+	data, _ := json.MarshalIndent(webhooks, "", "  ")
+	if err := os.WriteFile(webhooksPath(), data, 0600); err != nil {
+		slog.Error("Failed to save webhooks", "error", err)
+	}
+}
+
+/* The events a webhook can subscribe to */
+var webhookEvents = []string{"chat", "join", "leave", "room_join", "room_leave", "mention"}
+
+func (h *Webhook) wants(event string, room string) bool {
+	if len(h.Events) > 0 && !slices.Contains(h.Events, event) {
+		return false
+	}
+	return len(h.Rooms) == 0 || slices.Contains(h.Rooms, room)
+}
+
+/*
+ * Queue a chat event for every webhook that subscribes to it. This is called
+ * from broadcast with clientsMux held, so it never blocks: events are dropped
+ * and logged when the queue is full.
+ */
+func emitWebhookEvent(event string, msg Message) {
+	if webhookQueue == nil {
+		return
+	}
+
+	/* The server cannot read end-to-end encrypted messages, only their metadata is sent */
+	msg.E2E = nil
+	if msg.Time == 0 {
+		msg.Time = time.Now().UnixMilli()
+	}
+
+	webhooksMux.Lock()
+	defer webhooksMux.Unlock()
+
+	for _, hook := range webhooks {
+		if !hook.wants(event, msg.Room) {
+			continue
+		}
+
+		id := make([]byte, 8)
+		rand.Read(id)
+		delivery := webhookDelivery{
+			ID:      hex.EncodeToString(id),
+			Webhook: hook,
+			Event:   event,
+			Message: msg,
+		}
+		select {
+		case webhookQueue <- delivery:
+		default:
+			logWebhookDelivery(delivery, 0, 0, errors.New("delivery queue full"))
+		}
+	}
+}
+
+func webhookWorker() {
+	for delivery := range webhookQueue {
+		delivery.send()
+	}
+}
+
+/* POST the event, retrying with exponential backoff on network errors and 5xx/429 replies */
+func (d webhookDelivery) send() {
+	body, _ := json.Marshal(map[string]any{
+		"id":      d.ID,
+		"event":   d.Event,
+		"message": d.Message,
+	})
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	/* Receivers check the signature over "<timestamp>.<body>" and reject stale timestamps */
+	mac := hmac.New(sha256.New, []byte(d.Webhook.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	backoff := webhookBackoff
+	var status, attempts int
+	var err error
+	for attempts < webhookAttempts {
+		attempts++
+		status, err = d.post(body, timestamp, signature)
+		if err == nil && status < 300 {
+			logWebhookDelivery(d, attempts, status, nil)
+			return
+		}
+		if err == nil && status < 500 && status != http.StatusTooManyRequests {
+			break
+		}
+		if attempts < webhookAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("unexpected status %d", status)
+	}
+	logWebhookDelivery(d, attempts, status, err)
+}
+
+func (d webhookDelivery) post(body []byte, timestamp string, signature string) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, d.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Paizer-Webhook/1")
+	req.Header.Set("X-Paizer-Event", d.Event)
+	req.Header.Set("X-Paizer-Delivery", d.ID)
+	req.Header.Set("X-Paizer-Timestamp", timestamp)
+	req.Header.Set("X-Paizer-Signature", signature)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+/* Record the outcome of a delivery in the log served by the admin API */
+func logWebhookDelivery(d webhookDelivery, attempts int, status int, err error) {
+	entry := webhookLogEntry{
+		ID:       d.ID,
+		Webhook:  d.Webhook.ID,
+		Event:    d.Event,
+		Attempts: attempts,
+		Status:   status,
+		Time:     time.Now().Unix(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		slog.Warn("Webhook delivery failed", "webhook", d.Webhook.ID, "event", d.Event, "error", err)
+	}
+
+	webhookLogMux.Lock()
+	defer webhookLogMux.Unlock()
+
+	webhookLog = append(webhookLog, entry)
+	if len(webhookLog) > maxWebhookLog {
+		webhookLog = webhookLog[len(webhookLog)-maxWebhookLog:]
+	}
+}
+
+func handleAdminWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooksMux.Lock()
+	defer webhooksMux.Unlock()
+
+	/* Secrets are only shown when a webhook is created */
+	list := make([]Webhook, 0, len(webhooks))
+	for _, hook := range webhooks {
+		copied := *hook
+		copied.Secret = ""
+		list = append(list, copied)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+/* POST /admin/webhooks {"url": "...", "events": [...], "rooms": [...], "secret": "..."}, a secret is generated when none is given */
+func handleAdminAddWebhook(w http.ResponseWriter, r *http.Request) {
+	var hook Webhook
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if target, err := url.Parse(hook.URL); err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "url must be an http or https URL"})
+		return
+	}
+	for _, event := range hook.Events {
+		if !slices.Contains(webhookEvents, event) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unknown event " + event})
+			return
+		}
+	}
+	for i, room := range hook.Rooms {
+		hook.Rooms[i] = strings.ToLower(strings.TrimPrefix(room, "#"))
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	hook.ID = hex.EncodeToString(id)
+	if hook.Secret == "" {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		hook.Secret = hex.EncodeToString(secret)
+	}
+	hook.Created = time.Now().Unix()
+
+	webhooksMux.Lock()
+	webhooks = append(webhooks, &hook)
+	saveWebhooks()
+	webhooksMux.Unlock()
+
+	slog.Info("Added webhook", "webhook", hook.ID, "url", hook.URL, "events", hook.Events, "rooms", hook.Rooms)
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+func handleAdminDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	webhooksMux.Lock()
+	defer webhooksMux.Unlock()
+
+	for i, hook := range webhooks {
+		if hook.ID == id {
+			webhooks = slices.Delete(webhooks, i, i+1)
+			saveWebhooks()
+			slog.Info("Removed webhook", "webhook", id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such webhook"})
+}
+
+/* GET /admin/webhooks/log, the most recent delivery results */
+func handleAdminWebhookLog(w http.ResponseWriter, r *http.Request) {
+	webhookLogMux.Lock()
+	defer webhookLogMux.Unlock()
+
+	writeJSON(w, http.StatusOK, webhookLog)
+}
+
+func incomingWebhooksPath() string {
+	return filepath.Join(*dataDir, "incoming_webhooks.json")
+}
+
+func initIncomingWebhooks() error {
+	data, err := os.ReadFile(incomingWebhooksPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &incomingWebhooks)
+}
+
+/* Persist the incoming webhooks, the caller must hold incomingMux */
+func saveIncomingWebhooks() {
+	data, _ := json.MarshalIndent(incomingWebhooks, "", "  ")
+	if err := os.WriteFile(incomingWebhooksPath(), data, 0600); err != nil {
+		slog.Error("Failed to save incoming webhooks", "error", err)
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+/* Token bucket refilled at -incoming-rate messages per minute, the caller must hold incomingMux */
+func (h *IncomingWebhook) allow() bool {
+	rate := float64(*incomingRate) / 60
+	now := time.Now()
+	if h.last.IsZero() {
+		h.tokens = float64(*incomingRate)
+	} else {
+		h.tokens = min(float64(*incomingRate), h.tokens+now.Sub(h.last).Seconds()*rate)
+	}
+	h.last = now
+
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+/*
+ * POST /hooks/{id}/{token} {"content": "..."}, posts a message to the webhook's
+ * room as its bot. "text" is accepted as well for tools that send Slack style payloads.
+ */
+func handleIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	incomingMux.Lock()
+	var hook *IncomingWebhook
+	for _, candidate := range incomingWebhooks {
+		if candidate.ID == r.PathValue("id") && hmac.Equal([]byte(candidate.TokenHash), []byte(hashToken(r.PathValue("token")))) {
+			hook = candidate
+		}
+	}
+	allowed := hook != nil && hook.allow()
+	var bot IncomingWebhook
+	if hook != nil {
+		bot = *hook
+	}
+	incomingMux.Unlock()
+
+	if hook == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown webhook"})
+		return
+	}
+	if !allowed {
+		metricRateLimited.Add(1)
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, 60 / *incomingRate)))
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "rate limit exceeded"})
+		return
+	}
+
+	var req struct {
+		Content string `json:"content"`
+		Text    string `json:"text"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	content := strings.TrimSpace(req.Content + req.Text)
+	if content == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "content is required"})
+		return
+	}
+
+	if bot.Room != "" {
+		clientsMux.Lock()
+		room, exists := rooms[bot.Room]
+		encrypted := exists && room.Encrypted
+		clientsMux.Unlock()
+		if !exists {
+			writeJSON(w, http.StatusGone, map[string]string{"error": "the room no longer exists"})
+			return
+		}
+		if encrypted {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "the room is end-to-end encrypted"})
+			return
+		}
+	}
+
+	/* Bots are not connected, they get a session of their own that is never registered */
+	err := postChat(&Client{
+		UID:        "webhook-" + bot.ID,
+		Username:   bot.Name,
+		IP:         "webhook",
+		ClientType: "webhook",
+		Account:    &Account{Name: accountKey(bot.Name)},
+	}, bot.Room, content)
+	if err != nil {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "sent"})
+}
+
+func handleAdminIncomingWebhooks(w http.ResponseWriter, r *http.Request) {
+	incomingMux.Lock()
+	defer incomingMux.Unlock()
+
+	writeJSON(w, http.StatusOK, incomingWebhooks)
+}
+
+/* POST /admin/incoming {"room": "...", "name": "..."}, the URL with its secret token is only returned here */
+func handleAdminAddIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Room string `json:"room"`
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.Name == "" {
+		req.Name = "bot"
+	}
+	if req.Room != "" {
+		name, err := roomName(req.Room)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		clientsMux.Lock()
+		_, exists := rooms[name]
+		clientsMux.Unlock()
+		if !exists {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such room"})
+			return
+		}
+		req.Room = name
+	}
+
+	id := make([]byte, 8)
+	token := make([]byte, 24)
+	rand.Read(id)
+	rand.Read(token)
+	hook := &IncomingWebhook{
+		ID:        hex.EncodeToString(id),
+		Room:      req.Room,
+		Name:      req.Name,
+		TokenHash: hashToken(hex.EncodeToString(token)),
+		Created:   time.Now().Unix(),
+	}
+
+	incomingMux.Lock()
+	incomingWebhooks = append(incomingWebhooks, hook)
+	saveIncomingWebhooks()
+	incomingMux.Unlock()
+
+	slog.Info("Added incoming webhook", "webhook", hook.ID, "room", hook.Room, "name", hook.Name)
+	writeJSON(w, http.StatusCreated, map[string]any{
+		"webhook": hook,
+		"path":    "/hooks/" + hook.ID + "/" + hex.EncodeToString(token),
+	})
+}
+
+func handleAdminDeleteIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	incomingMux.Lock()
+	defer incomingMux.Unlock()
+
+	for i, hook := range incomingWebhooks {
+		if hook.ID == id {
+			incomingWebhooks = slices.Delete(incomingWebhooks, i, i+1)
+			saveIncomingWebhooks()
+			slog.Info("Revoked incoming webhook", "webhook", id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such webhook"})
+}
+
+/*
+ * Server plugins add policies to the message path without changing it. They are
+ * called in registration order from the connection goroutines, so they must be
+ * safe for concurrent use and must not block for long.
+ *
+ * Filter sees every inbound chat, file and direct message before it is relayed.
+ * It may change the message, annotate it with msg.Annotate, or return an error
+ * to reject it, the error text is shown to the sender. Connect and Join may
+ * refuse a login or a room join the same way.
+ */
+type Plugin interface {
+	Name() string
+	Connect(client *Client) error // Before the session is announced, Account is not set yet
+	Disconnect(client *Client)
+	Join(client *Client, room string) error // Before the client creates or joins a room
+	Leave(client *Client, room string)
+	Filter(client *Client, msg *Message) error
+}
+
+/* No-op implementations for plugins to embed, so they only define the hooks they need */
+type BasePlugin struct{}
+
+func (BasePlugin) Connect(client *Client) error              { return nil }
+func (BasePlugin) Disconnect(client *Client)                 {}
+func (BasePlugin) Join(client *Client, room string) error    { return nil }
+func (BasePlugin) Leave(client *Client, room string)         {}
+func (BasePlugin) Filter(client *Client, msg *Message) error { return nil }
+
+/* Add a plugin to the chain, only before the listeners start */
+func registerPlugin(p Plugin) {
+	plugins = append(plugins, p)
+	slog.Info("Registered plugin", "plugin", p.Name())
+}
+
+/* Attach a key/value note to a message, delivered to clients and webhooks with it */
+func (m *Message) Annotate(key string, value string) {
+	if m.Annotations == nil {
+		m.Annotations = make(map[string]string)
+	}
+	m.Annotations[key] = value
+}
+
+/* Run an inbound message through the plugin chain, stopping at the first rejection */
+func filterMessage(client *Client, msg *Message) error {
+	for _, p := range plugins {
+		if err := p.Filter(client, msg); err != nil {
+			client.logger().Info("Message rejected by plugin", "plugin", p.Name(), "type", msg.Type, "reason", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func pluginsConnect(client *Client) error {
+	for _, p := range plugins {
+		if err := p.Connect(client); err != nil {
+			client.logger().Info("Connection refused by plugin", "plugin", p.Name(), "reason", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func pluginsDisconnect(client *Client) {
+	for _, p := range plugins {
+		p.Disconnect(client)
+	}
+}
+
+func pluginsJoin(client *Client, room string) error {
+	for _, p := range plugins {
+		if err := p.Join(client, room); err != nil {
+			client.logger().Info("Room join refused by plugin", "plugin", p.Name(), "room", room, "reason", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func pluginsLeave(client *Client, room string) {
+	for _, p := range plugins {
+		p.Leave(client, room)
+	}
+}
+
+func rejectNotice(client *Client, err error) {
+	roomNotice(client, "Your message was rejected: "+err.Error())
+}
+
+/* Built-in plugin that masks blocked words in chat and direct messages */
+type wordFilter struct {
+	BasePlugin
+	pattern *regexp.Regexp
+}
+
+func newWordFilter(list string) *wordFilter {
+	var words []string
+	for _, word := range strings.Split(list, ",") {
+		if word = strings.TrimSpace(word); word != "" {
+			words = append(words, regexp.QuoteMeta(word))
+		}
+	}
+	return &wordFilter{pattern: regexp.MustCompile(`(?i)\b(` + strings.Join(words, "|") + `)\b`)}
+}
+
+func (f *wordFilter) Name() string {
+	return "word-filter"
+}
+
+func (f *wordFilter) Filter(client *Client, msg *Message) error {
+	masked := f.pattern.ReplaceAllStringFunc(msg.Content, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	})
+	if masked != msg.Content {
+		msg.Content = masked
+		msg.Annotate("filtered", "word-filter")
+	}
+	return nil
+}
+
+/*
+ * Clustering: several servers share broadcasts, presence, rooms and identity keys
+ * through a backplane. Every node publishes the changes it makes and applies the
+ * events of the others, clients stay connected to a single node.
+ */
+type Backplane interface {
+	Publish(ev ClusterEvent)                 // Send to every other node, must not block
+	Subscribe(handler func(ev ClusterEvent)) // Receive the events of the other nodes, one at a time
+	Close() error
+}
+
+type ClusterEvent struct {
+	Node     string                 `json:"node"`
+	Kind     string                 `json:"kind"` // See handleClusterEvent, "peer_up" and "peer_down" come from the backplane itself
+	Msg      *Message               `json:"msg,omitempty"`
+	Exclude  string                 `json:"exclude,omitempty"` // UID that does not receive a broadcast
+	Account  string                 `json:"account,omitempty"`
+	Session  *RemoteSession         `json:"session,omitempty"`
+	Sessions []RemoteSession        `json:"sessions,omitempty"`
+	Rooms    []*Room                `json:"rooms,omitempty"`
+	Keys     map[string][]DeviceKey `json:"keys,omitempty"`
+	Roles    map[string]string      `json:"roles,omitempty"`   // Server roles by account name
+	Updated  int64                  `json:"updated,omitempty"` // When Roles last changed, Unix milliseconds
+}
+
+/* A session connected to another node */
+type RemoteSession struct {
+	UID       string    `json:"uid"`
+	User      string    `json:"user"`
+	Account   string    `json:"account"`
+	IP        string    `json:"ip"`
+	Transport string    `json:"transport"`
+	Connected time.Time `json:"connected"`
+	Node      string    `json:"node"`
+}
+
+func initCluster() error {
+	nodeID = *nodeName
+	if nodeID == "" {
+		nodeID, _ = os.Hostname()
+	}
+
+	if *clusterAddr == "" {
+		/* A single node, nothing is listening on the other side of the hub */
+		backplane = NewMemoryHub().Attach(nodeID)
+	} else {
+		var peers []string
+		for _, peer := range strings.Split(*clusterPeers, ",") {
+			if peer = strings.TrimSpace(peer); peer != "" {
+				peers = append(peers, peer)
+			}
+		}
+		mesh, err := newMeshBackplane(nodeID, *clusterAddr, peers, *clusterSecret)
+		if err != nil {
+			return err
+		}
+		backplane = mesh
+		slog.Info("Cluster mesh listening", "node", nodeID, "addr", *clusterAddr, "peers", peers)
+	}
+	backplane.Subscribe(handleClusterEvent)
+	return nil
+}
+
+func publishCluster(ev ClusterEvent) {
+	ev.Node = nodeID
+	backplane.Publish(ev)
+}
+
+func localSession(client *Client) *RemoteSession {
+	return &RemoteSession{client.UID, client.Username, client.Account.Name, client.IP, client.ClientType, client.Connected, nodeID}
+}
+
+/* Whether an account has sessions on other nodes, the caller must hold clientsMux */
+func remoteOnline(account string) bool {
+	for _, sessions := range remoteSessions {
+		for _, session := range sessions {
+			if session.Account == account {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* Sessions connected to other nodes, the caller must hold clientsMux */
+func allRemoteSessions() []RemoteSession {
+	var list []RemoteSession
+	for _, sessions := range remoteSessions {
+		for _, session := range sessions {
+			list = append(list, session)
+		}
+	}
+	return list
+}
+
+/* Mark a room as changed, save it and share it with the other nodes. The caller must hold clientsMux */
+func roomChanged(room *Room) {
+	room.Updated = time.Now().UnixMilli()
+	saveRooms()
+	publishCluster(ClusterEvent{Kind: "room", Rooms: []*Room{room}})
+}
+
+/* Keep the newest version of each room, the caller must hold clientsMux */
+func mergeRooms(list []*Room) {
+	changed := false
+	for _, room := range list {
+		if room.Members == nil {
+			room.Members = make(map[string]bool)
+		}
+		if existing := rooms[room.Name]; existing == nil || room.Updated > existing.Updated {
+			rooms[room.Name] = room
+			if room.Deleted {
+				delete(rooms, room.Name)
+			}
+			changed = true
+		}
+	}
+	if changed {
+		saveRooms()
+	}
+}
+
+/*
+ * Add the identity keys another node knows about, the caller must hold keysMux.
+ * Keys are not evicted here, each node only makes room for a key it accepts itself.
+ */
+func mergeKeys(keys map[string][]DeviceKey) {
+	changed := false
+	for name, list := range keys {
+		for _, key := range list {
+			i := slices.IndexFunc(deviceKeys[name], func(existing DeviceKey) bool { return existing.Device == key.Device })
+			if i < 0 {
+				deviceKeys[name] = append(deviceKeys[name], key)
+				changed = true
+			} else if key.Seen > deviceKeys[name][i].Seen {
+				deviceKeys[name][i].Seen = key.Seen
+				changed = true
+			}
+		}
+		sort.SliceStable(deviceKeys[name], func(i, j int) bool { return deviceKeys[name][i].Published < deviceKeys[name][j].Published })
+	}
+	if changed {
+		saveKeys()
+	}
+}
+
+/* Everything a node shares, sent to a peer when it connects */
+func clusterSnapshot() ClusterEvent {
+	ev := ClusterEvent{Kind: "sync", Sessions: []RemoteSession{}}
+
+	clientsMux.Lock()
+	for _, client := range clients {
+		ev.Sessions = append(ev.Sessions, *localSession(client))
+	}
+	for _, room := range rooms {
+		copied := *room
+		copied.Members = maps.Clone(room.Members)
+		copied.Roles = maps.Clone(room.Roles)
+		copied.Invited = maps.Clone(room.Invited)
+		copied.Requests = maps.Clone(room.Requests)
+		copied.Invites = slices.Clone(room.Invites)
+		ev.Rooms = append(ev.Rooms, &copied)
+	}
+	ev.Roles, ev.Updated = maps.Clone(serverRoles), rolesUpdated
+	clientsMux.Unlock()
+
+	keysMux.Lock()
+	ev.Keys = make(map[string][]DeviceKey, len(deviceKeys))
+	for name, keys := range deviceKeys {
+		ev.Keys[name] = slices.Clone(keys)
+	}
+	keysMux.Unlock()
+	return ev
+}
+
+/*
+ * Apply an event published by another node:
+ *   broadcast     deliver Msg to the local clients, except Exclude
+ *   account       deliver Msg to the local sessions of Account
+ *   session_up    a session connected to the node
+ *   session_down  a session of the node disconnected
+ *   room          rooms were created or their members changed
+ *   keys          identity keys were published
+ *   roles         server roles were granted or taken away
+ *   sync          full state of the node, sent when it connects
+ */
+func handleClusterEvent(ev ClusterEvent) {
+	if ev.Node == nodeID {
+		return
+	}
+
+	switch ev.Kind {
+	case "peer_up":
+		slog.Info("Cluster peer connected", "node", ev.Node)
+		publishCluster(clusterSnapshot())
+
+	case "peer_down":
+		slog.Info("Cluster peer disconnected", "node", ev.Node)
+		clientsMux.Lock()
+		delete(remoteSessions, ev.Node)
+		clientsMux.Unlock()
+
+	case "broadcast":
+		if ev.Msg == nil {
+			return
+		}
+		clientsMux.Lock()
+		deliverLocal(*ev.Msg, ev.Exclude)
+		clientsMux.Unlock()
+		notifyMentions(*ev.Msg)
+
+	case "account":
+		if ev.Msg == nil {
+			return
+		}
+		clientsMux.Lock()
+		if account := onlineAccounts[ev.Account]; account != nil {
+			for _, session := range account.Sessions {
+				sendMessage(session, *ev.Msg)
+			}
+		}
+		clientsMux.Unlock()
+
+	case "session_up", "session_down":
+		if ev.Session == nil {
+			return
+		}
+		clientsMux.Lock()
+		if remoteSessions[ev.Node] == nil {
+			remoteSessions[ev.Node] = make(map[string]RemoteSession)
+		}
+		if ev.Kind == "session_up" {
+			remoteSessions[ev.Node][ev.Session.UID] = *ev.Session
+		} else {
+			delete(remoteSessions[ev.Node], ev.Session.UID)
+		}
+		clientsMux.Unlock()
+
+	case "room":
+		clientsMux.Lock()
+		mergeRooms(ev.Rooms)
+		clientsMux.Unlock()
+
+	case "keys":
+		keysMux.Lock()
+		mergeKeys(ev.Keys)
+		keysMux.Unlock()
+
+	case "roles":
+		clientsMux.Lock()
+		mergeRoles(ev.Roles, ev.Updated)
+		clientsMux.Unlock()
+
+	case "sync":
+		clientsMux.Lock()
+		sessions := make(map[string]RemoteSession, len(ev.Sessions))
+		for _, session := range ev.Sessions {
+			sessions[session.UID] = session
+		}
+		remoteSessions[ev.Node] = sessions
+		mergeRooms(ev.Rooms)
+		mergeRoles(ev.Roles, ev.Updated)
+		clientsMux.Unlock()
+
+		keysMux.Lock()
+		mergeKeys(ev.Keys)
+		keysMux.Unlock()
+	}
+}
+
+/* In-process backplane, the nodes attached to the same hub receive each other's events */
+type MemoryHub struct {
+	mu    sync.Mutex
+	nodes []*memoryBackplane
+}
+
+type memoryBackplane struct {
+	hub    *MemoryHub
+	node   string
+	events chan ClusterEvent
+	once   sync.Once
+}
+
+func NewMemoryHub() *MemoryHub {
+	return &MemoryHub{}
+}
+
+/* Add a node to the hub, the nodes already attached see it come up and it sees them */
+func (h *MemoryHub) Attach(node string) Backplane {
+	b := &memoryBackplane{hub: h, node: node, events: make(chan ClusterEvent, 1024)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, other := range h.nodes {
+		other.deliver(ClusterEvent{Node: node, Kind: "peer_up"})
+		b.deliver(ClusterEvent{Node: other.node, Kind: "peer_up"})
+	}
+	h.nodes = append(h.nodes, b)
+	return b
+}
+
+func (b *memoryBackplane) deliver(ev ClusterEvent) {
+	select {
+	case b.events <- ev:
+	default:
+		slog.Warn("Cluster event dropped, the node is not keeping up", "node", b.node, "kind", ev.Kind)
+	}
+}
+
+/* Events are copied through JSON like on the wire, so nodes never share memory */
+func (b *memoryBackplane) Publish(ev ClusterEvent) {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+
+	/* A single node has nobody to copy the event for */
+	if len(b.hub.nodes) < 2 {
+		return
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	for _, other := range b.hub.nodes {
+		if other != b {
+			var copied ClusterEvent
+			json.Unmarshal(data, &copied)
+			other.deliver(copied)
+		}
+	}
+}
+
+func (b *memoryBackplane) Subscribe(handler func(ev ClusterEvent)) {
+	b.once.Do(func() {
+		go func() {
+			for ev := range b.events {
+				handler(ev)
+			}
+		}()
+	})
+}
+
+func (b *memoryBackplane) Close() error {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+
+	b.hub.nodes = slices.DeleteFunc(b.hub.nodes, func(other *memoryBackplane) bool { return other == b })
+	for _, other := range b.hub.nodes {
+		other.deliver(ClusterEvent{Node: b.node, Kind: "peer_down"})
+	}
+	return nil
+}
+
+/*
+ * TCP peer mesh: every node dials every peer over TLS and sends its events as JSON
+ * lines, events from the peers arrive on the connections they dial in. A connection
+ * starts with a challenge-response in which both sides prove they know the
+ * cluster secret, the nonces keep a recorded handshake from being replayed:
+ *   acceptor -> {"nonce":"<hex>"}
+ *   dialer   -> {"node":"<name>","nonce":"<hex>","auth":"<HMAC>"}
+ *   acceptor -> {"auth":"<HMAC>"}
+ * See meshBackplane.auth for what the HMACs cover. TLS keeps the events after the
+ * handshake from being read or changed on the way.
+ */
+type meshBackplane struct {
+	node     string
+	secret   string
+	tls      *tls.Config   // Self-signed, the handshake authenticates the peers
+	listener net.Listener  // Accepts TLS connections
+	peers    []chan []byte // Outgoing queue per peer
+
+	mu      sync.Mutex
+	inbound map[string]net.Conn // Current connection from each node
+	handler func(ev ClusterEvent)
+	closed  chan struct{}
+}
+
+type meshHello struct {
+	Node  string `json:"node,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+	Auth  string `json:"auth,omitempty"`
+}
+
+func newMeshBackplane(node string, addr string, peers []string, secret string) (*meshBackplane, error) {
+	if secret == "" {
+		return nil, errors.New("the cluster mesh needs -cluster-secret or PAIZER_CLUSTER_SECRET")
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	config, err := newSelfSignedTLS(node, key)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &meshBackplane{
+		node:     node,
+		secret:   secret,
+		tls:      config,
+		listener: tls.NewListener(listener, config),
+		inbound:  make(map[string]net.Conn),
+		closed:   make(chan struct{}),
+	}
+	for _, peer := range peers {
+		queue := make(chan []byte, 4096)
+		m.peers = append(m.peers, queue)
+		go m.dial(peer, queue)
+	}
+	go m.accept()
+	return m, nil
+}
+
+/*
+ * The proof of one side of a handshake, role is "dialer" or "acceptor" so neither
+ * proof can be reflected. The binding comes from the TLS session, so a proof cannot
+ * be relayed by someone who ends the TLS sessions of both sides.
+ */
+func (m *meshBackplane) auth(role string, node string, acceptorNonce string, dialerNonce string, binding string) string {
+	mac := hmac.New(sha256.New, []byte(m.secret))
+	fmt.Fprintf(mac, "paizer-cluster/2|%s|%s|%s|%s|%s", role, node, acceptorNonce, dialerNonce, binding)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func readMeshHello(reader *bufio.Reader) (meshHello, error) {
+	var hello meshHello
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return hello, err
+	}
+	return hello, json.Unmarshal(line, &hello)
+}
+
+func writeMeshHello(conn net.Conn, hello meshHello) error {
+	data, _ := json.Marshal(hello)
+	_, err := conn.Write(append(data, '\n'))
+	return err
+}
+
+/* Answer the challenge of the peer that was dialed and check that it knows the secret as well */
+func (m *meshBackplane) greet(conn *tls.Conn) error {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	binding, err := tlsBinding(conn, "EXPORTER-paizer-cluster")
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	challenge, err := readMeshHello(reader)
+	if err != nil {
+		return err
+	}
+	nonce := newNonce()
+	if err := writeMeshHello(conn, meshHello{Node: m.node, Nonce: nonce, Auth: m.auth("dialer", m.node, challenge.Nonce, nonce, binding)}); err != nil {
+		return err
+	}
+	reply, err := readMeshHello(reader)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(reply.Auth), []byte(m.auth("acceptor", m.node, challenge.Nonce, nonce, binding))) {
+		return errors.New("the peer does not know the cluster secret")
+	}
+	return nil
+}
+
+func (m *meshBackplane) Publish(ev ClusterEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	for _, queue := range m.peers {
+		select {
+		case queue <- data:
+		default:
+			slog.Warn("Cluster event dropped, a peer is not keeping up", "kind", ev.Kind)
+		}
+	}
+}
+
+func (m *meshBackplane) Subscribe(handler func(ev ClusterEvent)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.handler = handler
+}
+
+func (m *meshBackplane) emit(ev ClusterEvent) {
+	m.mu.Lock()
+	handler := m.handler
+	m.mu.Unlock()
+
+	if handler != nil {
+		handler(ev)
+	}
+}
+
+func (m *meshBackplane) Close() error {
+	close(m.closed)
+
+	m.mu.Lock()
+	for _, conn := range m.inbound {
+		conn.Close()
+	}
+	m.mu.Unlock()
+	return m.listener.Close()
+}
+
+/* Keep a connection to a peer open and write the queued events to it */
+func (m *meshBackplane) dial(addr string, queue chan []byte) {
+	backoff := time.Second
+	for {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, m.tls)
+		if err == nil {
+			if err = m.greet(conn); err != nil {
+				slog.Warn("Cluster peer failed to authenticate", "peer", addr, "error", err)
+				conn.Close()
+			}
+		}
+		if err != nil {
+			slog.Debug("Unable to reach cluster peer", "peer", addr, "error", err)
+			select {
+			case <-m.closed:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, 10*time.Second)
+			continue
+		}
+		backoff = time.Second
+
+		/* The peer never writes back, reading notices when it goes away even while idle */
+		dropped := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, conn)
+			close(dropped)
+		}()
+
+		for err == nil {
+			select {
+			case <-m.closed:
+				conn.Close()
+				return
+			case <-dropped:
+				err = io.EOF
+			case data := <-queue:
+				_, err = conn.Write(data)
+			}
+		}
+		slog.Warn("Lost connection to cluster peer", "peer", addr, "error", err)
+		conn.Close()
+	}
+}
+
+func (m *meshBackplane) accept() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			select {
+			case <-m.closed:
+			default:
+				slog.Error("Cluster listener stopped", "error", err)
+			}
+			return
+		}
+		go m.receive(conn.(*tls.Conn))
+	}
+}
+
+/* Read the events of one peer until its connection drops */
+func (m *meshBackplane) receive(conn *tls.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	binding, err := tlsBinding(conn, "EXPORTER-paizer-cluster")
+	if err != nil {
+		return
+	}
+	challenge := newNonce()
+	if writeMeshHello(conn, meshHello{Nonce: challenge}) != nil {
+		return
+	}
+	hello, err := readMeshHello(reader)
+	if err != nil || hello.Node == "" || hello.Nonce == "" || !hmac.Equal([]byte(hello.Auth), []byte(m.auth("dialer", hello.Node, challenge, hello.Nonce, binding))) {
+		slog.Warn("Rejected cluster peer", "ip", conn.RemoteAddr().String())
+		return
+	}
+	if writeMeshHello(conn, meshHello{Auth: m.auth("acceptor", hello.Node, challenge, hello.Nonce, binding)}) != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	/* A peer that reconnects replaces its previous connection */
+	m.mu.Lock()
+	if previous := m.inbound[hello.Node]; previous != nil {
+		previous.Close()
+	}
+	m.inbound[hello.Node] = conn
+	m.mu.Unlock()
+	m.emit(ClusterEvent{Node: hello.Node, Kind: "peer_up"})
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		var ev ClusterEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			slog.Warn("Invalid cluster event", "node", hello.Node, "error", err)
+			continue
+		}
+		ev.Node = hello.Node
+		m.emit(ev)
+	}
+
+	m.mu.Lock()
+	current := m.inbound[hello.Node] == conn
+	if current {
+		delete(m.inbound, hello.Node)
+	}
+	m.mu.Unlock()
+	if current {
+		m.emit(ClusterEvent{Node: hello.Node, Kind: "peer_down"})
+	}
+}
+
+/*
+ * Federation links independent servers. Users of other servers are addressed as
+ * nick@server, direct messages to them are routed to their home server, and a
+ * room can be shared with other servers, which see it as room@home.
+ *
+ * Servers authenticate each other with Ed25519 keys that their admins exchange.
+ * Every server dials each of its peers over TLS and sends its events as JSON lines,
+ * the first lines of a connection are a handshake in which both sides sign both nonces:
+ *   dialer   -> {"type":"hello","version":2,"server":"<name>","nonce":"<hex>"}
+ *   acceptor -> {"type":"hello","version":2,"server":"<name>","nonce":"<hex>","signature":"<base64>"}
+ *   dialer   -> {"type":"auth","signature":"<base64>"}
+ *   acceptor -> {"type":"ready"}
+ * A signature covers "paizer-federation/<version>|<role>|<signer>|<verifier>|<dialer
+ * nonce>|<acceptor nonce>|<binding>". The role ("dialer" or "acceptor") keeps one side's
+ * signature from being passed off as the other's, and the binding is keying material
+ * exported from the TLS session, so the signatures cannot be relayed onto another
+ * session. The TLS certificates are self-signed and not checked for that reason.
+ * After that the dialer sends dm, room_shared, room_unshared, room_message,
+ * room_join, room_leave and room_post messages, see handleFederationMessage.
+ */
+const (
+	federationVersion = 2
+	nicknameAtNotice  = "Nicknames cannot contain '@' on a federated server, it separates the server name."
+)
+
+/* A message of the server-to-server protocol */
+type fedMessage struct {
+	Type      string `json:"type"`
+	Version   int    `json:"version,omitempty"`
+	Server    string `json:"server,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Room      string `json:"room,omitempty"`
+	User      string `json:"user,omitempty"` // Sender, as nick@server
+	To        string `json:"to,omitempty"`   // Recipient nickname on the receiving server
+	Content   string `json:"content,omitempty"`
+	Time      int64  `json:"time,omitempty"`
+}
+
+/* A server we federate with, configured through the admin API */
+type FederationPeer struct {
+	Name      string `json:"name"`
+	Addr      string `json:"addr"`
+	PublicKey string `json:"public_key"` // Base64 Ed25519 public key
+
+	queue     chan []byte
+	stop      chan struct{}
+	connected atomic.Bool
+}
+
+func federationKeyPath() string {
+	return filepath.Join(*dataDir, "federation.key")
+}
+
+func federationPeersPath() string {
+	return filepath.Join(*dataDir, "federation.json")
+}
+
+/* Load or create this server's signing key and the peers, then start the links */
+func initFederation() error {
+	if *federationName == "" {
+		return nil
+	}
+	if _, err := serverName(*federationName); err != nil {
+		return err
+	}
+
+	seed, err := os.ReadFile(federationKeyPath())
+	if errors.Is(err, os.ErrNotExist) {
+		seed = make([]byte, ed25519.SeedSize)
+		rand.Read(seed)
+		err = os.WriteFile(federationKeyPath(), seed, 0600)
+	}
+	if err != nil {
+		return err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return errors.New("invalid federation key file")
+	}
+	federationKey = ed25519.NewKeyFromSeed(seed)
+	if federationTLS, err = newSelfSignedTLS(*federationName, federationKey); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(federationPeersPath())
+	if err == nil {
+		err = json.Unmarshal(data, &federationPeers)
+	} else if errors.Is(err, os.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", *federationAddr)
+	if err != nil {
+		return err
+	}
+	go acceptFederation(tls.NewListener(listener, federationTLS))
+	for _, peer := range federationPeers {
+		startFederationPeer(peer)
+	}
+
+	slog.Info("Federation enabled", "server", *federationName, "addr", *federationAddr,
+		"public_key", base64.StdEncoding.EncodeToString(federationKey.Public().(ed25519.PublicKey)))
+	return nil
+}
+
+/* The caller must hold federationMux */
+func saveFederationPeers() {
+	data, _ := json.Marshal(federationPeers)
+	if err := os.WriteFile(federationPeersPath(), data, 0644); err != nil {
+		slog.Error("Failed to save federation peers", "error", err)
+	}
+}
+
+/* Server names are lower case and may contain letters, digits, '.', '_' and '-' */
+func serverName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || len(name) > 64 {
+		return "", errors.New("server names must be 1 to 64 characters long")
+	}
+	for _, c := range name {
+		if !strings.ContainsRune("abcdefghijklmnopqrstuvwxyz0123456789._-", c) {
+			return "", errors.New("server names may only contain letters, digits, '.', '_' and '-'")
+		}
+	}
+	return name, nil
+}
+
+/* Split nick@server, the server is empty for local users and users of this server */
+func splitAddress(address string) (string, string) {
+	nick, server, found := strings.Cut(address, "@")
+	if !found || strings.EqualFold(server, *federationName) {
+		return nick, ""
+	}
+	return nick, strings.ToLower(server)
+}
+
+/* A local nickname as other servers see it */
+func qualify(user string) string {
+	if strings.Contains(user, "@") {
+		return user
+	}
+	return user + "@" + *federationName
+}
+
+func federationPeer(name string) *FederationPeer {
+	federationMux.Lock()
+	defer federationMux.Unlock()
+
+	for _, peer := range federationPeers {
+		if peer.Name == name {
+			return peer
+		}
+	}
+	return nil
+}
+
+/* Queue a message for a peer, false when the server is not a peer */
+func sendFederation(server string, msg fedMessage) bool {
+	peer := federationPeer(server)
+	if peer == nil {
+		return false
+	}
+	data, _ := json.Marshal(msg)
+	select {
+	case peer.queue <- append(data, '\n'):
+	default:
+		slog.Warn("Federation message dropped, the peer is not keeping up", "server", server, "type", msg.Type)
+	}
+	return true
+}
+
+/* TLS with a self-signed certificate for the federation key, the handshake signatures authenticate the peers */
+/*
+ * A TLS configuration with a self-signed certificate. Peers do not check it, the
+ * federation and cluster handshakes authenticate them and are bound to the session.
+ */
+func newSelfSignedTLS(name string, key ed25519.PrivateKey) (*tls.Config, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates:       []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+	}, nil
+}
+
+/* Keying material of the TLS session, both ends of one session get the same value */
+func tlsBinding(conn *tls.Conn, label string) (string, error) {
+	if err := conn.Handshake(); err != nil {
+		return "", err
+	}
+	state := conn.ConnectionState()
+	material, err := state.ExportKeyingMaterial(label, nil, 32)
+	return hex.EncodeToString(material), err
+}
+
+func federationPayload(role string, signer string, verifier string, dialerNonce string, acceptorNonce string, binding string) []byte {
+	return fmt.Appendf(nil, "paizer-federation/%d|%s|%s|%s|%s|%s|%s", federationVersion, role, signer, verifier, dialerNonce, acceptorNonce, binding)
+}
+
+func verifyFederationSignature(peer *FederationPeer, payload []byte, signature string) bool {
+	key, err1 := base64.StdEncoding.DecodeString(peer.PublicKey)
+	sig, err2 := base64.StdEncoding.DecodeString(signature)
+	if errors.Join(err1, err2) != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(key), payload, sig)
+}
+
+func newNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+func readFedMessage(reader *bufio.Reader) (fedMessage, error) {
+	var msg fedMessage
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return msg, err
+	}
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return msg, err
+	}
+	if msg.Type == "error" {
+		return msg, errors.New(msg.Content)
+	}
+	return msg, nil
+}
+
+func writeFedMessage(conn net.Conn, msg fedMessage) error {
+	data, _ := json.Marshal(msg)
+	_, err := conn.Write(append(data, '\n'))
+	return err
+}
+
+func startFederationPeer(peer *FederationPeer) {
+	peer.queue = make(chan []byte, 1024)
+	peer.stop = make(chan struct{})
+	go dialFederation(peer)
+}
+
+/* Keep an authenticated link to a peer open and send the queued messages on it */
+func dialFederation(peer *FederationPeer) {
+	backoff := time.Second
+	for {
+		err := runFederationLink(peer)
+		peer.connected.Store(false)
+		slog.Debug("Federation link down", "server", peer.Name, "error", err)
+
+		select {
+		case <-peer.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+		if err == nil {
+			backoff = time.Second
+		}
+	}
+}
+
+/* The dialer's side of the handshake, self and key identify this server */
+func dialFederationHandshake(conn *tls.Conn, reader *bufio.Reader, self string, key ed25519.PrivateKey, peer *FederationPeer) error {
+	binding, err := tlsBinding(conn, "EXPORTER-paizer-federation")
+	if err != nil {
+		return err
+	}
+	nonce := newNonce()
+	if err := writeFedMessage(conn, fedMessage{Type: "hello", Version: federationVersion, Server: self, Nonce: nonce}); err != nil {
+		return err
+	}
+	hello, err := readFedMessage(reader)
+	if err != nil {
+		return err
+	}
+	if hello.Type != "hello" || hello.Server != peer.Name || hello.Nonce == "" ||
+		!verifyFederationSignature(peer, federationPayload("acceptor", peer.Name, self, nonce, hello.Nonce, binding), hello.Signature) {
+		slog.Warn("Federation peer failed to authenticate", "server", peer.Name, "addr", peer.Addr)
+		return errors.New("peer authentication failed")
+	}
+	signature := ed25519.Sign(key, federationPayload("dialer", self, peer.Name, nonce, hello.Nonce, binding))
+	if err := writeFedMessage(conn, fedMessage{Type: "auth", Signature: base64.StdEncoding.EncodeToString(signature)}); err != nil {
+		return err
+	}
+	if ready, err := readFedMessage(reader); err != nil || ready.Type != "ready" {
+		return fmt.Errorf("handshake rejected: %v", err)
+	}
+	return nil
+}
+
+/* The acceptor's side of the handshake, returns the peer that dialed in */
+func acceptFederationHandshake(conn *tls.Conn, reader *bufio.Reader, self string, key ed25519.PrivateKey, lookup func(name string) *FederationPeer) (*FederationPeer, error) {
+	binding, err := tlsBinding(conn, "EXPORTER-paizer-federation")
+	if err != nil {
+		return nil, err
+	}
+	hello, err := readFedMessage(reader)
+	if err != nil {
+		return nil, err
+	}
+	if hello.Type != "hello" || hello.Nonce == "" {
+		return nil, errors.New("expected a hello")
+	}
+	if hello.Version != federationVersion {
+		err := fmt.Errorf("unsupported protocol version %d, this server speaks %d", hello.Version, federationVersion)
+		writeFedMessage(conn, fedMessage{Type: "error", Content: err.Error()})
+		return nil, err
+	}
+	peer := lookup(hello.Server)
+	if peer == nil {
+		slog.Warn("Rejected unknown federation server", "server", hello.Server, "ip", conn.RemoteAddr().String())
+		writeFedMessage(conn, fedMessage{Type: "error", Content: "unknown server " + hello.Server})
+		return nil, errors.New("unknown server " + hello.Server)
+	}
+
+	nonce := newNonce()
+	reply := fedMessage{
+		Type:      "hello",
+		Version:   federationVersion,
+		Server:    self,
+		Nonce:     nonce,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, federationPayload("acceptor", self, peer.Name, hello.Nonce, nonce, binding))),
+	}
+	if err := writeFedMessage(conn, reply); err != nil {
+		return nil, err
+	}
+	auth, err := readFedMessage(reader)
+	if err != nil || auth.Type != "auth" || !verifyFederationSignature(peer, federationPayload("dialer", peer.Name, self, hello.Nonce, nonce, binding), auth.Signature) {
+		slog.Warn("Federation server failed to authenticate", "server", peer.Name, "ip", conn.RemoteAddr().String())
+		writeFedMessage(conn, fedMessage{Type: "error", Content: "authentication failed"})
+		return nil, errors.New("authentication failed")
+	}
+	if err := writeFedMessage(conn, fedMessage{Type: "ready"}); err != nil {
+		return nil, err
+	}
+	return peer, nil
+}
+
+func runFederationLink(peer *FederationPeer) error {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", peer.Addr, federationTLS)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := dialFederationHandshake(conn, reader, *federationName, federationKey, peer); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	peer.connected.Store(true)
+	slog.Info("Federation link up", "server", peer.Name)
+
+	/* The peer does not write after the handshake, reading notices when it goes away */
+	dropped := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, reader)
+		close(dropped)
+	}()
+
+	for {
+		select {
+		case <-peer.stop:
+			return nil
+		case <-dropped:
+			return io.EOF
+		case data := <-peer.queue:
+			if _, err := conn.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func acceptFederation(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			slog.Error("Federation listener stopped", "error", err)
+			return
+		}
+		go serveFederation(conn.(*tls.Conn))
+	}
+}
+
+/* Authenticate a peer that dialed in and apply the messages it sends */
+func serveFederation(conn *tls.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	peer, err := acceptFederationHandshake(conn, reader, *federationName, federationKey, federationPeer)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	for {
+		msg, err := readFedMessage(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Info("Federation connection closed", "server", peer.Name, "error", err)
+			}
+			return
+		}
+		handleFederationMessage(peer.Name, msg)
+	}
+}
+
+/* A session for a user of another server, never registered */
+func federatedClient(user string) *Client {
+	return &Client{
+		UID:        "federation-" + user,
+		Username:   user,
+		ClientType: "federation",
+		Account:    &Account{Name: accountKey(user)},
+	}
+}
+
+/*
+ * Apply a message from an authenticated peer:
+ *   dm             a direct message from a user of the peer to one of ours
+ *   room_shared    the peer shares one of its rooms with us
+ *   room_unshared  the peer stopped sharing a room
+ *   room_message   a message in a room the peer shares with us
+ *   room_join      one of the peer's users joined a room we share with it
+ *   room_leave     one of the peer's users left a room we share with it
+ *   room_post      one of the peer's users posts to a room we share with it
+ */
+func handleFederationMessage(server string, msg fedMessage) {
+	/* Senders belong to the server that sent the message, except in the rooms it shares */
+	if msg.User != "" && msg.Type != "room_message" {
+		if _, home := splitAddress(msg.User); home != server {
+			slog.Warn("Federation message with a foreign sender", "server", server, "user", msg.User)
+			return
+		}
+	}
+
+	switch msg.Type {
+	case "dm":
+		name := accountKey(msg.To)
+		dm := Message{Type: "dm", ID: newMessageID(), User: msg.User, To: msg.To, Content: msg.Content, Time: msg.Time}
+		if filterMessage(federatedClient(msg.User), &dm) != nil {
+			return
+		}
+
+		clientsMux.Lock()
+		online := onlineAccounts[name] != nil || remoteOnline(name)
+		if account := onlineAccounts[name]; account != nil {
+			sendToAccount(account, dm)
+		} else {
+			publishCluster(ClusterEvent{Kind: "account", Account: name, Msg: &dm})
+		}
+		clientsMux.Unlock()
+
+		if online || isKnownAccount(name) {
+			recordHistory(dm)
+		}
+		if !online && isKnownAccount(name) {
+			queueOfflineMessage(name, dm)
+		}
+		slog.Info("Federated direct message", "from", msg.User, "to", msg.To, contentAttr(msg.Content))
+
+	case "room_shared", "room_unshared":
+		base, err := roomName(msg.Room)
+		if err != nil || strings.Contains(base, "@") {
+			return
+		}
+		name := base + "@" + server
+
+		clientsMux.Lock()
+		room, exists := rooms[name]
+		if msg.Type == "room_shared" && !exists {
+			room = &Room{Name: name, Home: server, Created: time.Now().Unix(), Members: make(map[string]bool)}
+			rooms[name] = room
+			roomChanged(room)
+		} else if msg.Type == "room_unshared" && exists && room.Home == server {
+			delete(rooms, name)
+			room.Deleted = true
+			roomChanged(room)
+		}
+		clientsMux.Unlock()
+		slog.Info("Federated room "+strings.TrimPrefix(msg.Type, "room_"), "server", server, "room", name)
+
+	case "room_message":
+		base, err := roomName(msg.Room)
+		if err != nil {
+			return
+		}
+		clientsMux.Lock()
+		room := rooms[base+"@"+server]
+		clientsMux.Unlock()
+		_, home := splitAddress(msg.User)
+		if room == nil || room.Home != server || home == "" {
+			return
+		}
+		broadcast(Message{Type: "chat", User: msg.User, Room: room.Name, Content: msg.Content, Time: msg.Time}, "")
+
+	case "room_join", "room_leave":
+		sender := federatedClient(msg.User)
+		account := sender.Account.Name
+		clientsMux.Lock()
+		room := rooms[msg.Room]
+		if room == nil || !slices.Contains(room.Shared, server) || room.Members[account] == (msg.Type == "room_join") {
+			clientsMux.Unlock()
+			return
+		}
+		/* Users of other servers get into public and unlisted rooms, and into the others with an invitation */
+		if msg.Type == "room_join" {
+			denied := checkPermission(sender, "join", room)
+			if denied == nil && (room.Visibility == "invite" || room.Visibility == "password") && !admitToRoom(room, account, "", false) {
+				denied = errors.New("not invited")
+			}
+			if denied != nil {
+				clientsMux.Unlock()
+				slog.Info("Rejected federated room join", "server", server, "user", msg.User, "room", room.Name, "error", denied)
+				return
+			}
+			room.Members[account] = true
+		} else {
+			delete(room.Members, account)
+		}
+		roomChanged(room)
+		clientsMux.Unlock()
+
+		verb := " joined #"
+		if msg.Type == "room_leave" {
+			verb = " left #"
+		}
+		broadcast(Message{Type: msg.Type, User: msg.User, Room: room.Name, Content: msg.User + verb + room.Name}, "")
+
+	case "room_post":
+		sender := federatedClient(msg.User)
+		clientsMux.Lock()
+		room := rooms[msg.Room]
+		denied := errors.New("not a member")
+		if room != nil && slices.Contains(room.Shared, server) && room.Members[sender.Account.Name] {
+			denied = checkPermission(sender, "send", room)
+		}
+		clientsMux.Unlock()
+		if denied != nil {
+			slog.Info("Rejected federated room post", "server", server, "user", msg.User, "room", msg.Room, "error", denied)
+			return
+		}
+		if msg.Content != "" {
+			postChat(sender, room.Name, msg.Content)
+		}
+	}
+}
+
+/*
+ * Relay a room chat message to the other servers of a shared room: posts of
+ * our users to a room of another server go to its home server, and the home
+ * server passes every message on to the servers it shares the room with,
+ * except the one it came from. The caller must hold clientsMux.
+ */
+func forwardRoomMessage(msg Message) {
+	if *federationName == "" || msg.Type != "chat" || msg.Room == "" || len(msg.E2E) > 0 {
+		return
+	}
+	room := rooms[msg.Room]
+	if room == nil {
+		return
+	}
+
+	_, origin := splitAddress(msg.User)
+	if room.Home != "" {
+		if origin == "" {
+			base, _, _ := strings.Cut(room.Name, "@")
+			sendFederation(room.Home, fedMessage{Type: "room_post", Room: base, User: qualify(msg.User), Content: msg.Content, Time: msg.Time})
+		}
+		return
+	}
+	for _, server := range room.Shared {
+		if server != origin {
+			sendFederation(server, fedMessage{Type: "room_message", Room: room.Name, User: qualify(msg.User), Content: msg.Content, Time: msg.Time})
+		}
+	}
+}
+
+/*
+ * Tell the home server of a room it shares with us that one of our users joined
+ * or left it, it only takes posts from members. The caller must hold clientsMux.
+ */
+func federateMembership(room *Room, user string, joined bool) {
+	if room.Home == "" {
+		return
+	}
+	kind := "room_leave"
+	if joined {
+		kind = "room_join"
+	}
+	base, _, _ := strings.Cut(room.Name, "@")
+	sendFederation(room.Home, fedMessage{Type: kind, Room: base, User: qualify(user)})
+}
+
+/* Route a direct message to the home server of its nick@server recipient */
+func relayFederatedDM(client *Client, dm Message) {
+	nick, server := splitAddress(dm.To)
+	notice := ""
+	switch {
+	case len(dm.E2E) > 0:
+		notice = "End-to-end encrypted messages cannot be sent to other servers."
+	case nick == "" || dm.Content == "":
+		return
+	case !sendFederation(server, fedMessage{Type: "dm", User: qualify(client.Username), To: nick, Content: dm.Content, Time: dm.Time}):
+		notice = "Unknown server: " + server
+	}
+	if notice != "" {
+		roomNotice(client, notice)
+		return
+	}
+	recordHistory(dm)
+
+	/* The sender's other sessions see the message too */
+	clientsMux.Lock()
+	for _, session := range client.Account.Sessions {
+		if session != client {
+			sendMessage(session, dm)
+		}
+	}
+	publishCluster(ClusterEvent{Kind: "account", Account: client.Account.Name, Msg: &dm})
+	clientsMux.Unlock()
+}
+
+/* GET /admin/federation */
+func handleAdminFederation(w http.ResponseWriter, r *http.Request) {
+	if *federationName == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "federation is disabled"})
+		return
+	}
+
+	type peerStatus struct {
+		*FederationPeer
+		Connected bool `json:"connected"`
+	}
+	federationMux.Lock()
+	peers := make([]peerStatus, 0, len(federationPeers))
+	for _, peer := range federationPeers {
+		peers = append(peers, peerStatus{peer, peer.connected.Load()})
+	}
+	federationMux.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"server":     *federationName,
+		"addr":       *federationAddr,
+		"version":    federationVersion,
+		"public_key": base64.StdEncoding.EncodeToString(federationKey.Public().(ed25519.PublicKey)),
+		"peers":      peers,
+	})
+}
+
+/* POST /admin/federation/peers {"name", "addr", "public_key"} */
+func handleAdminAddFederationPeer(w http.ResponseWriter, r *http.Request) {
+	if *federationName == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "federation is disabled"})
+		return
+	}
+
+	var peer FederationPeer
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&peer); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	name, err := serverName(peer.Name)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(peer.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "public_key must be a base64 Ed25519 public key"})
+		return
+	}
+	if _, _, err := net.SplitHostPort(peer.Addr); err != nil || name == *federationName {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "addr must be host:port of another server"})
+		return
+	}
+
+	federationMux.Lock()
+	if slices.ContainsFunc(federationPeers, func(existing *FederationPeer) bool { return existing.Name == name }) {
+		federationMux.Unlock()
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "peer already exists"})
+		return
+	}
+	added := &FederationPeer{Name: name, Addr: peer.Addr, PublicKey: peer.PublicKey}
+	federationPeers = append(federationPeers, added)
+	saveFederationPeers()
+	federationMux.Unlock()
+
+	startFederationPeer(added)
+	slog.Info("Admin added federation peer", "server", name, "addr", peer.Addr)
+	writeJSON(w, http.StatusCreated, added)
+}
+
+/* DELETE /admin/federation/peers/{name} */
+func handleAdminDeleteFederationPeer(w http.ResponseWriter, r *http.Request) {
+	federationMux.Lock()
+	var removed *FederationPeer
+	federationPeers = slices.DeleteFunc(federationPeers, func(peer *FederationPeer) bool {
+		if peer.Name == r.PathValue("name") {
+			removed = peer
+			return true
+		}
+		return false
+	})
+	if removed != nil {
+		saveFederationPeers()
+	}
+	federationMux.Unlock()
+
+	if removed == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such peer"})
+		return
+	}
+	close(removed.stop)
+	slog.Info("Admin removed federation peer", "server", removed.Name)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "removed"})
+}
+
+/* POST /admin/federation/share {"room", "server"} and DELETE with the same body to stop sharing */
+func handleAdminShareRoom(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Room   string `json:"room"`
+		Server string `json:"server"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	name, err := roomName(req.Room)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	server, _ := serverName(req.Server)
+	if federationPeer(server) == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such peer"})
+		return
+	}
+	sharing := r.Method == http.MethodPost
+
+	clientsMux.Lock()
+	room, exists := rooms[name]
+	switch {
+	case !exists || room.Home != "":
+		clientsMux.Unlock()
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such local room"})
+		return
+	case room.Encrypted:
+		clientsMux.Unlock()
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "end-to-end encrypted rooms cannot be shared"})
+		return
+	}
+	room.Shared = slices.DeleteFunc(room.Shared, func(existing string) bool { return existing == server })
+	if sharing {
+		room.Shared = append(room.Shared, server)
+	} else {
+		maps.DeleteFunc(room.Members, func(account string, _ bool) bool {
+			_, home := splitAddress(account)
+			return home == server
+		})
+	}
+	roomChanged(room)
+	shared := slices.Clone(room.Shared)
+	clientsMux.Unlock()
+
+	kind := "room_unshared"
+	if sharing {
+		kind = "room_shared"
+	}
+	sendFederation(server, fedMessage{Type: kind, Room: name})
+	slog.Info("Admin changed room sharing", "room", name, "server", server, "shared", sharing)
+	writeJSON(w, http.StatusOK, map[string]any{"room": name, "shared": shared})
+}
+
+/*
+ * IRC gateway: a listener speaking a subset of RFC 1459/2812 so IRC clients can
+ * chat alongside the other clients. The main chat is the channel &main, rooms
+ * are #room channels and nicknames are Paizer nicknames. Sending PASS with a
+ * session token before registering resumes that session's nickname.
+ */
+const (
+	ircMainChannel  = "&main"
+	ircPingInterval = 90 * time.Second
+)
+
+/* A parsed IRC line: COMMAND params... with the trailing parameter last */
+type ircLine struct {
+	Command string
+	Params  []string
+}
+
+func parseIRCLine(line string) ircLine {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	var parsed ircLine
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if strings.HasPrefix(line, ":") {
+			parsed.Params = append(parsed.Params, line[1:])
+			break
+		}
+		var word string
+		word, line, _ = strings.Cut(line, " ")
+		if word == "" {
+			continue
+		}
+		if parsed.Command == "" {
+			parsed.Command = strings.ToUpper(word)
+		} else {
+			parsed.Params = append(parsed.Params, word)
+		}
+	}
+	return parsed
+}
+
+func ircServerName() string {
+	if *federationName != "" {
+		return *federationName
+	}
+	return "paizer"
+}
+
+/* IRC nicknames cannot contain spaces */
+func ircNick(user string) string {
+	return strings.ReplaceAll(user, " ", "_")
+}
+
+func ircPrefix(user string, ip string) string {
+	if ip == "" {
+		ip = ircServerName()
+	}
+	return ircNick(user) + "!" + ircNick(user) + "@" + ip
+}
+
+/* The channel of a message, &main for the main chat */
+func ircChannel(room string) string {
+	if room == "" {
+		return ircMainChannel
+	}
+	return "#" + room
+}
+
+/* Write a numeric or command reply from the server, the last parameter is sent as trailing */
+func ircReply(conn net.Conn, nick string, command string, params ...string) {
+	line := ":" + ircServerName() + " " + command
+	if nick != "" {
+		line += " " + ircNick(nick)
+	}
+	for i, param := range params {
+		if i == len(params)-1 {
+			line += " :" + param
+		} else {
+			line += " " + param
+		}
+	}
+	conn.Write([]byte(line + "\r\n"))
+}
+
+type ircUser struct {
+	Nick string
+	Host string
+}
+
+/*
+ * Online users of a channel across the cluster as seen by an account, rooms that
+ * are not public look like they do not exist to non-members. The caller must hold clientsMux.
+ */
+func ircChannelUsers(channel string, account string) ([]ircUser, bool) {
+	var room *Room
+	if channel != ircMainChannel {
+		room = rooms[strings.TrimPrefix(channel, "#")]
+		if room == nil || !strings.HasPrefix(channel, "#") || !roomVisible(room, account) {
+			return nil, false
+		}
+	}
+
+	seen := make(map[string]bool)
+	var users []ircUser
+	add := func(user string, account string, ip string) {
+		if !seen[account] && (room == nil || room.Members[account]) {
+			seen[account] = true
+			users = append(users, ircUser{ircNick(user), ip})
+		}
+	}
+	for _, client := range clients {
+		add(client.Username, client.Account.Name, client.IP)
+	}
+	for _, session := range allRemoteSessions() {
+		add(session.User, session.Account, session.IP)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Nick < users[j].Nick })
+	return users, true
+}
+
+/* Send the topic and names of a channel, the caller must hold clientsMux */
+func ircSendNames(client *Client, channel string) {
+	users, _ := ircChannelUsers(channel, client.Account.Name)
+	var names []string
+	for _, user := range users {
+		names = append(names, user.Nick)
+	}
+	for len(names) > 0 {
+		n := min(len(names), 40)
+		ircReply(client.Conn, client.Username, "353", "=", channel, strings.Join(names[:n], " "))
+		names = names[n:]
+	}
+	ircReply(client.Conn, client.Username, "366", channel, "End of /NAMES list")
+}
+
+/* Render a message for an IRC session, sendMessage calls this with clientsMux held */
+func formatIRCMessage(client *Client, msg Message) string {
+	self := accountKey(msg.User) == client.Account.Name
+	prefix := ":" + ircPrefix(msg.User, msg.IP)
+	privmsg := func(target string, content string) string {
+		if action, found := strings.CutPrefix(content, "* "); found && !strings.Contains(action, "\n") {
+			content = "\x01ACTION " + action + "\x01"
+		}
+		var out strings.Builder
+		for _, line := range strings.Split(content, "\n") {
+			out.WriteString(prefix + " PRIVMSG " + target + " :" + strings.TrimRight(line, "\r") + "\r\n")
+		}
+		return out.String()
+	}
+	/* IRC lines cannot hold a newline, multi-line notices like /rooms become one NOTICE per line */
+	notice := func(target string, content string) string {
+		var out strings.Builder
+		for _, line := range strings.Split(content, "\n") {
+			if line = strings.TrimRight(line, "\r"); line != "" {
+				out.WriteString(":" + ircServerName() + " NOTICE " + target + " :" + line + "\r\n")
+			}
+		}
+		return out.String()
+	}
+
+	switch msg.Type {
+	case "chat":
+		if len(msg.E2E) > 0 {
+			return notice(ircChannel(msg.Room), "An end-to-end encrypted message from "+msg.User+" cannot be read over IRC.")
+		}
+		return privmsg(ircChannel(msg.Room), msg.Content)
+	case "file":
+		return privmsg(ircChannel(msg.Room), fmt.Sprintf("\x01ACTION shared a file: %s (%s, %d bytes) %s\x01",
+			msg.File.Name, msg.File.MIME, msg.File.Size, fileURL(msg.File.ID, msg.File.Name)))
+	case "dm":
+		if len(msg.E2E) > 0 {
+			return notice(ircNick(client.Username), "An end-to-end encrypted message from "+msg.User+" cannot be read over IRC.")
+		}
+		if self {
+			return privmsg(ircNick(msg.To), msg.Content)
+		}
+		return privmsg(ircNick(client.Username), msg.Content)
+	case "join":
+		return prefix + " JOIN " + ircMainChannel + "\r\n"
+	case "leave":
+		return prefix + " QUIT :" + msg.Content + "\r\n"
+	case "room_join", "room_leave":
+		/* The account's own sessions are told with room_joined and room_left */
+		if self {
+			return ""
+		}
+		if msg.Type == "room_join" {
+			return prefix + " JOIN " + ircChannel(msg.Room) + "\r\n"
+		}
+		return prefix + " PART " + ircChannel(msg.Room) + "\r\n"
+	case "room_joined":
+		channel := ircChannel(msg.Room)
+		client.Conn.Write([]byte(":" + ircPrefix(client.Username, client.IP) + " JOIN " + channel + "\r\n"))
+		ircSendTopic(client, channel)
+		ircSendNames(client, channel)
+		return ""
+	case "room_left":
+		return ":" + ircPrefix(client.Username, client.IP) + " PART " + ircChannel(msg.Room) + "\r\n"
+	case "topic_change":
+		return prefix + " TOPIC " + ircChannel(msg.Room) + " :" + msg.Content + "\r\n"
+	case "invite":
+		return prefix + " INVITE " + ircNick(client.Username) + " " + ircChannel(msg.Room) + "\r\n"
+	case "join_request":
+		return notice(ircChannel(msg.Room), msg.Content)
+	case "system":
+		return notice(ircNick(client.Username), msg.Content)
+	}
+	return ""
+}
+
+/* Send the topic of a channel with RPL_TOPIC and RPL_TOPICWHOTIME, the caller must hold clientsMux */
+func ircSendTopic(client *Client, channel string) {
+	room := rooms[strings.ToLower(strings.TrimPrefix(channel, "#"))]
+	if channel == ircMainChannel || room == nil || room.Topic == "" || !roomVisible(room, client.Account.Name) {
+		ircReply(client.Conn, client.Username, "331", channel, "No topic is set")
+		return
+	}
+	ircReply(client.Conn, client.Username, "332", channel, room.Topic)
+	ircReply(client.Conn, client.Username, "333", channel, ircNick(room.TopicBy), strconv.FormatInt(room.TopicTime/1000, 10))
+}
+
+func startIRCServer() {
+	if *ircAddr == "" {
+		return
+	}
+
+	listener, err := net.Listen("tcp", *ircAddr)
+	if err != nil {
+		fatal("Unable to start IRC gateway", err)
+	}
+	listenersMux.Lock()
+	ircListener = listener
+	listenersMux.Unlock()
+	slog.Info("IRC gateway listening", "addr", *ircAddr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if shuttingDown.Load() {
+				return
+			}
+			slog.Warn("IRC accept failed", "error", err)
+			continue
+		}
+		go handleIRCConnection(conn)
+	}
+}
+
+func handleIRCConnection(conn net.Conn) {
+	conn = &countingConn{Conn: conn, transport: "irc"}
+	defer conn.Close()
+
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+
+	/* Registration: NICK and USER, optionally PASS with a session token first */
+	reader := bufio.NewReader(conn)
+	var nick, pass string
+	var gotUser bool
+	for nick == "" || !gotUser {
+		conn.SetReadDeadline(time.Now().Add(time.Minute))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := parseIRCLine(line)
+		switch cmd.Command {
+		case "CAP":
+			if len(cmd.Params) > 0 && strings.ToUpper(cmd.Params[0]) == "LS" {
+				ircReply(conn, "*", "CAP", "LS", "")
+			} else if len(cmd.Params) > 1 && strings.ToUpper(cmd.Params[0]) == "REQ" {
+				ircReply(conn, "*", "CAP", "NAK", cmd.Params[1])
+			}
+		case "PASS":
+			if len(cmd.Params) > 0 {
+				pass = cmd.Params[0]
+			}
+		case "NICK":
+			if len(cmd.Params) == 0 {
+				ircReply(conn, "*", "431", "No nickname given")
+				continue
+			}
+			nick = cmd.Params[0]
+			if strings.ContainsAny(nick, ",*?!#&:") || (*federationName != "" && strings.Contains(nick, "@")) {
+				ircReply(conn, "*", "432", nick, "Erroneous nickname")
+				nick = ""
+			}
+		case "USER":
+			gotUser = true
+		case "PING":
+			if len(cmd.Params) > 0 {
+				ircReply(conn, "", "PONG", ircServerName(), cmd.Params[0])
+			}
+		case "QUIT":
+			return
+		case "":
+		default:
+			ircReply(conn, "*", "451", "You have not registered")
+		}
+	}
+
+	var token *sessionToken
+	if pass != "" {
+		if token, err = verifySessionToken(pass); err != nil {
+			ircReply(conn, nick, "464", "Session token rejected: "+err.Error())
+			return
+		}
+		nick = token.User
+	}
+	if ban := findBan(nick, ip); ban != nil {
+		slog.Info("Rejected banned login", "username", nick, "ip", ip, "transport", "irc")
+		conn.Write([]byte("ERROR :" + ban.notice() + "\r\n"))
+		return
+	}
+	if token == nil && needsToken(accountKey(nick)) {
+		slog.Info("Rejected login without a session token", "username", nick, "ip", ip, "transport", "irc")
+		ircReply(conn, nick, "464", roleTokenNotice+" Send PASS <token> before NICK.")
+		return
+	}
+
+	uid, mentions := resumeSession(token)
+	client := &Client{
+		UID:        uid,
+		Username:   nick,
+		IP:         ip,
+		Conn:       conn,
+		LastBeat:   time.Now(),
+		ClientType: "irc",
+		Connected:  time.Now(),
+		Token:      token,
+	}
+	if err := pluginsConnect(client); err != nil {
+		conn.Write([]byte("ERROR :" + err.Error() + "\r\n"))
+		return
+	}
+
+	client.logger().Info("Joined the server")
+
+	server := ircServerName()
+	ircReply(conn, nick, "001", "Welcome to Paizer, "+ircPrefix(nick, ip))
+	ircReply(conn, nick, "002", "Your host is "+server+", running Paizer")
+	ircReply(conn, nick, "003", "This server was created "+startTime.Format(time.RFC1123))
+	ircReply(conn, nick, "004", server, "paizer", "i", "nt")
+	ircReply(conn, nick, "005", "CHANTYPES=#&", "NETWORK=Paizer", "NICKLEN=64", "are supported by this server")
+	ircReply(conn, nick, "422", "Chat in "+ircMainChannel+", rooms are #channels and /msg reaches every session of a user")
+
+	var raw string
+	if token == nil {
+		clientsMux.Lock()
+		raw, client.Token = issueSessionToken(nick)
+		clientsMux.Unlock()
+	}
+
+	announceJoin(client)
+	restoreMentions(client, mentions)
+
+	if raw != "" {
+		ircReply(conn, nick, "NOTICE", "Send PASS "+raw+" before NICK to resume this session.")
+	}
+
+	clientsMux.Lock()
+	conn.Write([]byte(":" + ircPrefix(nick, ip) + " JOIN " + ircMainChannel + "\r\n"))
+	ircReply(conn, nick, "331", ircMainChannel, "No topic is set")
+	ircSendNames(client, ircMainChannel)
+	clientsMux.Unlock()
+	sendRoomMemberships(client)
+	deliverOfflineMessages(client)
+
+	/* Clients answer PING, a connection that stays silent after one is dropped */
+	pinged := false
+	for {
+		conn.SetReadDeadline(time.Now().Add(ircPingInterval))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && !pinged {
+				pinged = true
+				ircReply(conn, "", "PING", server)
+				continue
+			}
+			if netErr != nil && netErr.Timeout() {
+				metricHeartbeatTimeouts.Add(1)
+			}
+			client.logger().Info("IRC connection closed", "error", err)
+			removeClient(uid)
+			return
+		}
+		pinged = false
+		client.LastBeat = time.Now()
+
+		cmd := parseIRCLine(line)
+		if cmd.Command == "" {
+			continue
+		}
+		if cmd.Command != "PING" && cmd.Command != "PONG" {
+			metricMessagesReceived.Add("irc", 1)
+		}
+		if cmd.Command == "QUIT" {
+			conn.Write([]byte("ERROR :Closing link\r\n"))
+			removeClient(uid)
+			return
+		}
+		handleIRCCommand(client, cmd)
+	}
+}
+
+func handleIRCCommand(client *Client, cmd ircLine) {
+	conn, nick := client.Conn, client.Username
+	param := func(i int) string {
+		if i < len(cmd.Params) {
+			return cmd.Params[i]
+		}
+		return ""
+	}
+	if needs := map[string]int{"JOIN": 1, "PART": 1, "PRIVMSG": 2, "NOTICE": 2, "NAMES": 1, "TOPIC": 1, "WHOIS": 1, "KICK": 2, "INVITE": 2}[cmd.Command]; len(cmd.Params) < needs {
+		ircReply(conn, nick, "461", cmd.Command, "Not enough parameters")
+		return
+	}
+
+	switch cmd.Command {
+	case "PING":
+		ircReply(conn, "", "PONG", ircServerName(), param(0))
+
+	case "PONG", "CAP", "USER", "AWAY":
+
+	case "NICK":
+		ircReply(conn, nick, "NOTICE", "Changing nicknames is not supported, reconnect with the new nickname.")
+
+	case "JOIN":
+		/* Joining a room that does not exist creates it, like an IRC channel */
+		keys := strings.Split(param(1), ",")
+		for i, channel := range strings.Split(param(0), ",") {
+			if channel == ircMainChannel {
+				continue
+			}
+			name := strings.TrimPrefix(channel, "#")
+			clientsMux.Lock()
+			_, exists := rooms[strings.ToLower(name)]
+			clientsMux.Unlock()
+			if exists || strings.Contains(name, "@") {
+				key := ""
+				if i < len(keys) {
+					key = keys[i]
+				}
+				joinRoom(client, name, key)
+			} else {
+				createRoom(client, name, false)
+			}
+		}
+
+	case "PART":
+		for _, channel := range strings.Split(param(0), ",") {
+			if channel == ircMainChannel {
+				ircReply(conn, nick, "NOTICE", "Everyone stays in "+ircMainChannel+", QUIT to leave the server.")
+				continue
+			}
+			leaveRoom(client, strings.TrimPrefix(channel, "#"))
+		}
+
+	case "PRIVMSG", "NOTICE":
+		text := param(1)
+		if strings.HasPrefix(text, "\x01") {
+			/* Only CTCP ACTION (/me) is relayed, as "* text" */
+			action, found := strings.CutPrefix(strings.Trim(text, "\x01"), "ACTION ")
+			if !found {
+				return
+			}
+			text = "* " + action
+		}
+		for _, target := range strings.Split(param(0), ",") {
+			switch {
+			case target == ircMainChannel:
+				handleChat(client, "", text)
+			case strings.HasPrefix(target, "#"):
+				handleChat(client, strings.TrimPrefix(target, "#"), text)
+			default:
+				relayDM(client, target, text, nil)
+			}
+		}
+
+	case "NAMES":
+		clientsMux.Lock()
+		ircSendNames(client, param(0))
+		clientsMux.Unlock()
+
+	case "WHO":
+		clientsMux.Lock()
+		users, ok := ircChannelUsers(param(0), client.Account.Name)
+		if !ok {
+			/* WHO <nick> */
+			all, _ := ircChannelUsers(ircMainChannel, client.Account.Name)
+			users = slices.DeleteFunc(all, func(user ircUser) bool { return !strings.EqualFold(user.Nick, param(0)) })
+		}
+		clientsMux.Unlock()
+		channel := param(0)
+		if !ok {
+			channel = "*"
+		}
+		for _, user := range users {
+			ircReply(conn, nick, "352", channel, user.Nick, user.Host, ircServerName(), user.Nick, "H", "0 "+user.Nick)
+		}
+		ircReply(conn, nick, "315", param(0), "End of /WHO list")
+
+	case "WHOIS":
+		target := param(len(cmd.Params) - 1)
+		clientsMux.Lock()
+		all, _ := ircChannelUsers(ircMainChannel, client.Account.Name)
+		clientsMux.Unlock()
+		index := slices.IndexFunc(all, func(user ircUser) bool { return strings.EqualFold(user.Nick, target) })
+		if index < 0 {
+			ircReply(conn, nick, "401", target, "No such nick")
+		} else {
+			ircReply(conn, nick, "311", all[index].Nick, all[index].Nick, all[index].Host, "*", all[index].Nick)
+		}
+		ircReply(conn, nick, "318", target, "End of /WHOIS list")
+
+	case "TOPIC":
+		if len(cmd.Params) > 1 {
+			text := param(1)
+			if text == "" {
+				text = "-"
+			}
+			roomTopic(client, strings.TrimPrefix(param(0), "#"), text, false)
+			return
+		}
+		clientsMux.Lock()
+		ircSendTopic(client, param(0))
+		clientsMux.Unlock()
+
+	case "INVITE":
+		inviteUser(client, param(0), strings.TrimPrefix(param(1), "#"))
+
+	case "KICK":
+		room := strings.TrimPrefix(param(0), "#")
+		if param(0) == ircMainChannel {
+			room = ""
+		}
+		for _, target := range strings.Split(param(1), ",") {
+			kickUser(client, target, room, param(2))
+		}
+
+	case "MODE":
+		if strings.HasPrefix(param(0), "#") || param(0) == ircMainChannel {
+			ircReply(conn, nick, "324", param(0), "+nt")
+		} else {
+			ircReply(conn, nick, "221", "+i")
+		}
+
+	case "LIST":
+		ircReply(conn, nick, "321", "Channel", "Users  Name")
+		clientsMux.Lock()
+		main, _ := ircChannelUsers(ircMainChannel, client.Account.Name)
+		ircReply(conn, nick, "322", ircMainChannel, strconv.Itoa(len(main)), "The main chat")
+		for name, room := range rooms {
+			if !roomVisible(room, client.Account.Name) {
+				continue
+			}
+			topic := room.Topic
+			if room.Encrypted {
+				topic = "End-to-end encrypted, not readable over IRC"
+			}
+			ircReply(conn, nick, "322", "#"+name, strconv.Itoa(len(room.Members)), topic)
+		}
+		clientsMux.Unlock()
+		ircReply(conn, nick, "323", "End of /LIST")
+
+	default:
+		ircReply(conn, nick, "421", cmd.Command, "Unknown command")
 	}
 }
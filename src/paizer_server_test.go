@@ -0,0 +1,1806 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/* The newest entry of the webhook delivery log */
+func lastWebhookLog(t *testing.T) webhookLogEntry {
+	t.Helper()
+	webhookLogMux.Lock()
+	defer webhookLogMux.Unlock()
+
+	if len(webhookLog) == 0 {
+		t.Fatal("no webhook delivery was logged")
+	}
+	return webhookLog[len(webhookLog)-1]
+}
+
+func TestWebhookSignature(t *testing.T) {
+	hook := &Webhook{ID: "hook", Secret: "s3cret"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get("X-Paizer-Timestamp")
+
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get("X-Paizer-Signature") != want {
+			t.Errorf("signature = %q, want %q", r.Header.Get("X-Paizer-Signature"), want)
+		}
+		if sent, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(sent, 0)).Abs() > time.Minute {
+			t.Errorf("timestamp = %q", timestamp)
+		}
+		if r.Header.Get("X-Paizer-Event") != "chat" || r.Header.Get("X-Paizer-Delivery") != "d1" {
+			t.Errorf("headers = %v", r.Header)
+		}
+
+		var payload struct {
+			ID      string  `json:"id"`
+			Event   string  `json:"event"`
+			Message Message `json:"message"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil || payload.Event != "chat" || payload.Message.Content != "hello" {
+			t.Errorf("payload = %s, %v", body, err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	hook.URL = server.URL
+
+	webhookDelivery{ID: "d1", Webhook: hook, Event: "chat", Message: Message{Type: "chat", User: "alice", Content: "hello"}}.send()
+
+	if entry := lastWebhookLog(t); entry.ID != "d1" || entry.Attempts != 1 || entry.Status != http.StatusNoContent || entry.Error != "" {
+		t.Errorf("log entry = %+v", entry)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(webhookBackoff)
+	webhookBackoff = time.Millisecond
+
+	tests := []struct {
+		name     string
+		replies  []int // Status of each attempt, the last one repeats
+		attempts int
+		status   int
+		failed   bool
+	}{
+		{"recovers after server errors", []int{503, 500, 200}, 3, 200, false},
+		{"retries rate limits", []int{429, 200}, 2, 200, false},
+		{"gives up after the last attempt", []int{502}, webhookAttempts, 502, true},
+		{"does not retry client errors", []int{400, 200}, 1, 400, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(calls.Add(1))
+				w.WriteHeader(test.replies[min(n, len(test.replies))-1])
+			}))
+			defer server.Close()
+
+			webhookDelivery{ID: test.name, Webhook: &Webhook{ID: "hook", URL: server.URL}, Event: "join"}.send()
+
+			entry := lastWebhookLog(t)
+			if int(calls.Load()) != test.attempts || entry.Attempts != test.attempts || entry.Status != test.status || (entry.Error != "") != test.failed {
+				t.Errorf("%d calls, log entry %+v", calls.Load(), entry)
+			}
+		})
+	}
+}
+
+func TestWebhookWants(t *testing.T) {
+	hook := &Webhook{Events: []string{"chat", "room_join"}, Rooms: []string{"", "dev"}}
+	tests := []struct {
+		event string
+		room  string
+		want  bool
+	}{
+		{"chat", "", true},
+		{"chat", "dev", true},
+		{"room_join", "dev", true},
+		{"chat", "ops", false},
+		{"leave", "", false},
+	}
+	for _, test := range tests {
+		if got := hook.wants(test.event, test.room); got != test.want {
+			t.Errorf("wants(%q, %q) = %v, want %v", test.event, test.room, got, test.want)
+		}
+	}
+	if all := (&Webhook{}); !all.wants("mention", "ops") {
+		t.Error("a webhook without filters should want every event")
+	}
+
+	/* Every event the server emits can be subscribed to */
+	resetServerState(t)
+	defer func() {
+		webhooksMux.Lock()
+		webhooks = nil
+		webhooksMux.Unlock()
+	}()
+	for _, test := range []struct {
+		events string
+		status int
+	}{
+		{`["chat", "join", "leave", "mention"]`, http.StatusCreated},
+		{`["room_join", "room_leave"]`, http.StatusCreated},
+		{`["room_topic"]`, http.StatusBadRequest},
+	} {
+		body := `{"url": "http://127.0.0.1:1/hook", "events": ` + test.events + `}`
+		recorder := httptest.NewRecorder()
+		handleAdminAddWebhook(recorder, httptest.NewRequest("POST", "/admin/webhooks", strings.NewReader(body)))
+		if recorder.Code != test.status {
+			t.Errorf("events %s: status %d, want %d: %s", test.events, recorder.Code, test.status, recorder.Body)
+		}
+	}
+}
+
+/* Collect the events a backplane delivers */
+func subscribe(b Backplane) chan ClusterEvent {
+	events := make(chan ClusterEvent, 16)
+	b.Subscribe(func(ev ClusterEvent) { events <- ev })
+	return events
+}
+
+func waitEvent(t *testing.T, events chan ClusterEvent, kind string) ClusterEvent {
+	t.Helper()
+	for {
+		select {
+		case ev := <-events:
+			if ev.Kind == kind {
+				return ev
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no %q event", kind)
+		}
+	}
+}
+
+func TestMemoryHub(t *testing.T) {
+	hub := NewMemoryHub()
+	a := hub.Attach("a")
+	aEvents := subscribe(a)
+	b := hub.Attach("b")
+	bEvents := subscribe(b)
+
+	if ev := waitEvent(t, aEvents, "peer_up"); ev.Node != "b" {
+		t.Errorf("a saw %q come up", ev.Node)
+	}
+	if ev := waitEvent(t, bEvents, "peer_up"); ev.Node != "a" {
+		t.Errorf("b saw %q come up", ev.Node)
+	}
+
+	/* Events are copied, changing the message after publishing it does not reach the other node */
+	msg := &Message{Type: "chat", Content: "hello"}
+	a.Publish(ClusterEvent{Node: "a", Kind: "broadcast", Msg: msg})
+	msg.Content = "changed"
+	if ev := waitEvent(t, bEvents, "broadcast"); ev.Node != "a" || ev.Msg == msg || ev.Msg.Content != "hello" {
+		t.Errorf("b received %+v", ev)
+	}
+	select {
+	case ev := <-aEvents:
+		t.Errorf("a received its own event %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.Close()
+	if ev := waitEvent(t, aEvents, "peer_down"); ev.Node != "b" {
+		t.Errorf("a saw %q go down", ev.Node)
+	}
+	a.Publish(ClusterEvent{Node: "a", Kind: "broadcast", Msg: msg})
+	select {
+	case ev := <-bEvents:
+		t.Errorf("a closed node received %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMeshBackplane(t *testing.T) {
+	if _, err := newMeshBackplane("a", "127.0.0.1:0", nil, ""); err == nil {
+		t.Fatal("the mesh started without a secret")
+	}
+
+	b, err := newMeshBackplane("b", "127.0.0.1:0", nil, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	bEvents := subscribe(b)
+	addr := b.listener.Addr().String()
+
+	a, err := newMeshBackplane("a", "127.0.0.1:0", []string{addr}, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if ev := waitEvent(t, bEvents, "peer_up"); ev.Node != "a" {
+		t.Errorf("b saw %q come up", ev.Node)
+	}
+	a.Publish(ClusterEvent{Kind: "broadcast", Msg: &Message{Type: "chat", Content: "hello"}})
+	if ev := waitEvent(t, bEvents, "broadcast"); ev.Node != "a" || ev.Msg.Content != "hello" {
+		t.Errorf("b received %+v", ev)
+	}
+
+	/* A node with another secret is turned away */
+	intruder, err := newMeshBackplane("x", "127.0.0.1:0", []string{addr}, "guess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer intruder.Close()
+	intruder.Publish(ClusterEvent{Kind: "broadcast", Msg: &Message{Type: "chat", Content: "spoofed"}})
+	select {
+	case ev := <-bEvents:
+		t.Errorf("b accepted %+v from a node without the secret", ev)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+/* Someone who ends the TLS sessions of both sides cannot pass the handshake on */
+func TestMeshRelay(t *testing.T) {
+	b, err := newMeshBackplane("b", "127.0.0.1:0", nil, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	bEvents := subscribe(b)
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	mallory, err := newSelfSignedTLS("mallory", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", mallory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		in, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer in.Close()
+		out, err := tls.Dial("tcp", b.listener.Addr().String(), mallory)
+		if err != nil {
+			return
+		}
+		defer out.Close()
+		go func() {
+			io.Copy(out, in)
+			out.Close()
+		}()
+		io.Copy(in, out)
+	}()
+
+	a, err := newMeshBackplane("a", "127.0.0.1:0", []string{listener.Addr().String()}, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.Publish(ClusterEvent{Kind: "roles", Roles: map[string]string{"mallory": "owner"}})
+	select {
+	case ev := <-bEvents:
+		t.Errorf("b accepted %+v through the relay", ev)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestMemoryHubSingleNode(t *testing.T) {
+	hub := NewMemoryHub()
+	a := hub.Attach("a")
+	if allocs := testing.AllocsPerRun(10, func() { a.Publish(ClusterEvent{Kind: "broadcast", Msg: &Message{Content: "hi"}}) }); allocs > 1 {
+		t.Errorf("publishing without peers allocated %v times", allocs)
+	}
+}
+
+/* A hello recorded from another handshake does not answer a new challenge */
+func TestMeshHelloReplay(t *testing.T) {
+	b, err := newMeshBackplane("b", "127.0.0.1:0", nil, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	bEvents := subscribe(b)
+
+	conn, err := tls.Dial("tcp", b.listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	binding, err := tlsBinding(conn, "EXPORTER-paizer-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	challenge, err := readMeshHello(reader)
+	if err != nil || challenge.Nonce == "" {
+		t.Fatalf("challenge = %+v, %v", challenge, err)
+	}
+
+	recorded := meshHello{Node: "a", Nonce: "d1", Auth: b.auth("dialer", "a", "an old challenge", "d1", binding)}
+	writeMeshHello(conn, recorded)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if reply, err := readMeshHello(reader); err == nil {
+		t.Errorf("the replayed hello was answered with %+v", reply)
+	}
+	select {
+	case ev := <-bEvents:
+		t.Errorf("b emitted %+v", ev)
+	default:
+	}
+}
+
+/* One side of a federation link, with its own name, key and TLS certificate */
+type testFederationServer struct {
+	name string
+	key  ed25519.PrivateKey
+	tls  *tls.Config
+}
+
+func newTestFederationServer(t *testing.T, name string) *testFederationServer {
+	t.Helper()
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	config, err := newSelfSignedTLS(name, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testFederationServer{name: name, key: key, tls: config}
+}
+
+/* How other servers configure this one */
+func (s *testFederationServer) peer() *FederationPeer {
+	return &FederationPeer{Name: s.name, PublicKey: base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))}
+}
+
+/* Listen on localhost and run the acceptor side of one handshake */
+func (s *testFederationServer) accept(t *testing.T, peers ...*FederationPeer) (string, chan error) {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", s.tls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	result := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		lookup := func(name string) *FederationPeer {
+			for _, peer := range peers {
+				if peer.Name == name {
+					return peer
+				}
+			}
+			return nil
+		}
+		_, err = acceptFederationHandshake(conn.(*tls.Conn), bufio.NewReader(conn), s.name, s.key, lookup)
+		result <- err
+	}()
+	return listener.Addr().String(), result
+}
+
+func (s *testFederationServer) dial(addr string, peer *FederationPeer) error {
+	conn, err := tls.Dial("tcp", addr, s.tls)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return dialFederationHandshake(conn, bufio.NewReader(conn), s.name, s.key, peer)
+}
+
+func TestFederationHandshake(t *testing.T) {
+	alpha := newTestFederationServer(t, "alpha")
+	beta := newTestFederationServer(t, "beta")
+
+	t.Run("authenticates both servers", func(t *testing.T) {
+		addr, accepted := alpha.accept(t, beta.peer())
+		if err := beta.dial(addr, alpha.peer()); err != nil {
+			t.Errorf("dialer: %v", err)
+		}
+		if err := <-accepted; err != nil {
+			t.Errorf("acceptor: %v", err)
+		}
+	})
+
+	t.Run("rejects an unknown server", func(t *testing.T) {
+		addr, accepted := alpha.accept(t)
+		if err := beta.dial(addr, alpha.peer()); err == nil {
+			t.Error("dialer succeeded")
+		}
+		if err := <-accepted; err == nil {
+			t.Error("acceptor succeeded")
+		}
+	})
+
+	t.Run("rejects the wrong key", func(t *testing.T) {
+		impostor := newTestFederationServer(t, "beta")
+		addr, accepted := alpha.accept(t, beta.peer())
+		if err := impostor.dial(addr, alpha.peer()); err == nil {
+			t.Error("the impostor was let in")
+		}
+		if err := <-accepted; err == nil {
+			t.Error("acceptor succeeded")
+		}
+
+		/* The dialer checks the acceptor's key as well */
+		addr, accepted = newTestFederationServer(t, "alpha").accept(t, beta.peer())
+		if err := beta.dial(addr, alpha.peer()); err == nil {
+			t.Error("the dialer trusted the impostor")
+		}
+		<-accepted
+	})
+
+	/* A relay that terminates TLS on both sides and passes the handshake through cannot reuse the signatures */
+	t.Run("rejects a relay", func(t *testing.T) {
+		addr, accepted := alpha.accept(t, beta.peer())
+		mallory := newTestFederationServer(t, "mallory")
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", mallory.tls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func() {
+			in, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer in.Close()
+			out, err := tls.Dial("tcp", addr, mallory.tls)
+			if err != nil {
+				return
+			}
+			defer out.Close()
+			go func() {
+				io.Copy(out, in)
+				out.Close()
+			}()
+			io.Copy(in, out)
+		}()
+
+		if err := beta.dial(listener.Addr().String(), alpha.peer()); err == nil {
+			t.Error("dialer accepted the relayed handshake")
+		}
+		if err := <-accepted; err == nil {
+			t.Error("acceptor accepted the relayed handshake")
+		}
+	})
+}
+
+/* Start a test with an empty server state in a temporary data directory */
+func resetServerState(t *testing.T) {
+	*dataDir = t.TempDir()
+	backplane = NewMemoryHub().Attach(nodeID)
+	clientsMux.Lock()
+	rooms = make(map[string]*Room)
+	serverRoles = make(map[string]string)
+	rolesUpdated = 0
+	joinFailures = make(map[string][]time.Time)
+	clientsMux.Unlock()
+	keysMux.Lock()
+	deviceKeys = make(map[string][]DeviceKey)
+	keysMux.Unlock()
+	historyMux.Lock()
+	history = nil
+	searchIndex = make(map[string][]posting)
+	if historyFile != nil {
+		historyFile.Close()
+		historyFile = nil
+	}
+	historyMux.Unlock()
+}
+
+/* A connection that keeps what the server writes to a JSON lines TCP session */
+type recordedConn struct {
+	net.Conn
+	mu    sync.Mutex
+	lines bytes.Buffer
+}
+
+func (c *recordedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lines.Write(p)
+}
+
+func (c *recordedConn) Close() error { return nil }
+
+/* Take the messages written so far */
+func (c *recordedConn) messages(t *testing.T) []Message {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var messages []Message
+	for _, line := range strings.Split(strings.TrimSpace(c.lines.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var msg Message
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		messages = append(messages, msg)
+	}
+	c.lines.Reset()
+	return messages
+}
+
+/* Log in a TCP session that is removed again when the test ends */
+func testSession(t *testing.T, nick string) (*Client, *recordedConn) {
+	conn := &recordedConn{}
+	client := &Client{UID: nick + "-uid", Username: nick, IP: "127.0.0.1", Conn: conn, ClientType: "tcp", JSONLines: true, Connected: time.Now()}
+	announceJoin(client)
+	rememberAccount(client.Account.Name)
+	t.Cleanup(func() { removeClient(client.UID) })
+	return client, conn
+}
+
+func TestMergeRoles(t *testing.T) {
+	resetServerState(t)
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	serverRoles["alice"] = "admin"
+	rolesChanged()
+	stale := map[string]string{"alice": "admin"}
+	staleTime := rolesUpdated
+
+	/* Taking the role away must survive a resync from a node that did not see it yet */
+	time.Sleep(2 * time.Millisecond)
+	delete(serverRoles, "alice")
+	rolesChanged()
+	mergeRoles(stale, staleTime)
+	if role, exists := serverRoles["alice"]; exists {
+		t.Fatalf("a stale sync brought back alice's %s role", role)
+	}
+
+	mergeRoles(map[string]string{"bob": "moderator"}, rolesUpdated+1)
+	if len(serverRoles) != 1 || serverRoles["bob"] != "moderator" {
+		t.Errorf("newer roles were not taken: %v", serverRoles)
+	}
+
+	/* The roles file keeps the time of the last change across restarts */
+	updated := rolesUpdated
+	serverRoles, rolesUpdated = make(map[string]string), 0
+	if err := initRoles(); err != nil {
+		t.Fatal(err)
+	}
+	if rolesUpdated != updated || serverRoles["bob"] != "moderator" {
+		t.Errorf("loaded %v at %d, want bob at %d", serverRoles, rolesUpdated, updated)
+	}
+}
+
+func TestNeedsToken(t *testing.T) {
+	resetServerState(t)
+	clientsMux.Lock()
+	serverRoles["admin"] = "admin"
+	serverRoles["muted"] = "guest"
+	rooms["dev"] = &Room{Name: "dev", Creator: "carol", Members: map[string]bool{}, Roles: map[string]string{"dave": "moderator", "erin": "member"}}
+	clientsMux.Unlock()
+
+	for account, want := range map[string]bool{"admin": true, "carol": true, "dave": true, "muted": false, "erin": false, "frank": false} {
+		if got := needsToken(account); got != want {
+			t.Errorf("needsToken(%q) = %v, want %v", account, got, want)
+		}
+	}
+}
+
+func TestFederatedRoomMembers(t *testing.T) {
+	resetServerState(t)
+	clientsMux.Lock()
+	rooms["dev"] = &Room{Name: "dev", Members: map[string]bool{}, Shared: []string{"beta"}}
+	rooms["secret"] = &Room{Name: "secret", Members: map[string]bool{}, Shared: []string{"beta"}, Visibility: "invite"}
+	clientsMux.Unlock()
+	posted := func(content string) bool {
+		historyMux.Lock()
+		defer historyMux.Unlock()
+		return len(history) > 0 && history[len(history)-1].Content == content
+	}
+
+	handleFederationMessage("beta", fedMessage{Type: "room_post", Room: "dev", User: "bob@beta", Content: "before joining"})
+	if posted("before joining") {
+		t.Error("a user of another server posted without joining")
+	}
+
+	handleFederationMessage("beta", fedMessage{Type: "room_join", Room: "dev", User: "bob@beta"})
+	handleFederationMessage("beta", fedMessage{Type: "room_post", Room: "dev", User: "bob@beta", Content: "hello"})
+	if !posted("hello") {
+		t.Error("a member from another server could not post")
+	}
+
+	/* A guest in the room keeps its membership but may not post */
+	clientsMux.Lock()
+	rooms["dev"].Roles = map[string]string{"bob@beta": "guest"}
+	clientsMux.Unlock()
+	handleFederationMessage("beta", fedMessage{Type: "room_post", Room: "dev", User: "bob@beta", Content: "as a guest"})
+	if posted("as a guest") {
+		t.Error("a guest from another server posted")
+	}
+
+	handleFederationMessage("beta", fedMessage{Type: "room_join", Room: "secret", User: "bob@beta"})
+	handleFederationMessage("beta", fedMessage{Type: "room_join", Room: "dev", User: "mallory@gamma"})
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+	if rooms["secret"].Members["bob@beta"] {
+		t.Error("a user of another server joined an invite-only room uninvited")
+	}
+	if rooms["dev"].Members["mallory@gamma"] {
+		t.Error("a server joined a user of another server")
+	}
+}
+
+func TestPublishKeyLimit(t *testing.T) {
+	resetServerState(t)
+	client := &Client{UID: "u1", Username: "alice", ClientType: "federation", Account: &Account{Name: "alice"}}
+	newKey := func() string {
+		key := make([]byte, 32)
+		rand.Read(key)
+		return base64.StdEncoding.EncodeToString(key)
+	}
+	devices := func() []DeviceKey {
+		keysMux.Lock()
+		defer keysMux.Unlock()
+		return slices.Clone(deviceKeys["alice"])
+	}
+
+	for range maxDeviceKeys {
+		publishKey(client, newKey())
+	}
+	owner := devices()
+
+	/* Devices in use are not pushed out by a new one */
+	extra := newKey()
+	publishKey(client, extra)
+	if got := devices(); len(got) != maxDeviceKeys || slices.ContainsFunc(got, func(k DeviceKey) bool { return k.Key == extra }) {
+		t.Fatalf("a full directory took a new key: %d keys", len(got))
+	}
+
+	/* Publishing a known key again keeps its device in use */
+	old := time.Now().Add(-deviceKeyIdle - time.Hour).Unix()
+	keysMux.Lock()
+	for i := range deviceKeys["alice"] {
+		deviceKeys["alice"][i].Published, deviceKeys["alice"][i].Seen = old, old
+	}
+	keysMux.Unlock()
+	publishKey(client, owner[0].Key)
+	publishKey(client, extra)
+
+	got := devices()
+	if len(got) != maxDeviceKeys || !slices.ContainsFunc(got, func(k DeviceKey) bool { return k.Key == extra }) {
+		t.Fatalf("the new key did not replace an idle one: %d keys", len(got))
+	}
+	if !slices.ContainsFunc(got, func(k DeviceKey) bool { return k.Device == owner[0].Device }) {
+		t.Error("the key of a device in use was replaced")
+	}
+	if slices.ContainsFunc(got, func(k DeviceKey) bool { return k.Device == owner[1].Device }) {
+		t.Error("the longest idle key was kept")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram(0.001, 0.01, 0.1)
+	h.Observe(500 * time.Microsecond)
+	h.Observe(5 * time.Millisecond)
+	h.Observe(time.Second)
+
+	/* Buckets are cumulative, the last observation only lands in +Inf */
+	for i, want := range []int64{1, 2, 2} {
+		if got := h.Counts[i].Load(); got != want {
+			t.Errorf("bucket le=%g = %d, want %d", h.Bounds[i], got, want)
+		}
+	}
+	if h.Count.Load() != 3 || time.Duration(h.Sum.Load()) != time.Second+5500*time.Microsecond {
+		t.Errorf("count %d, sum %v", h.Count.Load(), time.Duration(h.Sum.Load()))
+	}
+}
+
+func TestTransportCounter(t *testing.T) {
+	var c transportCounter
+	c.Add("tcp", 2)
+	c.Add("sse", 3)
+	c.Add("irc", 4)
+	c.Add("websocket", 5)
+	c.Add("federation", 1)
+	c.Add("webhook", 1)
+	if c.TCP.Load() != 2 || c.SSE.Load() != 3 || c.IRC.Load() != 4 || c.WebSocket.Load() != 5 {
+		t.Errorf("tcp %d, sse %d, irc %d, websocket %d", c.TCP.Load(), c.SSE.Load(), c.IRC.Load(), c.WebSocket.Load())
+	}
+	if total := c.Total(); total != 14 {
+		t.Errorf("total %d, want 14", total)
+	}
+}
+
+func TestAdminStatsMessages(t *testing.T) {
+	resetServerState(t)
+	before := metricMessagesReceived.Total()
+	for _, transport := range []string{"tcp", "websocket", "sse", "irc"} {
+		metricMessagesReceived.Add(transport, 1)
+	}
+
+	recorder := httptest.NewRecorder()
+	handleAdminStats(recorder, httptest.NewRequest("GET", "/admin/stats", nil))
+	var stats struct {
+		Received int64 `json:"messages_received"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Received != before+4 {
+		t.Errorf("messages_received = %d, want %d", stats.Received, before+4)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	clientsMux.Lock()
+	saved := clients
+	clients = map[string]*Client{
+		"1": {UID: "1", ClientType: "tcp"},
+		"2": {UID: "2", ClientType: "tcp"},
+		"3": {UID: "3", ClientType: "irc"},
+	}
+	clientsMux.Unlock()
+	defer func() {
+		clientsMux.Lock()
+		clients = saved
+		clientsMux.Unlock()
+	}()
+	rateLimited := metricRateLimited.Load()
+	metricRateLimited.Add(1)
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	/* Every sample is "<name>[{labels}] <number>" and belongs to a declared metric */
+	samples := make(map[string]string)
+	declared := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+		if fields := strings.Fields(line); strings.HasPrefix(line, "# TYPE ") && len(fields) == 4 {
+			declared[fields[2]] = true
+			continue
+		} else if strings.HasPrefix(line, "#") {
+			continue
+		}
+		series, value, found := strings.Cut(line, " ")
+		if _, err := strconv.ParseFloat(value, 64); !found || err != nil {
+			t.Errorf("malformed sample %q", line)
+			continue
+		}
+		name, _, _ := strings.Cut(series, "{")
+		base := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count")
+		if !declared[name] && !declared[base] {
+			t.Errorf("sample %q has no TYPE line", line)
+		}
+		samples[series] = value
+	}
+
+	want := map[string]string{
+		`paizer_connected_clients{transport="tcp"}`:       "2",
+		`paizer_connected_clients{transport="irc"}`:       "1",
+		`paizer_connected_clients{transport="websocket"}`: "0",
+		`paizer_rate_limited_total`:                       strconv.FormatInt(rateLimited+1, 10),
+	}
+	for series, value := range want {
+		if samples[series] != value {
+			t.Errorf("%s = %q, want %q", series, samples[series], value)
+		}
+	}
+	for _, series := range []string{`paizer_broadcast_duration_seconds_bucket{le="+Inf"}`, "paizer_broadcast_duration_seconds_count", "go_goroutines"} {
+		if _, exists := samples[series]; !exists {
+			t.Errorf("missing %s", series)
+		}
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	tests := map[string][]string{
+		"Hello, World! v2.0": {"hello", "world", "v2", "0"},
+		"Go语言很好用":            {"go", "语言很好用"},
+		"今天天气不错。明天见":         {"今天天气不错", "明天见"},
+		"カタカナとひらがな":          {"カタカナとひらがな"},
+		"안녕하세요 여러분":          {"안녕하세요", "여러분"},
+		"café naïve":         {"café", "naïve"},
+		"  ...  ":            nil,
+		"Paizer聊天2024年":      {"paizer", "聊天", "2024", "年"},
+	}
+	for text, want := range tests {
+		if got := searchTerms(text); !slices.Equal(got, want) {
+			t.Errorf("searchTerms(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestTermTokens(t *testing.T) {
+	tests := map[string][]string{
+		"hello": {"hello"},
+		"天":     {"天"},
+		"天气":    {"天气"},
+		"今天天气":  {"今天", "天天", "天气"},
+		"안녕하세요": {"안녕", "녕하", "하세", "세요"},
+	}
+	for term, want := range tests {
+		if got := termTokens(term); !slices.Equal(got, want) {
+			t.Errorf("termTokens(%q) = %q, want %q", term, got, want)
+		}
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	tests := []struct {
+		text  string
+		terms []string
+		want  string
+	}{
+		{"Deploy the Go server", []string{"go"}, "Deploy the **Go** server"},
+		{"going to gophercon, go!", []string{"go"}, "going to gophercon, **go**!"},
+		{"明天我们讨论天气预报", []string{"天气"}, "明天我们讨论**天气**预报"},
+		{"今天天气不错", []string{"天天"}, "今**天天**气不错"},
+		{"Paizer聊天很方便", []string{"paizer", "聊天"}, "**Paizer聊天**很方便"},
+		{"line one\nline two", []string{"two"}, "line one line **two**"},
+	}
+	for _, test := range tests {
+		if got := searchSnippet(test.text, test.terms); got != test.want {
+			t.Errorf("searchSnippet(%q, %q) = %q, want %q", test.text, test.terms, got, test.want)
+		}
+	}
+
+	/* Long messages are cut around the first match */
+	long := strings.Repeat("前", 200) + "关键词" + strings.Repeat("后", 200)
+	got := searchSnippet(long, []string{"关键词"})
+	if !strings.HasPrefix(got, "…") || !strings.HasSuffix(got, "…") || !strings.Contains(got, "**关键词**") {
+		t.Errorf("long snippet = %q", got)
+	}
+	if n := len([]rune(strings.ReplaceAll(strings.Trim(got, "…"), "**", ""))); n != 120 {
+		t.Errorf("long snippet has %d characters, want 120", n)
+	}
+}
+
+func TestSearchHistoryCJK(t *testing.T) {
+	resetServerState(t)
+	historyMux.Lock()
+	for i, content := range []string{"明天的天气怎么样", "天气预报说明天下雨", "今天去北京开会", "weather report"} {
+		history = append(history, Message{Type: "chat", ID: strconv.Itoa(i), User: "alice", Content: content, Time: int64(i + 1)})
+		indexMessage(i, history[i])
+	}
+	historyMux.Unlock()
+	client := &Client{UID: "u1", Username: "bob", ClientType: "federation", Account: &Account{Name: "bob"}}
+
+	search := func(text string) []string {
+		var ids []string
+		for _, result := range searchHistory(client, searchQuery{Text: text, Page: 1}).Results {
+			ids = append(ids, result.ID)
+		}
+		return ids
+	}
+	/* A CJK query matches inside longer runs, every bigram of it has to be there */
+	if got := search("天气"); !slices.Equal(got, []string{"1", "0"}) {
+		t.Errorf("天气 found %q", got)
+	}
+	if got := search("北京"); !slices.Equal(got, []string{"2"}) {
+		t.Errorf("北京 found %q", got)
+	}
+	if got := search("天气预报"); !slices.Equal(got, []string{"1"}) {
+		t.Errorf("天气预报 found %q", got)
+	}
+	if got := search("北京天气"); len(got) != 0 {
+		t.Errorf("北京天气 found %q", got)
+	}
+	page := searchHistory(client, searchQuery{Text: "明天 下雨", Page: 1})
+	if len(page.Results) != 1 || page.Results[0].Snippet != "天气预报说**明天下雨**" {
+		t.Errorf("明天 下雨 = %+v", page.Results)
+	}
+}
+
+func TestAdminImportFiles(t *testing.T) {
+	resetServerState(t)
+	content := []byte("stored file")
+	sum := sha256.Sum256(content)
+	id := hex.EncodeToString(sum[:])
+	if err := os.MkdirAll(filepath.Dir(filePath(id)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filePath(id), content, 0644)
+
+	importLine := func(msg Message) int {
+		data, _ := json.Marshal(msg)
+		rec := httptest.NewRecorder()
+		handleAdminImport(rec, httptest.NewRequest("POST", "/admin/import", bytes.NewReader(data)))
+		return rec.Code
+	}
+	missing := strings.Repeat("ab", sha256.Size)
+	for name, file := range map[string]*FileInfo{
+		"no file":     nil,
+		"short ID":    {ID: "a", Name: "x"},
+		"path":        {ID: "../../x", Name: "x"},
+		"not hex":     {ID: strings.Repeat("zz", sha256.Size), Name: "x"},
+		"not SHA-256": {ID: id[:12], Name: "x"},
+		"not stored":  {ID: missing, Name: "x"},
+	} {
+		if code := importLine(Message{Type: "file", ID: name, User: "alice", Time: 1, File: file}); code != http.StatusBadRequest {
+			t.Errorf("%s: import returned %d, want 400", name, code)
+		}
+	}
+	historyMux.Lock()
+	n := len(history)
+	historyMux.Unlock()
+	if n != 0 {
+		t.Fatalf("rejected lines were imported: %d messages", n)
+	}
+
+	if code := importLine(Message{Type: "file", ID: "ok", User: "alice", Time: 1, File: &FileInfo{ID: id, Name: "notes.txt"}}); code != http.StatusOK {
+		t.Errorf("a stored file was rejected with %d", code)
+	}
+}
+
+func TestAdminExportRoom(t *testing.T) {
+	resetServerState(t)
+	clientsMux.Lock()
+	rooms["dev"] = &Room{Name: "dev", Members: map[string]bool{}}
+	clientsMux.Unlock()
+
+	export := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleAdminExport(rec, httptest.NewRequest("GET", "/admin/export?"+query, nil))
+		return rec
+	}
+	if rec := export("room=%23Dev&format=text"); rec.Code != http.StatusOK || rec.Header().Get("Content-Disposition") != `attachment; filename=paizer-dev.txt` {
+		t.Errorf("export of #dev = %d, %q", rec.Code, rec.Header().Get("Content-Disposition"))
+	}
+	if rec := export("room=a%22b%3Bc"); rec.Code != http.StatusBadRequest {
+		t.Errorf("export of an invalid room name = %d", rec.Code)
+	}
+	if rec := export("room=nowhere"); rec.Code != http.StatusNotFound {
+		t.Errorf("export of an unknown room = %d", rec.Code)
+	}
+}
+
+/* An SSE connection to a test server, events are read as they arrive */
+type testSSE struct {
+	base   string
+	key    string
+	events chan Message
+}
+
+func openSSE(t *testing.T) *testSSE {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sse", handleSSE)
+	mux.HandleFunc("POST /sse/send", handleSSESend)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	resp, err := http.Get(server.URL + "/sse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	s := &testSSE{base: server.URL, events: make(chan Message, 100)}
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var msg Message
+			if data, found := strings.CutPrefix(scanner.Text(), "data: "); found && json.Unmarshal([]byte(data), &msg) == nil {
+				s.events <- msg
+			}
+		}
+		close(s.events)
+	}()
+	s.key = s.next(t, "stream").Content
+	return s
+}
+
+func (s *testSSE) post(msg Message) int {
+	data, _ := json.Marshal(msg)
+	resp, err := http.Post(s.base+"/sse/send?stream="+s.key, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+/* The next event of a type, skipping the others */
+func (s *testSSE) next(t *testing.T, kind string) Message {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case msg, ok := <-s.events:
+			if !ok {
+				t.Fatalf("the stream closed before a %s event", kind)
+			}
+			if msg.Type == kind {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", kind)
+		}
+	}
+}
+
+func TestSSEHandshake(t *testing.T) {
+	resetServerState(t)
+	if err := initOfflineStore(); err != nil {
+		t.Fatal(err)
+	}
+	queueOfflineMessage("alice", Message{Type: "dm", User: "bob", Content: "while you were away"})
+	s := openSSE(t)
+
+	if code := (&testSSE{base: s.base, key: "unknown"}).post(Message{Type: "join", User: "alice"}); code != http.StatusNotFound {
+		t.Errorf("join on an unknown stream = %d", code)
+	}
+	if code := s.post(Message{Type: "join", User: "alice"}); code != http.StatusNoContent {
+		t.Fatalf("join = %d", code)
+	}
+	if code := s.post(Message{Type: "join", User: "mallory"}); code != http.StatusConflict {
+		t.Errorf("second join = %d", code)
+	}
+
+	/* A request right after the join waits for the session, which has its token by then */
+	if code := s.post(Message{Type: "logout"}); code != http.StatusNoContent {
+		t.Errorf("logout = %d", code)
+	}
+	welcome := s.next(t, "system")
+	if welcome.Token == "" || welcome.UID == "" {
+		t.Fatalf("welcome = %+v", welcome)
+	}
+	if _, err := verifySessionToken(welcome.Token); err == nil {
+		t.Error("the token survived the logout")
+	}
+	loggedOut := false
+	for msg := range s.events {
+		loggedOut = loggedOut || (msg.Type == "system" && strings.Contains(msg.Content, "logged out"))
+	}
+	if !loggedOut {
+		t.Error("the stream closed without the logout notice")
+	}
+
+	/* The welcome is sent in the background, its last step takes the offline messages */
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		offlineMux.Lock()
+		_, err := os.Stat(offlineQueuePath("alice"))
+		offlineMux.Unlock()
+		if os.IsNotExist(err) {
+			return
+		}
+	}
+	t.Error("the offline messages were not delivered")
+}
+
+func TestRoomInvites(t *testing.T) {
+	resetServerState(t)
+	alice, aliceConn := testSession(t, "alice")
+	bob, _ := testSession(t, "bob")
+	carol, _ := testSession(t, "carol")
+	dave, daveConn := testSession(t, "dave")
+	createRoom(alice, "club", false)
+	setRoomVisibility(alice, "club", "invite", "")
+	member := func(account string) bool {
+		clientsMux.Lock()
+		defer clientsMux.Unlock()
+		return rooms["club"].Members[account]
+	}
+	aliceConn.messages(t)
+
+	/* Joining without an invitation asks the moderators */
+	joinRoom(bob, "club", "")
+	if member("bob") {
+		t.Fatal("bob joined an invite-only room uninvited")
+	}
+	if !slices.ContainsFunc(aliceConn.messages(t), func(msg Message) bool { return msg.Type == "join_request" && msg.User == "bob" }) {
+		t.Error("the owner was not asked to let bob in")
+	}
+	answerJoinRequest(alice, "club", "bob", true)
+	if !member("bob") {
+		t.Error("an approved request did not join bob")
+	}
+
+	/* A link for one use lets in one account */
+	createInviteLink(alice, "club", time.Hour, 1)
+	clientsMux.Lock()
+	code := rooms["club"].Invites[0].Code
+	clientsMux.Unlock()
+	joinRoom(carol, "club", code)
+	joinRoom(dave, "club", code)
+	if !member("carol") || member("dave") {
+		t.Errorf("carol joined %v, dave joined %v with a link for one use", member("carol"), member("dave"))
+	}
+	if !slices.ContainsFunc(daveConn.messages(t), func(msg Message) bool { return strings.HasPrefix(msg.Content, "Wrong password or invite code") }) {
+		t.Error("dave was not told the code is no longer valid")
+	}
+
+	/* Expired links and invitations do not let anyone in */
+	createInviteLink(alice, "club", time.Hour, 0)
+	inviteUser(alice, "dave", "club")
+	clientsMux.Lock()
+	expired := time.Now().Add(-time.Second).UnixMilli()
+	rooms["club"].Invites[0].Expires = expired
+	rooms["club"].Invited["dave"] = expired
+	code = rooms["club"].Invites[0].Code
+	clientsMux.Unlock()
+	joinRoom(dave, "club", "")
+	joinRoom(dave, "club", code)
+	if member("dave") {
+		t.Error("dave joined with an expired invitation or link")
+	}
+
+	/* A turned down request is gone */
+	answerJoinRequest(alice, "club", "dave", false)
+	clientsMux.Lock()
+	_, asked := rooms["club"].Requests["dave"]
+	clientsMux.Unlock()
+	if asked || member("dave") {
+		t.Error("a turned down request was kept")
+	}
+}
+
+func TestRoomPasswordPermission(t *testing.T) {
+	resetServerState(t)
+	alice, _ := testSession(t, "alice")
+	bob, bobConn := testSession(t, "bob")
+	createRoom(alice, "club", false)
+	joinRoom(bob, "club", "")
+	bobConn.messages(t)
+
+	setRoomVisibility(bob, "club", "password", "hunter2")
+	clientsMux.Lock()
+	visibility := rooms["club"].Visibility
+	clientsMux.Unlock()
+	if visibility != "" {
+		t.Errorf("a member made the room %q", visibility)
+	}
+	if messages := bobConn.messages(t); len(messages) != 1 || messages[0].Type != "system" {
+		t.Errorf("bob was told %+v", messages)
+	}
+
+	setRoomVisibility(alice, "club", "password", "hunter2")
+	clientsMux.Lock()
+	hash := rooms["club"].Password
+	clientsMux.Unlock()
+	if !checkRoomPassword(hash, "hunter2") {
+		t.Error("the owner could not set a password")
+	}
+}
+
+func TestMentionOutsideRoom(t *testing.T) {
+	resetServerState(t)
+	alice, _ := testSession(t, "alice")
+	_, bobConn := testSession(t, "bob")
+	carol, carolConn := testSession(t, "carol")
+	createRoom(alice, "club", false)
+	joinRoom(carol, "club", "")
+	setRoomVisibility(alice, "club", "invite", "")
+	bobConn.messages(t)
+	carolConn.messages(t)
+
+	postChat(alice, "club", "the code is 1234 @bob @carol")
+	mention := func(conn *recordedConn) Message {
+		for _, msg := range conn.messages(t) {
+			if msg.Type == "mention" {
+				return msg
+			}
+		}
+		t.Fatal("no mention was sent")
+		return Message{}
+	}
+	if got := mention(bobConn); got.Content != "" || got.Room != "club" {
+		t.Errorf("bob, who is not a member, got %+v", got)
+	}
+	if got := mention(carolConn); got.Content != "the code is 1234 @bob @carol" {
+		t.Errorf("carol got %+v", got)
+	}
+}
+
+func TestValidateFlags(t *testing.T) {
+	defer func(interval time.Duration, rate int) { *retentionInterval, *incomingRate = interval, rate }(*retentionInterval, *incomingRate)
+	if err := validateFlags(); err != nil {
+		t.Fatalf("the defaults were rejected: %v", err)
+	}
+	*retentionInterval = 0
+	if validateFlags() == nil {
+		t.Error("-retention-interval 0 was accepted")
+	}
+	*retentionInterval, *incomingRate = time.Hour, 0
+	if validateFlags() == nil {
+		t.Error("-incoming-rate 0 was accepted")
+	}
+}
+
+func TestPurgeHistory(t *testing.T) {
+	resetServerState(t)
+	if err := initFileStore(); err != nil {
+		t.Fatal(err)
+	}
+	defer func(age time.Duration) { *retentionAge = age }(*retentionAge)
+	*retentionAge = time.Hour
+	clientsMux.Lock()
+	rooms["logs"] = &Room{Name: "logs", Members: map[string]bool{}, Retention: &Retention{MaxCount: 2}}
+	rooms["legal"] = &Room{Name: "legal", Members: map[string]bool{}, Retention: &Retention{MaxAge: "1m", LegalHold: true}}
+	clientsMux.Unlock()
+
+	storeFile := func(content string) *FileInfo {
+		sum := sha256.Sum256([]byte(content))
+		id := hex.EncodeToString(sum[:])
+		os.MkdirAll(filepath.Dir(filePath(id)), 0755)
+		if err := os.WriteFile(filePath(id), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return &FileInfo{ID: id, Name: "a.txt", Size: int64(len(content))}
+	}
+	purged, shared := storeFile("purged attachment"), storeFile("shared attachment")
+
+	old := time.Now().Add(-2 * time.Hour).UnixMilli()
+	recent := time.Now().UnixMilli()
+	messages := []struct {
+		msg  Message
+		kept bool
+	}{
+		{Message{Type: "chat", Content: "old", Time: old}, false},
+		{Message{Type: "file", File: purged, Time: old}, false},
+		{Message{Type: "file", File: shared, Time: old}, false},
+		{Message{Type: "chat", Room: "legal", Content: "on hold", Time: old}, true},
+		{Message{Type: "chat", Room: "logs", Content: "logs 1", Time: recent}, false},
+		{Message{Type: "chat", Room: "logs", Content: "logs 2", Time: recent}, true},
+		{Message{Type: "chat", Room: "logs", Content: "logs 3", Time: recent}, true},
+		{Message{Type: "file", File: shared, Time: recent}, true},
+		{Message{Type: "chat", Content: "new", Time: recent}, true},
+	}
+	var want []Message
+	var wantBytes int64
+	historyMux.Lock()
+	for _, m := range messages {
+		history = append(history, m.msg)
+		if m.kept {
+			want = append(want, m.msg)
+		} else {
+			data, _ := json.Marshal(m.msg)
+			wantBytes += int64(len(data)) + 1
+		}
+	}
+	historyMux.Unlock()
+	wantBytes += purged.Size
+	before := metricPurgedBytes.Load()
+
+	run := purgeHistory()
+	if run.Messages != 4 || run.Files != 1 || run.Bytes != wantBytes {
+		t.Errorf("run = %+v, want 4 messages, 1 file and %d bytes", run, wantBytes)
+	}
+	if got := metricPurgedBytes.Load() - before; got != wantBytes {
+		t.Errorf("purged bytes metric grew by %d, want %d", got, wantBytes)
+	}
+	historyMux.Lock()
+	got := slices.Clone(history)
+	historyMux.Unlock()
+	if len(got) != len(want) {
+		t.Fatalf("kept %d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Content != want[i].Content || got[i].Room != want[i].Room || got[i].Time != want[i].Time {
+			t.Errorf("message %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if _, err := os.Stat(filePath(purged.ID)); !os.IsNotExist(err) {
+		t.Error("the attachment of a purged message was kept")
+	}
+	if _, err := os.Stat(filePath(shared.ID)); err != nil {
+		t.Error("an attachment that is still referenced was deleted")
+	}
+
+	/* The compacted history file holds what was kept */
+	data, err := os.ReadFile(historyPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != len(want) {
+		t.Errorf("history file has %d lines, want %d", lines, len(want))
+	}
+}
+
+func TestSessionTokens(t *testing.T) {
+	resetServerState(t)
+	if err := initSessionTokens(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, issued := issueSessionToken("alice")
+	token, err := verifySessionToken(raw)
+	if err != nil || token.ID != issued.ID || token.User != "alice" {
+		t.Fatalf("verify = %+v, %v", token, err)
+	}
+
+	/* The signature covers the payload */
+	payload, signature, _ := strings.Cut(raw, ".")
+	forged, _ := json.Marshal(sessionToken{ID: issued.ID, User: "admin", Expires: issued.Expires})
+	for _, bad := range []string{
+		payload,
+		payload + "." + signature[:len(signature)-2],
+		base64.RawURLEncoding.EncodeToString(forged) + "." + signature,
+	} {
+		if _, err := verifySessionToken(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+
+	defer func(ttl time.Duration) { *tokenTTL = ttl }(*tokenTTL)
+	*tokenTTL = -time.Minute
+	expired, _ := issueSessionToken("alice")
+	if _, err := verifySessionToken(expired); err == nil || err.Error() != "token expired" {
+		t.Errorf("expired token: %v", err)
+	}
+
+	/* A revoked token cannot resume its session, also after a restart */
+	client := &Client{UID: "42", Username: "alice", Token: issued}
+	suspendSession(client, nil)
+	revokeSessionToken(issued.ID, issued.Expires)
+	if _, err := verifySessionToken(raw); err == nil || err.Error() != "token revoked" {
+		t.Errorf("revoked token: %v", err)
+	}
+	if uid, _ := resumeSession(issued); uid == "42" {
+		t.Error("a revoked token resumed its session")
+	}
+	tokensMux.Lock()
+	revokedTokens = make(map[string]int64)
+	tokensMux.Unlock()
+	if err := initSessionTokens(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifySessionToken(raw); err == nil {
+		t.Error("the revocation was lost on restart")
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	resetServerState(t)
+	if err := initSessionTokens(); err != nil {
+		t.Fatal(err)
+	}
+	_, token := issueSessionToken("alice")
+	mention := Message{Type: "mention", User: "bob", Content: "@alice"}
+	suspendSession(&Client{UID: "42", Username: "alice", Token: token}, []Message{mention})
+
+	uid, mentions := resumeSession(token)
+	if uid != "42" || len(mentions) != 1 || mentions[0].Content != "@alice" {
+		t.Errorf("resumed %q with %+v", uid, mentions)
+	}
+	if uid, _ := resumeSession(token); uid == "42" {
+		t.Error("a session was resumed twice")
+	}
+}
+
+/* A plugin that records its hooks, appends its name to messages and rejects those containing reject */
+type testPlugin struct {
+	BasePlugin
+	name   string
+	reject string
+	calls  *[]string
+}
+
+func (p *testPlugin) Name() string { return p.name }
+
+func (p *testPlugin) Filter(client *Client, msg *Message) error {
+	*p.calls = append(*p.calls, p.name)
+	if p.reject != "" && strings.Contains(msg.Content, p.reject) {
+		return errors.New(p.reject + " is not allowed")
+	}
+	msg.Content += " " + p.name
+	msg.Annotate("seen", p.name)
+	return nil
+}
+
+/* A plugin that records the connection hooks and refuses the nick and room named refuse */
+type hookPlugin struct {
+	BasePlugin
+	refuse string
+	calls  []string
+}
+
+func (p *hookPlugin) Name() string { return "hooks" }
+
+func (p *hookPlugin) Connect(client *Client) error {
+	p.calls = append(p.calls, "connect "+client.Username)
+	if client.Username == p.refuse {
+		return errors.New("go away")
+	}
+	return nil
+}
+
+func (p *hookPlugin) Disconnect(client *Client) {
+	p.calls = append(p.calls, "disconnect "+client.Username)
+}
+
+func (p *hookPlugin) Join(client *Client, room string) error {
+	p.calls = append(p.calls, "join "+room)
+	if room == p.refuse {
+		return errors.New("not here")
+	}
+	return nil
+}
+
+func (p *hookPlugin) Leave(client *Client, room string) {
+	p.calls = append(p.calls, "leave "+room)
+}
+
+/* Run a test with its own plugin chain */
+func usePlugins(t *testing.T, chain ...Plugin) {
+	saved := plugins
+	plugins = chain
+	t.Cleanup(func() { plugins = saved })
+}
+
+func TestFilterMessage(t *testing.T) {
+	resetServerState(t)
+	var calls []string
+	usePlugins(t, &testPlugin{name: "a", reject: "spam", calls: &calls}, &testPlugin{name: "b", calls: &calls})
+	client := &Client{UID: "u1", Username: "alice", ClientType: "federation"}
+
+	msg := Message{Type: "chat", Content: "hello"}
+	if err := filterMessage(client, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Content != "hello a b" || msg.Annotations["seen"] != "b" || !slices.Equal(calls, []string{"a", "b"}) {
+		t.Errorf("content %q, annotations %v, calls %v", msg.Content, msg.Annotations, calls)
+	}
+
+	/* The first rejection stops the chain */
+	calls = nil
+	spam := Message{Type: "chat", Content: "buy spam"}
+	if err := filterMessage(client, &spam); err == nil || err.Error() != "spam is not allowed" {
+		t.Errorf("err = %v", err)
+	}
+	if !slices.Equal(calls, []string{"a"}) {
+		t.Errorf("calls %v after a rejection", calls)
+	}
+
+	alice, _ := testSession(t, "alice")
+	if err := postChat(alice, "", "more spam"); err == nil {
+		t.Error("a rejected message was posted")
+	}
+	historyMux.Lock()
+	posted := len(history)
+	historyMux.Unlock()
+	if posted != 0 {
+		t.Errorf("%d messages in the history after a rejection", posted)
+	}
+}
+
+/* A plugin with only a name, BasePlugin provides the hooks */
+type namedPlugin struct{ BasePlugin }
+
+func (namedPlugin) Name() string { return "named" }
+
+func TestBasePlugin(t *testing.T) {
+	usePlugins(t, namedPlugin{})
+	client := &Client{UID: "u1", Username: "alice", ClientType: "federation"}
+	msg := Message{Type: "chat", Content: "hello"}
+	if pluginsConnect(client) != nil || pluginsJoin(client, "dev") != nil || filterMessage(client, &msg) != nil {
+		t.Error("BasePlugin refused something")
+	}
+	pluginsLeave(client, "dev")
+	pluginsDisconnect(client)
+	if msg.Content != "hello" || msg.Annotations != nil {
+		t.Errorf("BasePlugin changed the message to %+v", msg)
+	}
+}
+
+func TestWordFilter(t *testing.T) {
+	filter := newWordFilter(" darn, heck ,")
+	client := &Client{Username: "alice"}
+	msg := Message{Type: "chat", Content: "Darn it, heckler, what the heck!"}
+	filter.Filter(client, &msg)
+	if msg.Content != "**** it, heckler, what the ****!" || msg.Annotations["filtered"] != "word-filter" {
+		t.Errorf("filtered to %q with %v", msg.Content, msg.Annotations)
+	}
+
+	clean := Message{Type: "dm", Content: "hello"}
+	filter.Filter(client, &clean)
+	if clean.Content != "hello" || clean.Annotations != nil {
+		t.Errorf("a clean message became %+v", clean)
+	}
+}
+
+func TestPluginHooks(t *testing.T) {
+	resetServerState(t)
+	hooks := &hookPlugin{refuse: "mallory"}
+	usePlugins(t, hooks)
+
+	if err := pluginsConnect(&Client{Username: "mallory"}); err == nil {
+		t.Error("a refused login was let in")
+	}
+	alice, _ := testSession(t, "alice")
+	createRoom(alice, "dev", false)
+	createRoom(alice, "mallory", false)
+	leaveRoom(alice, "dev")
+	removeClient(alice.UID)
+
+	clientsMux.Lock()
+	_, refused := rooms["mallory"]
+	clientsMux.Unlock()
+	if refused {
+		t.Error("a refused room was created")
+	}
+	want := []string{"connect mallory", "join dev", "join mallory", "leave dev", "disconnect alice"}
+	if !slices.Equal(hooks.calls, want) {
+		t.Errorf("calls %v, want %v", hooks.calls, want)
+	}
+}
+
+/* POST a file to /upload with an optional bearer token and announced checksum */
+func uploadFile(t *testing.T, token string, name string, content string, checksum string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if checksum != "" {
+		form.WriteField("sha256", checksum)
+	}
+	part, _ := form.CreateFormFile("file", name)
+	part.Write([]byte(content))
+	form.Close()
+
+	r := httptest.NewRequest("POST", "/upload", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	handleFileUpload(recorder, r)
+	return recorder
+}
+
+func TestFileUpload(t *testing.T) {
+	resetServerState(t)
+	if err := initFileStore(); err != nil {
+		t.Fatal(err)
+	}
+	if err := initSessionTokens(); err != nil {
+		t.Fatal(err)
+	}
+	content := "hello file"
+	sum := sha256.Sum256([]byte(content))
+	id := hex.EncodeToString(sum[:])
+
+	token, _ := issueSessionToken("alice")
+	forged, _, _ := strings.Cut(token, ".")
+	for _, bad := range []string{"", forged + ".c2lnbmF0dXJl"} {
+		if got := uploadFile(t, bad, "a.txt", content, ""); got.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: status %d", bad, got.Code)
+		}
+	}
+
+	if got := uploadFile(t, token, "a.txt", content, strings.Repeat("0", 64)); got.Code != http.StatusBadRequest {
+		t.Errorf("wrong checksum: status %d", got.Code)
+	}
+
+	got := uploadFile(t, token, "a.txt", content, id)
+	var info FileInfo
+	if got.Code != http.StatusOK || json.Unmarshal(got.Body.Bytes(), &info) != nil || info.ID != id || info.Size != int64(len(content)) {
+		t.Fatalf("status %d: %s", got.Code, got.Body)
+	}
+	if data, err := os.ReadFile(filePath(id)); err != nil || string(data) != content {
+		t.Errorf("stored %q, %v", data, err)
+	}
+
+	defer func(size, quota int64) { *maxFileSize, *uploadQuota = size, quota }(*maxFileSize, *uploadQuota)
+	*maxFileSize = 4
+	if got := uploadFile(t, token, "a.txt", content, ""); got.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("a file over the size limit: status %d", got.Code)
+	}
+	*maxFileSize, *uploadQuota = 1<<20, 15
+	bob, _ := issueSessionToken("bob")
+	uploadFile(t, bob, "a.txt", content, "")
+	if got := uploadFile(t, bob, "a.txt", content, ""); got.Code != http.StatusTooManyRequests {
+		t.Errorf("an upload over the quota: status %d", got.Code)
+	}
+}
+
+func TestFileDownload(t *testing.T) {
+	resetServerState(t)
+	if err := initFileStore(); err != nil {
+		t.Fatal(err)
+	}
+	page := "<html><script>alert(1)</script></html>"
+	sum := sha256.Sum256([]byte(page))
+	id := hex.EncodeToString(sum[:])
+	os.MkdirAll(filepath.Dir(filePath(id)), 0755)
+	if err := os.WriteFile(filePath(id), []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	download := func(target string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handleFileDownload(recorder, httptest.NewRequest("GET", target, nil))
+		return recorder
+	}
+
+	/* A page is served as an attachment in a sandbox, whatever its name says */
+	got := download("/files/" + id[:12] + "?name=../../evil.png")
+	if got.Code != http.StatusOK || got.Body.String() != page {
+		t.Fatalf("status %d: %q", got.Code, got.Body)
+	}
+	headers := map[string]string{
+		"Content-Type":            "text/html; charset=utf-8",
+		"X-Content-Type-Options":  "nosniff",
+		"Content-Security-Policy": "sandbox",
+		"Content-Disposition":     "attachment; filename=evil.png",
+		"ETag":                    `"` + id + `"`,
+	}
+	for name, want := range headers {
+		if value := got.Header().Get(name); value != want {
+			t.Errorf("%s: %q, want %q", name, value, want)
+		}
+	}
+	if disposition := download("/files/" + id).Header().Get("Content-Disposition"); disposition != "attachment; filename="+id {
+		t.Errorf("without a name: %q", disposition)
+	}
+
+	for _, target := range []string{"/files/" + strings.Repeat("0", 64), "/files/../session.key", "/files/abc"} {
+		if got := download(target); got.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d", target, got.Code)
+		}
+	}
+}
+
+/* The client end of an IRC connection served by handleIRCConnection */
+type ircTestConn struct {
+	conn  net.Conn
+	lines chan string
+}
+
+func dialIRC(t *testing.T) *ircTestConn {
+	server, conn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		handleIRCConnection(server)
+		close(done)
+	}()
+	c := &ircTestConn{conn: conn, lines: make(chan string, 100)}
+	go func() {
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			c.lines <- strings.TrimSuffix(scanner.Text(), "\r")
+		}
+		close(c.lines)
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	return c
+}
+
+func (c *ircTestConn) send(lines ...string) {
+	for _, line := range lines {
+		c.conn.Write([]byte(line + "\r\n"))
+	}
+}
+
+/* Wait for a line that contains every part */
+func (c *ircTestConn) expect(t *testing.T, parts ...string) string {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				t.Fatalf("connection closed while waiting for %q", parts)
+			}
+			if !slices.ContainsFunc(parts, func(part string) bool { return !strings.Contains(line, part) }) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("no line with %q", parts)
+		}
+	}
+}
+
+func TestIRCRegistration(t *testing.T) {
+	resetServerState(t)
+	if err := initSessionTokens(); err != nil {
+		t.Fatal(err)
+	}
+	irc := dialIRC(t)
+	irc.send("JOIN #dev")
+	irc.expect(t, " 451 ", "You have not registered")
+	irc.send("NICK bad#nick")
+	irc.expect(t, " 432 ", "bad#nick")
+	irc.send("NICK alice", "USER alice 0 * :Alice")
+	irc.expect(t, " 001 alice ", "Welcome to Paizer")
+	notice := irc.expect(t, "NOTICE alice", "Send PASS ")
+	irc.expect(t, " JOIN "+ircMainChannel)
+
+	/* The token in the notice resumes the account */
+	raw := strings.Fields(notice[strings.Index(notice, "Send PASS ")+len("Send PASS "):])[0]
+	resumed := dialIRC(t)
+	resumed.send("PASS "+raw, "NICK someone", "USER x 0 * :X")
+	resumed.expect(t, " 001 alice ")
+
+	rejected := dialIRC(t)
+	rejected.send("PASS forged.token", "NICK mallory", "USER x 0 * :X")
+	rejected.expect(t, " 464 ", "Session token rejected")
+}
+
+func TestIRCJoinAndPrivmsg(t *testing.T) {
+	resetServerState(t)
+	if err := initSessionTokens(); err != nil {
+		t.Fatal(err)
+	}
+	bob, bobConn := testSession(t, "bob")
+	irc := dialIRC(t)
+	irc.send("NICK alice", "USER alice 0 * :Alice")
+	irc.expect(t, " JOIN "+ircMainChannel)
+
+	/* JOIN creates a room that does not exist yet */
+	irc.send("JOIN #dev")
+	irc.expect(t, "alice!", " JOIN #dev")
+	clientsMux.Lock()
+	room := rooms["dev"]
+	clientsMux.Unlock()
+	if room == nil || room.Creator != "alice" {
+		t.Fatalf("JOIN #dev made %+v", room)
+	}
+	joinRoom(bob, "dev", "")
+	bobConn.messages(t)
+
+	received := func(kind string, content string) Message {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			for _, msg := range bobConn.messages(t) {
+				if msg.Type == kind && msg.Content == content {
+					return msg
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("bob got no %s %q", kind, content)
+		return Message{}
+	}
+	irc.send("PRIVMSG #dev :hello room")
+	if msg := received("chat", "hello room"); msg.Room != "dev" || msg.User != "alice" {
+		t.Errorf("room message %+v", msg)
+	}
+	irc.send("PRIVMSG " + ircMainChannel + " :hello everyone")
+	if msg := received("chat", "hello everyone"); msg.Room != "" {
+		t.Errorf("main chat message %+v", msg)
+	}
+	irc.send("PRIVMSG bob :psst")
+	received("dm", "psst")
+	irc.send("PRIVMSG #dev :\x01ACTION waves\x01")
+	received("chat", "* waves")
+
+	/* Messages of other users arrive as PRIVMSG */
+	postChat(bob, "dev", "hi alice")
+	irc.expect(t, ":bob!", "PRIVMSG #dev :hi alice")
+}